@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wanjie-dev/wmimage/pkg/manager"
+)
+
+const configEnv = "VMIMAGE_CONFIG"
+
+// fileConfig 是 --config 指定的 JSON 配置文件，字段均可选
+type fileConfig struct {
+	UserName            string   `json:"username"`
+	Password            string   `json:"password"`
+	CredentialsFile     string   `json:"credentialsFile"`
+	RootCacheDir        string   `json:"rootCacheDir"`
+	CacheMaxSize        int64    `json:"cacheMaxSize"`
+	UploadChunkSize     int64    `json:"uploadChunkSize"`
+	DownloadConcurrency int      `json:"downloadConcurrency"`
+	BackendType         string   `json:"backend"`
+	OCILayoutDir        string   `json:"ociLayoutDir"`
+	Versioning          string   `json:"versioning"`
+	CAFile              string   `json:"caFile"`
+	CertFile            string   `json:"certFile"`
+	KeyFile             string   `json:"keyFile"`
+	CertDir             string   `json:"certDir"`
+	InsecureRegistries  []string `json:"insecureRegistries"`
+	PlainHTTPRegistries []string `json:"plainHTTPRegistries"`
+	Proxy               string   `json:"proxy"`
+	DialTimeout         string   `json:"dialTimeout"`
+	ResponseTimeout     string   `json:"responseTimeout"`
+	RetryAttempts       int      `json:"retryAttempts"`
+	RetryBackoff        string   `json:"retryBackoff"`
+	RetryMaxBackoff     string   `json:"retryMaxBackoff"`
+}
+
+// globalOptions 是所有子命令共用的参数
+type globalOptions struct {
+	configPath      string
+	userName        string
+	password        string
+	passwordStdin   bool
+	credentialsFile string
+	rootCacheDir    string
+	insecure        stringList
+	plainHTTP       stringList
+	jsonOutput      bool
+}
+
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (o *globalOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.configPath, "config", "", "config file, default $"+configEnv+" or ~/.config/vmimage/config.json")
+	fs.StringVar(&o.userName, "username", "", "registry user name")
+	fs.StringVar(&o.password, "password", "", "registry password, prefer --password-stdin")
+	fs.BoolVar(&o.passwordStdin, "password-stdin", false, "read the registry password from stdin")
+	fs.StringVar(&o.credentialsFile, "credentials-file", "", `JSON file with {"username","password"} or a Harbor robot account`)
+	fs.StringVar(&o.rootCacheDir, "cache-dir", "", "local cache directory")
+	fs.Var(&o.insecure, "insecure", "registry host that skips TLS verification, repeatable")
+	fs.Var(&o.plainHTTP, "plain-http", "registry host accessed over plain HTTP, repeatable")
+	fs.BoolVar(&o.jsonOutput, "json", false, "print machine readable JSON")
+}
+
+func defaultConfigPath() string {
+	if path := os.Getenv(configEnv); path != "" {
+		return path
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "vmimage", "config.json")
+}
+
+// loadFileConfig 读取配置文件，未显式指定且默认路径不存在时返回空配置
+func loadFileConfig(path string) (*fileConfig, error) {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	config := &fileConfig{}
+	if path == "" {
+		return config, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	return d, nil
+}
+
+// buildConfig 合并命令行参数与配置文件。凭据按以下顺序查找：
+// --username/--password、--credentials-file、HARBOR_USERNAME/HARBOR_PASSWORD、
+// 配置文件、docker config.json/auth.json
+func buildConfig(opts *globalOptions, stdin io.Reader) (*manager.FmConfig, error) {
+	fc, err := loadFileConfig(opts.configPath)
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout, err := parseDuration("dialTimeout", fc.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	responseTimeout, err := parseDuration("responseTimeout", fc.ResponseTimeout)
+	if err != nil {
+		return nil, err
+	}
+	retryBackoff, err := parseDuration("retryBackoff", fc.RetryBackoff)
+	if err != nil {
+		return nil, err
+	}
+	retryMaxBackoff, err := parseDuration("retryMaxBackoff", fc.RetryMaxBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	password := opts.password
+	if opts.passwordStdin {
+		content, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+	if opts.userName == "" && password != "" {
+		return nil, errors.New("--password requires --username")
+	}
+
+	providers := []manager.CredentialProvider{}
+	if opts.userName != "" {
+		providers = append(providers, manager.StaticCredentials(opts.userName, password))
+	}
+	if opts.credentialsFile != "" {
+		providers = append(providers, manager.FileCredentials(opts.credentialsFile))
+	}
+	providers = append(providers, manager.EnvCredentials("", ""))
+	if fc.UserName != "" {
+		providers = append(providers, manager.StaticCredentials(fc.UserName, fc.Password))
+	}
+	if fc.CredentialsFile != "" {
+		providers = append(providers, manager.FileCredentials(fc.CredentialsFile))
+	}
+	providers = append(providers, manager.DockerConfigCredentials())
+
+	rootCacheDir := opts.rootCacheDir
+	if rootCacheDir == "" {
+		rootCacheDir = fc.RootCacheDir
+	}
+	if rootCacheDir == "" {
+		if cacheDir, err := os.UserCacheDir(); err == nil {
+			rootCacheDir = filepath.Join(cacheDir, "vmimage")
+		}
+	}
+
+	return &manager.FmConfig{
+		RootCacheDir:        rootCacheDir,
+		Credentials:         manager.ChainCredentials(providers...),
+		UploadChunkSize:     fc.UploadChunkSize,
+		CacheMaxSize:        fc.CacheMaxSize,
+		DownloadConcurrency: fc.DownloadConcurrency,
+		BackendType:         fc.BackendType,
+		OCILayoutDir:        fc.OCILayoutDir,
+		Versioning:          manager.VersioningPolicy(fc.Versioning),
+		Retry: manager.RetryPolicy{
+			MaxAttempts:    fc.RetryAttempts,
+			InitialBackoff: retryBackoff,
+			MaxBackoff:     retryMaxBackoff,
+		},
+		Transport: manager.TransportConfig{
+			CAFile:                fc.CAFile,
+			CertFile:              fc.CertFile,
+			KeyFile:               fc.KeyFile,
+			CertDir:               fc.CertDir,
+			InsecureRegistries:    append(fc.InsecureRegistries, opts.insecure...),
+			PlainHTTPRegistries:   append(fc.PlainHTTPRegistries, opts.plainHTTP...),
+			Proxy:                 fc.Proxy,
+			DialTimeout:           dialTimeout,
+			ResponseHeaderTimeout: responseTimeout,
+		},
+	}, nil
+}
@@ -0,0 +1,587 @@
+// Command vmimage 通过 Harbor/OCI registry 上传、下载和管理虚拟机镜像文件。
+//
+// 退出码：0 成功，1 执行失败，2 参数或配置错误，130 被中断
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wanjie-dev/wmimage/pkg/manager"
+)
+
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitUsage       = 2
+	exitInterrupted = 130
+)
+
+const defaultTag = "latest"
+
+// usageError 表示命令行参数错误，对应退出码 2
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, env *cmdEnv, args []string) error
+}
+
+// cmdEnv 是子命令执行时的上下文
+type cmdEnv struct {
+	opts   *globalOptions
+	config *manager.FmConfig
+	fm     manager.FileManager
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// 子命令自己的参数
+	tag           string
+	mediaType     string
+	versioning    string
+	digest        string
+	progress      string
+	page          int
+	pageSize      int
+	yes           bool
+	name          string
+	all           bool
+	containerDisk bool
+	arch          string
+	sort          string
+	query         string
+	filter        string
+}
+
+// print 在 --json 时输出 v 的 JSON，否则调用 text 输出可读文本
+func (e *cmdEnv) print(v interface{}, text func(w io.Writer)) error {
+	if e.opts.jsonOutput {
+		encoder := json.NewEncoder(e.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	text(tw)
+	return tw.Flush()
+}
+
+func commands() []*command {
+	return []*command{
+		{name: "push", args: "<file|dir|->... <repository>[:tag]", summary: "upload a file, a directory or several files, - reads from stdin", run: runPush},
+		{name: "pull", args: "<repository>[:tag] <target>", summary: "download the latest file, a named file or all files of a tag", run: runPull},
+		{name: "ls", args: "<repository>", summary: "list artifacts of a Harbor repository", run: runList},
+		{name: "repos", args: "<registry>/<project>", summary: "list repositories of a project", run: runRepos},
+		{name: "tags", args: "<repository>", summary: "list tags of a repository", run: runTags},
+		{name: "versions", args: "<repository>[:tag]", summary: "list the files kept in a tag, newest first", run: runVersions},
+		{name: "inspect", args: "<repository>[:tag]", summary: "show digests and tags of an image", run: runInspect},
+		{name: "digest", args: "<repository>[:tag]", summary: "print the digest of the latest file of a tag", run: runDigest},
+		{name: "rm", args: "<repository>:<tag>", summary: "delete an image", run: runRemove},
+		{name: "rm-repo", args: "<repository>", summary: "delete a repository and all of its images", run: runRemoveRepo},
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: vmimage <command> [flags] <args>")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-8s %-34s %s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "vmimage <command> -h" for the flags of a command.`)
+	fmt.Fprintln(w, "Exit codes: 0 success, 1 failure, 2 usage or config error, 130 interrupted.")
+}
+
+// parseInterspersed 允许参数与 flag 交错出现，返回所有位置参数
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// splitReference 把 hub.xxxx.com/vmimages/ubuntu:22.04 拆分为仓库和 tag，没有 tag 时返回 defaultTag
+func splitReference(ref string) (string, string) {
+	slash := strings.LastIndex(ref, "/")
+	colon := strings.LastIndex(ref, ":")
+	if colon > slash {
+		return ref[:colon], ref[colon+1:]
+	}
+	return ref, defaultTag
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		usage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	var cmd *command
+	for _, c := range commands() {
+		if c.name == args[0] {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "vmimage: unknown command %q\n\n", args[0])
+		usage(stderr)
+		return exitUsage
+	}
+
+	env := &cmdEnv{opts: &globalOptions{}, stdin: stdin, stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("vmimage "+cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: vmimage %s [flags] %s\n\nFlags:\n", cmd.name, cmd.args)
+		fs.PrintDefaults()
+	}
+	env.opts.register(fs)
+	switch cmd.name {
+	case "push":
+		fs.StringVar(&env.tag, "tag", "", "tag to push, overrides the tag in the reference")
+		fs.StringVar(&env.mediaType, "media-type", "", "layer media type, detected from the file header by default")
+		fs.StringVar(&env.versioning, "versioning", "", "replace, append or keep-last-N, overrides the config file")
+		fs.StringVar(&env.name, "name", "", "file name recorded in the artifact, defaults to the local file name")
+		fs.BoolVar(&env.containerDisk, "container-disk", false, "publish a qcow2 or raw disk as a KubeVirt containerDisk image")
+		fs.StringVar(&env.arch, "arch", "", "architecture of the containerDisk image, defaults to the local architecture")
+		fs.StringVar(&env.progress, "progress", "auto", progressUsage)
+	case "pull":
+		fs.StringVar(&env.digest, "digest", "", "download this blob digest instead of the latest file of the tag")
+		fs.StringVar(&env.name, "name", "", "download the file with this name")
+		fs.BoolVar(&env.all, "all", false, "download all named files of the tag into the target directory")
+		fs.BoolVar(&env.containerDisk, "container-disk", false, "extract the disk from a KubeVirt containerDisk image")
+		fs.StringVar(&env.arch, "arch", "", "architecture to pick from a multi-arch containerDisk image, defaults to the local architecture")
+		fs.StringVar(&env.progress, "progress", "auto", progressUsage)
+	case "ls":
+		fs.IntVar(&env.page, "page", 1, "page number")
+		fs.IntVar(&env.pageSize, "page-size", 20, "page size")
+		fs.BoolVar(&env.all, "all", false, "list all artifacts instead of one page")
+		fs.StringVar(&env.sort, "sort", "", "sort order, e.g. -push_time")
+		fs.StringVar(&env.query, "query", "", "Harbor q= filter, e.g. tags=~22.04,media_type=application/vnd.oci.image.manifest.v1+json")
+	case "repos":
+		fs.StringVar(&env.filter, "filter", "", "only list repositories whose name contains this text")
+	case "rm-repo":
+		fs.BoolVar(&env.yes, "yes", false, "confirm deleting the repository")
+	}
+	positional, err := parseInterspersed(fs, args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	err = func() error {
+		if env.config, err = buildConfig(env.opts, stdin); err != nil {
+			return &usageError{msg: err.Error()}
+		}
+		if env.fm, err = manager.New(env.config); err != nil {
+			return &usageError{msg: err.Error()}
+		}
+		return cmd.run(ctx, env, positional)
+	}()
+	return reportError(ctx, env.opts, stderr, err)
+}
+
+func reportError(ctx context.Context, opts *globalOptions, stderr io.Writer, err error) int {
+	if err == nil {
+		return exitOK
+	}
+	code := exitError
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		code = exitUsage
+	case ctx.Err() != nil:
+		code = exitInterrupted
+	}
+	if opts.jsonOutput {
+		_ = json.NewEncoder(stderr).Encode(map[string]interface{}{"error": err.Error(), "exitCode": code})
+	} else {
+		fmt.Fprintf(stderr, "vmimage: %v\n", err)
+	}
+	return code
+}
+
+func expectArgs(args []string, n int, names string) error {
+	if len(args) != n {
+		return usageErrorf("expected %s, got %d argument(s)", names, len(args))
+	}
+	return nil
+}
+
+func runPush(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) < 2 {
+		return usageErrorf("expected <file|dir|->... <repository>[:tag], got %d argument(s)", len(args))
+	}
+	sources := args[:len(args)-1]
+	repo, tag := splitReference(args[len(args)-1])
+	if env.tag != "" {
+		tag = env.tag
+	}
+	opts := &manager.UploadOptions{
+		MediaType:  env.mediaType,
+		Versioning: manager.VersioningPolicy(env.versioning),
+		Title:      env.name,
+	}
+	ctx, finish, err := env.withProgress(ctx)
+	if err != nil {
+		return err
+	}
+	defer finish()
+	if env.containerDisk {
+		if len(sources) > 1 || sources[0] == "-" {
+			return usageErrorf("--container-disk expects a single disk file")
+		}
+		layer, err := env.fm.PublishContainerDisk(ctx, sources[0], repo, tag, &manager.ContainerDiskOptions{Name: env.name, Architecture: env.arch})
+		if err != nil {
+			return err
+		}
+		result := map[string]interface{}{"repository": repo, "tag": tag, "digest": layer.Digest.String(), "size": layer.Size}
+		return env.print(result, func(w io.Writer) {
+			fmt.Fprintf(w, "published %s as containerDisk %s:%s\n", sources[0], repo, tag)
+			fmt.Fprintf(w, "layer digest:\t%s\nlayer size:\t%d\n", layer.Digest, layer.Size)
+		})
+	}
+	// 多个文件或一个目录作为一组文件上传，替换 tag 中已有的文件
+	if info, statErr := os.Stat(sources[0]); len(sources) > 1 || statErr == nil && info.IsDir() {
+		var blobInfos []types.BlobInfo
+		if len(sources) > 1 {
+			for _, source := range sources {
+				if source == "-" {
+					return usageErrorf("- can not be combined with other files")
+				}
+			}
+			blobInfos, err = env.fm.UploadFiles(ctx, sources, repo, tag, opts)
+		} else {
+			blobInfos, err = env.fm.UploadDirectory(ctx, sources[0], repo, tag, opts)
+		}
+		if err != nil {
+			return err
+		}
+		return env.printFiles(repo, tag, blobInfos)
+	}
+	var blobInfo *types.BlobInfo
+	if args[0] == "-" {
+		// 从标准输入流式上传，例如 qemu-img convert -O qcow2 src.vmdk /dev/stdout | vmimage push - repo:tag
+		if env.opts.passwordStdin {
+			return usageErrorf("--password-stdin can not be used when pushing from stdin")
+		}
+		blobInfo, err = env.fm.UploadReader(ctx, env.stdin, -1, repo, tag, opts)
+	} else {
+		blobInfo, err = env.fm.UploadFileWithOptions(ctx, args[0], repo, tag, opts)
+	}
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{
+		"repository": repo,
+		"tag":        tag,
+		"digest":     blobInfo.Digest.String(),
+		"size":       blobInfo.Size,
+		"mediaType":  blobInfo.MediaType,
+	}
+	return env.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "pushed %s to %s:%s\n", args[0], repo, tag)
+		fmt.Fprintf(w, "digest:\t%s\nsize:\t%d\nmedia type:\t%s\n", blobInfo.Digest, blobInfo.Size, blobInfo.MediaType)
+	})
+}
+
+func runPull(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 2, "<repository>[:tag] <target>"); err != nil {
+		return err
+	}
+	selectors := 0
+	for _, set := range []bool{env.all, env.name != "", env.digest != "", env.containerDisk} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return usageErrorf("--all, --name, --digest and --container-disk are mutually exclusive")
+	}
+	repo, tag := splitReference(args[0])
+	ctx, finish, err := env.withProgress(ctx)
+	if err != nil {
+		return err
+	}
+	defer finish()
+	if env.all {
+		blobInfos, err := env.fm.DownloadDirectory(ctx, repo, tag, args[1])
+		if err != nil {
+			return err
+		}
+		return env.printFiles(repo, tag, blobInfos)
+	}
+	result := map[string]interface{}{"repository": repo, "tag": tag, "path": args[1]}
+	if env.containerDisk {
+		layer, err := env.fm.ImportContainerDisk(ctx, repo, tag, args[1], &manager.ContainerDiskOptions{Architecture: env.arch})
+		if err != nil {
+			return err
+		}
+		result["digest"] = layer.Digest.String()
+		result["size"] = layer.Size
+		result["mediaType"] = layer.MediaType
+	} else if env.name != "" {
+		layer, err := env.fm.DownloadFileByName(ctx, repo, tag, env.name, args[1])
+		if err != nil {
+			return err
+		}
+		result["digest"] = layer.Digest.String()
+		result["size"] = layer.Size
+		result["mediaType"] = layer.MediaType
+	} else if env.digest != "" {
+		if err := env.fm.DownloadFileWithBlobDigest(ctx, repo, tag, env.digest, args[1]); err != nil {
+			return err
+		}
+		result["digest"] = env.digest
+	} else {
+		layer, err := env.fm.DownloadFileWithInfo(ctx, repo, tag, args[1])
+		if err != nil {
+			return err
+		}
+		result["digest"] = layer.Digest.String()
+		result["size"] = layer.Size
+		result["mediaType"] = layer.MediaType
+	}
+	return env.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "pulled %s:%s to %s\ndigest:\t%s\n", repo, tag, args[1], result["digest"])
+		if mediaType, ok := result["mediaType"]; ok {
+			fmt.Fprintf(w, "media type:\t%s\n", mediaType)
+		}
+	})
+}
+
+// printFiles 输出一组文件的名称、digest、大小以及媒体类型
+func (e *cmdEnv) printFiles(repo, tag string, blobInfos []types.BlobInfo) error {
+	files := make([]map[string]interface{}, 0, len(blobInfos))
+	for _, blobInfo := range blobInfos {
+		files = append(files, map[string]interface{}{
+			"name":      blobInfo.Annotations[imgspecv1.AnnotationTitle],
+			"digest":    blobInfo.Digest.String(),
+			"size":      blobInfo.Size,
+			"mediaType": blobInfo.MediaType,
+		})
+	}
+	result := map[string]interface{}{"repository": repo, "tag": tag, "files": files}
+	return e.print(result, func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tDIGEST\tSIZE\tMEDIA TYPE")
+		for _, file := range files {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", file["name"], file["digest"], file["size"], file["mediaType"])
+		}
+	})
+}
+
+func runList(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<repository>"); err != nil {
+		return err
+	}
+	harborHostname, projectName, repoName, err := manager.ParseHarborRepo(args[0])
+	if err != nil {
+		return usageErrorf("invalid repository %q: %v", args[0], err)
+	}
+	client, err := manager.NewHarborClientWithConfig(env.config, harborHostname)
+	if err != nil {
+		return err
+	}
+	iterator := client.ListArtifacts(ctx, projectName, repoName, &manager.ListArtifactsOptions{
+		Query:    env.query,
+		Sort:     env.sort,
+		PageSize: env.pageSize,
+		Page:     env.page,
+	})
+	artifacts := []manager.Artifact{}
+	for (env.all || len(artifacts) < env.pageSize) && iterator.Next() {
+		artifacts = append(artifacts, iterator.Artifact())
+	}
+	if err = iterator.Err(); err != nil {
+		return err
+	}
+	return env.print(artifacts, func(w io.Writer) {
+		fmt.Fprintln(w, "DIGEST\tTAGS\tSIZE\tPUSHED")
+		for _, artifact := range artifacts {
+			tags := make([]string, 0, len(artifact.Tags))
+			for _, tag := range artifact.Tags {
+				tags = append(tags, tag.Name)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", artifact.Digest, strings.Join(tags, ","), artifact.Size, artifact.PushTime)
+		}
+	})
+}
+
+func runRepos(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<registry>/<project>"); err != nil {
+		return err
+	}
+	repos, err := env.fm.ListRepositories(ctx, args[0], env.filter)
+	if err != nil {
+		return err
+	}
+	if repos == nil {
+		repos = []string{}
+	}
+	return env.print(repos, func(w io.Writer) {
+		for _, repo := range repos {
+			fmt.Fprintln(w, repo)
+		}
+	})
+}
+
+func runTags(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<repository>"); err != nil {
+		return err
+	}
+	tags, err := env.fm.ListTags(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return env.print(tags, func(w io.Writer) {
+		for _, tag := range tags {
+			fmt.Fprintln(w, tag)
+		}
+	})
+}
+
+func runVersions(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<repository>[:tag]"); err != nil {
+		return err
+	}
+	repo, tag := splitReference(args[0])
+	versions, err := env.fm.ListVersions(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+	if versions == nil {
+		versions = []manager.Version{}
+	}
+	return env.print(versions, func(w io.Writer) {
+		fmt.Fprintln(w, "DIGEST\tSIZE\tMEDIA TYPE\tCREATED")
+		for _, version := range versions {
+			created := "-"
+			if !version.Created.IsZero() {
+				created = version.Created.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", version.Digest, version.Size, version.MediaType, created)
+		}
+	})
+}
+
+func runInspect(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<repository>[:tag]"); err != nil {
+		return err
+	}
+	repo, tag := splitReference(args[0])
+	layer, err := env.fm.GetLatestLayer(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+	artifactDigest, err := env.fm.GetLatestArtifactDigest(ctx, repo)
+	if err != nil {
+		return err
+	}
+	tags, err := env.fm.ListTags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{
+		"repository":           repo,
+		"tag":                  tag,
+		"layerDigest":          layer.Digest.String(),
+		"layerSize":            layer.Size,
+		"mediaType":            layer.MediaType,
+		"latestArtifactDigest": artifactDigest,
+		"tags":                 tags,
+	}
+	return env.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "repository:\t%s\ntag:\t%s\nlayer digest:\t%s\nlayer size:\t%d\nmedia type:\t%s\nlatest artifact:\t%s\ntags:\t%s\n",
+			repo, tag, layer.Digest, layer.Size, layer.MediaType, artifactDigest, strings.Join(tags, ", "))
+	})
+}
+
+func runDigest(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<repository>[:tag]"); err != nil {
+		return err
+	}
+	repo, tag := splitReference(args[0])
+	digestStr, err := env.fm.GetBlobDigest(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+	return env.print(map[string]string{"repository": repo, "tag": tag, "digest": digestStr}, func(w io.Writer) {
+		fmt.Fprintln(w, digestStr)
+	})
+}
+
+func runRemove(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<repository>:<tag>"); err != nil {
+		return err
+	}
+	// 删除不使用默认 tag，避免漏写 tag 时误删 latest
+	repo, tag := splitReference(args[0])
+	if repo == args[0] || tag == "" {
+		return usageErrorf("refusing to delete %s without an explicit tag, use <repository>:<tag>", args[0])
+	}
+	if err := env.fm.DeleteImage(ctx, repo, tag); err != nil {
+		return err
+	}
+	return env.print(map[string]string{"repository": repo, "tag": tag, "deleted": "image"}, func(w io.Writer) {
+		fmt.Fprintf(w, "deleted %s:%s\n", repo, tag)
+	})
+}
+
+func runRemoveRepo(ctx context.Context, env *cmdEnv, args []string) error {
+	if err := expectArgs(args, 1, "<repository>"); err != nil {
+		return err
+	}
+	if !env.yes {
+		return usageErrorf("refusing to delete repository %s without --yes", args[0])
+	}
+	if err := env.fm.DeleteRepo(ctx, args[0]); err != nil {
+		return err
+	}
+	return env.print(map[string]string{"repository": args[0], "deleted": "repository"}, func(w io.Writer) {
+		fmt.Fprintf(w, "deleted repository %s\n", args[0])
+	})
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
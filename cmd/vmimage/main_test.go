@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wanjie-dev/wmimage/pkg/manager"
+)
+
+func TestSplitReference(t *testing.T) {
+	for ref, expected := range map[string][2]string{
+		"hub.example.com/vmimages/ubuntu:22.04":      {"hub.example.com/vmimages/ubuntu", "22.04"},
+		"hub.example.com/vmimages/ubuntu":            {"hub.example.com/vmimages/ubuntu", defaultTag},
+		"dev.example.com:5000/vmimages/ubuntu":       {"dev.example.com:5000/vmimages/ubuntu", defaultTag},
+		"dev.example.com:5000/vmimages/ubuntu:jammy": {"dev.example.com:5000/vmimages/ubuntu", "jammy"},
+	} {
+		repo, tag := splitReference(ref)
+		if repo != expected[0] || tag != expected[1] {
+			t.Errorf("splitReference(%q) = %q, %q", ref, repo, tag)
+		}
+	}
+}
+
+func TestBuildConfig(t *testing.T) {
+	t.Setenv(manager.DefaultUserNameEnv, "env-user")
+	t.Setenv(manager.DefaultPasswordEnv, "env-password")
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	content := `{"username": "file-user", "password": "file-password", "rootCacheDir": "` + dir + `",
+		"plainHTTPRegistries": ["dev.example.com:5000"], "dialTimeout": "5s", "retryAttempts": 6, "retryBackoff": "1s"}`
+	if err := os.WriteFile(configPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := func(opts *globalOptions, stdin string) manager.Credentials {
+		t.Helper()
+		config, err := buildConfig(opts, strings.NewReader(stdin))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.RootCacheDir != dir || len(config.Transport.PlainHTTPRegistries) != 1 || config.Transport.DialTimeout.Seconds() != 5 ||
+			config.Retry.MaxAttempts != 6 || config.Retry.InitialBackoff != time.Second {
+			t.Fatalf("unexpected config %+v", config)
+		}
+		creds, err := config.Credentials.Credentials(context.Background(), "hub.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return creds
+	}
+	if creds := credentials(&globalOptions{configPath: configPath, userName: "flag-user"}, "stdin-password\n"); creds.Password != "" {
+		t.Fatalf("flag credentials: %+v", creds)
+	}
+	if creds := credentials(&globalOptions{configPath: configPath, userName: "flag-user", passwordStdin: true}, "stdin-password\n"); creds.UserName != "flag-user" || creds.Password != "stdin-password" {
+		t.Fatalf("flag credentials: %+v", creds)
+	}
+	if creds := credentials(&globalOptions{configPath: configPath}, ""); creds.UserName != "env-user" {
+		t.Fatalf("env credentials: %+v", creds)
+	}
+	t.Setenv(manager.DefaultUserNameEnv, "")
+	t.Setenv(manager.DefaultPasswordEnv, "")
+	if creds := credentials(&globalOptions{configPath: configPath}, ""); creds.UserName != "file-user" {
+		t.Fatalf("config file credentials: %+v", creds)
+	}
+
+	if _, err := buildConfig(&globalOptions{configPath: filepath.Join(dir, "missing.json")}, nil); err == nil {
+		t.Fatal("expected error for missing explicit config file")
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	t.Setenv(configEnv, filepath.Join(t.TempDir(), "config.json"))
+	ctx := context.Background()
+	var stdout, stderr bytes.Buffer
+	for _, tc := range []struct {
+		args []string
+		code int
+	}{
+		{nil, exitUsage},
+		{[]string{"help"}, exitOK},
+		{[]string{"unknown"}, exitUsage},
+		{[]string{"push", "only-one-arg"}, exitUsage},
+		{[]string{"pull", "--no-such-flag"}, exitUsage},
+		{[]string{"pull", "--progress", "bogus", "hub.example.com/vmimages/ubuntu", "out"}, exitUsage},
+		{[]string{"pull", "--all", "--name", "disk.qcow2", "hub.example.com/vmimages/ubuntu", "out"}, exitUsage},
+		{[]string{"push", "-", "disk.qcow2", "hub.example.com/vmimages/ubuntu"}, exitUsage},
+		{[]string{"push", "--container-disk", "disk.qcow2", "seed.iso", "hub.example.com/vmimages/ubuntu"}, exitUsage},
+		{[]string{"pull", "--container-disk", "--name", "disk.qcow2", "hub.example.com/vmimages/ubuntu", "out"}, exitUsage},
+		{[]string{"rm", "hub.example.com/vmimages/ubuntu"}, exitUsage},
+		{[]string{"rm", "hub.example.com:8443/vmimages/ubuntu:"}, exitUsage},
+		{[]string{"rm-repo", "hub.example.com/vmimages/ubuntu"}, exitUsage},
+		{[]string{"repos", "--filter", "ubuntu"}, exitUsage},
+		{[]string{"tags", "--json", "hub.example.com/vmimages/ubuntu", "extra"}, exitUsage},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+		if code := run(ctx, tc.args, strings.NewReader(""), &stdout, &stderr); code != tc.code {
+			t.Errorf("run(%q) = %d, want %d: %s", tc.args, code, tc.code, stderr.String())
+		}
+	}
+	if !strings.Contains(stderr.String(), `"exitCode": 2`) && !strings.Contains(stderr.String(), `"exitCode":2`) {
+		t.Fatalf("expected JSON error output, got %q", stderr.String())
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	for _, tc := range []struct {
+		event manager.ProgressEvent
+		want  string
+	}{
+		{
+			manager.ProgressEvent{Phase: manager.PhaseUploading, Transferred: 512 << 20, Total: 2 << 30, BytesPerSecond: 64 << 20, ETA: 24 * time.Second},
+			"uploading            [#######.......................]  25% 512.0MiB/2.0GiB 64.0MiB/s ETA 0:24",
+		},
+		{
+			manager.ProgressEvent{Phase: manager.PhaseUploading, Transferred: 100, Total: -1},
+			"uploading            100B",
+		},
+	} {
+		if got := strings.TrimSuffix(formatProgress(tc.event), "\x1b[K"); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+
+	var out bytes.Buffer
+	bar := &progressBar{w: &out}
+	bar.OnProgress(manager.ProgressEvent{Phase: manager.PhaseHashing, Total: 10})
+	bar.OnProgress(manager.ProgressEvent{Phase: manager.PhaseUploading, Total: 10})
+	bar.OnProgress(manager.ProgressEvent{Phase: manager.PhaseDone, Transferred: 10, Total: 10})
+	bar.finish()
+	if lines := strings.Count(out.String(), "\n"); lines != 3 {
+		t.Fatalf("expected one line per phase, got %q", out.String())
+	}
+}
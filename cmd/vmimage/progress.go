@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wanjie-dev/wmimage/pkg/manager"
+)
+
+const (
+	progressBarWidth = 30
+	progressUsage    = "auto, bar, json or none; auto shows a bar when stderr is a terminal and --json is not set"
+)
+
+// withProgress 按 --progress 在 ctx 中设置进度输出，返回的函数在命令结束时调用，结束未完成的进度条
+func (e *cmdEnv) withProgress(ctx context.Context) (context.Context, func(), error) {
+	mode := e.progress
+	if mode == "" || mode == "auto" {
+		mode = "none"
+		if !e.opts.jsonOutput && isTerminal(e.stderr) {
+			mode = "bar"
+		}
+	}
+	switch mode {
+	case "none":
+		return ctx, func() {}, nil
+	case "json":
+		return manager.WithProgress(ctx, &jsonProgress{encoder: json.NewEncoder(e.stderr)}), func() {}, nil
+	case "bar":
+		bar := &progressBar{w: e.stderr}
+		return manager.WithProgress(ctx, bar), bar.finish, nil
+	default:
+		return nil, nil, usageErrorf("invalid --progress %q, expected auto, bar, json or none", e.progress)
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// jsonProgress 每个事件输出一行 JSON，供脚本或任务系统解析
+type jsonProgress struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (p *jsonProgress) OnProgress(event manager.ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.encoder.Encode(map[string]interface{}{
+		"phase":          event.Phase,
+		"repository":     event.Repo,
+		"tag":            event.Tag,
+		"digest":         event.Digest,
+		"transferred":    event.Transferred,
+		"total":          event.Total,
+		"bytesPerSecond": int64(event.BytesPerSecond),
+		"etaSeconds":     int64(event.ETA.Seconds()),
+	})
+}
+
+// progressBar 在终端的同一行刷新进度，阶段变化或完成时换行
+type progressBar struct {
+	mu    sync.Mutex
+	w     io.Writer
+	phase manager.TransferPhase
+	open  bool
+}
+
+func (p *progressBar) OnProgress(event manager.ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open && event.Phase != p.phase {
+		fmt.Fprintln(p.w)
+		p.open = false
+	}
+	p.phase = event.Phase
+	if event.Phase == manager.PhaseDone {
+		fmt.Fprintf(p.w, "%-20s %s in total, %s/s\n", event.Phase, formatBytes(event.Total), formatBytes(int64(event.BytesPerSecond)))
+		return
+	}
+	fmt.Fprintf(p.w, "\r%s", formatProgress(event))
+	p.open = true
+}
+
+func (p *progressBar) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open {
+		fmt.Fprintln(p.w)
+		p.open = false
+	}
+}
+
+// formatProgress 返回一行进度，例如 uploading [#######.....]  58% 1.2GiB/2.0GiB 85.0MiB/s ETA 0:10
+func formatProgress(event manager.ProgressEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-20s ", event.Phase)
+	if event.Total > 0 {
+		filled := int(event.Transferred * progressBarWidth / event.Total)
+		fmt.Fprintf(&b, "[%s%s] %3d%% %s/%s", strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled),
+			event.Transferred*100/event.Total, formatBytes(event.Transferred), formatBytes(event.Total))
+	} else {
+		b.WriteString(formatBytes(event.Transferred))
+	}
+	if event.BytesPerSecond > 0 {
+		fmt.Fprintf(&b, " %s/s", formatBytes(int64(event.BytesPerSecond)))
+	}
+	if event.ETA > 0 {
+		eta := event.ETA.Round(time.Second)
+		fmt.Fprintf(&b, " ETA %d:%02d", int(eta.Minutes()), int(eta.Seconds())%60)
+	}
+	// 覆盖上一次输出较长时残留的字符
+	b.WriteString("\x1b[K")
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
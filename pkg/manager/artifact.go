@@ -0,0 +1,366 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// 上传的制品遵循 ORAS 的约定：config 为空 JSON，通过 artifactType 区分制品类型，
+// layer 使用 org.opencontainers.image.title 记录文件名，因此可以直接用 oras pull 下载，
+// oras push 上传的文件也可以用 DownloadFile 下载
+const (
+	// ArtifactTypeVMImage 是上传的制品 manifest 的 artifactType
+	ArtifactTypeVMImage = "application/vnd.wanjie.vmimage.v1"
+	// MediaTypeVMImageLayer 是文件 layer 的默认类型
+	MediaTypeVMImageLayer = "application/octet-stream"
+)
+
+// mediaTypeDockerManifest 是旧版本通过引导镜像写入的 docker schema2 manifest 的类型
+const mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+const (
+	// annotationLineage 记录 manifest 是依次在哪些 manifest 的基础上修改得到的，逗号分隔，从新到旧
+	annotationLineage = "vnd.wanjie.vmimage.lineage"
+	maxLineage        = 16
+
+	defaultManifestRetries     = 5
+	manifestRetryBackoff       = 50 * time.Millisecond
+	defaultManifestSettleDelay = 100 * time.Millisecond
+)
+
+// parseManifest 解析 OCI image manifest 或 docker schema2 manifest
+func parseManifest(content []byte) (*imgspecv1.Manifest, error) {
+	manifest := &imgspecv1.Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.SchemaVersion != 2 {
+		return nil, fmt.Errorf("unsupported manifest schema version %d", manifest.SchemaVersion)
+	}
+	return manifest, nil
+}
+
+// fileLayers 返回 manifest 中保存文件的 layer。ORAS 在没有文件时写入的空 layer 会被跳过；
+// 旧版本写入的 docker schema2 manifest 把文件原样保存为 tar+gzip 类型的 layer，
+// 这里改为 MediaTypeVMImageLayer，避免调用方按 tar+gzip 解压
+func fileLayers(manifest *imgspecv1.Manifest) []imgspecv1.Descriptor {
+	layers := make([]imgspecv1.Descriptor, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == imgspecv1.MediaTypeEmptyJSON {
+			continue
+		}
+		if manifest.MediaType == mediaTypeDockerManifest && layer.MediaType == imgspecv1.MediaTypeImageLayerGzip {
+			layer.MediaType = MediaTypeVMImageLayer
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// buildArtifactManifest 在 previous 的基础上追加 layers，生成 OCI 1.1 制品 manifest，最新的文件位于最后。
+// previous 为 nil 时从头创建；旧版本写入的 docker schema2 manifest 以及 oras push 上传的制品会被转换为
+// 本项目的制品，保留已有的文件，参见 fileLayers。
+// 重复上传历史中已有的文件时将其移到最后；keep 大于 0 时只保留最近的 keep 个文件
+func buildArtifactManifest(previous *imgspecv1.Manifest, config imgspecv1.Descriptor, layers []imgspecv1.Descriptor, created time.Time, keep int) *imgspecv1.Manifest {
+	createdStr := created.UTC().Format(time.RFC3339)
+	manifest := &imgspecv1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: ArtifactTypeVMImage,
+		Config:       config,
+		Annotations:  map[string]string{imgspecv1.AnnotationCreated: createdStr},
+	}
+	added := make(map[digest.Digest]bool, len(layers))
+	for _, layer := range layers {
+		added[layer.Digest] = true
+	}
+	if previous != nil {
+		for _, previousLayer := range fileLayers(previous) {
+			if !added[previousLayer.Digest] {
+				manifest.Layers = append(manifest.Layers, previousLayer)
+			}
+		}
+		for key, value := range previous.Annotations {
+			if _, ok := manifest.Annotations[key]; !ok {
+				manifest.Annotations[key] = value
+			}
+		}
+	}
+	// 在 layer 上记录上传时间，供 ListVersions 使用
+	for _, layer := range layers {
+		annotations := map[string]string{imgspecv1.AnnotationCreated: createdStr}
+		for key, value := range layer.Annotations {
+			annotations[key] = value
+		}
+		layer.Annotations = annotations
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	if keep > 0 && len(manifest.Layers) > keep {
+		manifest.Layers = manifest.Layers[len(manifest.Layers)-keep:]
+	}
+	return manifest
+}
+
+// pushBytes 把内存中的小 blob(例如 config)上传到仓库，已存在时跳过
+func pushBytes(ctx context.Context, policy RetryPolicy, backend Backend, repo, mediaType string, content []byte) (imgspecv1.Descriptor, error) {
+	desc := imgspecv1.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	_, exists, err := backend.StatBlob(ctx, repo, desc.Digest)
+	if err != nil || exists {
+		return desc, err
+	}
+	session, err := startUpload(ctx, policy, backend, repo)
+	if err != nil {
+		return desc, err
+	}
+	if session, err = uploadChunk(ctx, policy, backend, repo, session, bytes.NewReader(content), 0, desc.Size, true); err != nil {
+		return desc, err
+	}
+	return desc, commitUpload(ctx, policy, backend, repo, session, desc.Digest)
+}
+
+// readManifest 读取 imageRef 当前的 manifest 及其 digest，不存在时返回 nil
+func (fm *fileManager) readManifest(ctx context.Context, imageRef types.ImageReference, sys *types.SystemContext) (*imgspecv1.Manifest, digest.Digest, error) {
+	content, err := fm.readManifestContent(ctx, imageRef, sys)
+	if err != nil || content == nil {
+		return nil, "", err
+	}
+	manifest, err := parseManifest(content)
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, digest.FromBytes(content), nil
+}
+
+// readManifestContent 读取 imageRef 当前的 manifest，不存在时返回 nil，读取失败时按重试策略重试
+func (fm *fileManager) readManifestContent(ctx context.Context, imageRef types.ImageReference, sys *types.SystemContext) ([]byte, error) {
+	var content []byte
+	err := fm.retryPolicy().retry(ctx, func() error {
+		return fm.withImageTimeout(ctx, func(ctx context.Context) error {
+			imageSource, err := imageRef.NewImageSource(ctx, sys)
+			if err != nil {
+				return err
+			}
+			defer imageSource.Close()
+			content, _, err = imageSource.GetManifest(ctx, nil)
+			return err
+		})
+	})
+	if err != nil {
+		if isImageNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return content, nil
+}
+
+func (fm *fileManager) manifestRetries() int {
+	if fm.hifConf.ManifestRetries <= 0 {
+		return defaultManifestRetries
+	}
+	return fm.hifConf.ManifestRetries
+}
+
+func (fm *fileManager) manifestSettleDelay() time.Duration {
+	if fm.hifConf.ManifestSettleDelay <= 0 {
+		return defaultManifestSettleDelay
+	}
+	return fm.hifConf.ManifestSettleDelay
+}
+
+// putArtifactManifest 上传 config blob，并把 layers 写入 harborRepo:tag 的制品 manifest 中，keep 大于 0 时只保留最近的 keep 个文件。
+// 仓库或 tag 不存在时直接创建，不需要预先推送任何镜像。
+// registry 不支持条件写入，这里采用乐观并发：写入前后都与读取时的 manifest 比较，
+// 检测到并发修改时重新读取并合并，超过 ManifestRetries 次后返回 ManifestConflictError。
+// 后端支持时(oci-layout)在锁内读取、比较并写入，写入本身就是条件写入
+func (fm *fileManager) putArtifactManifest(ctx context.Context, harborRepo, tag string, layers []imgspecv1.Descriptor, keep int) error {
+	backend, err := fm.getBackend()
+	if err != nil {
+		return err
+	}
+	imageRef, err := backend.ImageReference(harborRepo, tag)
+	if err != nil {
+		return err
+	}
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return err
+	}
+
+	created := time.Now()
+	policy := fm.retryPolicy()
+	config, err := pushBytes(ctx, policy, backend, harborRepo, imgspecv1.MediaTypeEmptyJSON, imgspecv1.DescriptorEmptyJSON.Data)
+	if err != nil {
+		return err
+	}
+
+	retries := fm.manifestRetries()
+	for attempt := 1; ; attempt++ {
+		previous, previousDigest, err := fm.readManifest(ctx, imageRef, sys)
+		if err != nil {
+			return wrapImageError(err, "get manifest", harborRepo, tag)
+		}
+		manifest := buildArtifactManifest(previous, config, layers, created, keep)
+		if previous != nil {
+			manifest.Annotations[annotationLineage] = strings.Join(lineage(previous, previousDigest), ",")
+		}
+		content, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+
+		conflict, err := fm.putManifestIfUnchanged(ctx, backend, harborRepo, imageRef, sys, previousDigest, content)
+		if err != nil {
+			return wrapImageError(err, "put manifest", harborRepo, tag)
+		}
+		if conflict == nil {
+			return nil
+		}
+		if attempt > retries {
+			conflict.Repo, conflict.Tag, conflict.Attempts = harborRepo, tag, attempt
+			return conflict
+		}
+		// 随机退避，避免多个写入方同时重试再次冲突
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rand.Int63n(int64(attempt) * int64(manifestRetryBackoff)))):
+		}
+	}
+}
+
+// lineage 返回新 manifest 的修改记录：previous 本身以及 previous 的修改记录，最多 maxLineage 个
+func lineage(previous *imgspecv1.Manifest, previousDigest digest.Digest) []string {
+	result := []string{previousDigest.String()}
+	if value := previous.Annotations[annotationLineage]; value != "" {
+		result = append(result, strings.Split(value, ",")...)
+	}
+	if len(result) > maxLineage {
+		result = result[:maxLineage]
+	}
+	return result
+}
+
+// putManifestIfUnchanged 在 tag 仍然指向 expected 时写入 content，返回检测到的冲突。
+// 后端实现了 manifestLocker 时在锁内完成检查与写入，不需要事后检查。
+// 否则写入前的检查只能缩小竞争窗口，因此写入后立即以及等待
+// ManifestSettleDelay 后各检查一次：tag 指向的 manifest 既不是本次写入的，也不是在其基础上修改得到的，
+// 说明本次写入被基于旧 manifest 的并发写入覆盖。
+// 写入失败时不直接重放：重新读取 tag，已经指向 content 说明写入实际已生效，仍指向 expected 时才再次写入
+func (fm *fileManager) putManifestIfUnchanged(ctx context.Context, backend Backend, harborRepo string, imageRef types.ImageReference, sys *types.SystemContext, expected digest.Digest, content []byte) (*ManifestConflictError, error) {
+	written := digest.FromBytes(content)
+	if locker, ok := backend.(manifestLocker); ok {
+		unlock, err := locker.lockManifests(ctx, harborRepo)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		_, current, err := fm.readManifest(ctx, imageRef, sys)
+		if err != nil || current == written {
+			return nil, err
+		}
+		if current != expected {
+			return &ManifestConflictError{Expected: expected, Actual: current}, nil
+		}
+		return nil, fm.putManifest(ctx, imageRef, sys, content)
+	}
+
+	policy := fm.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		_, current, err := fm.readManifest(ctx, imageRef, sys)
+		if err != nil {
+			return nil, err
+		}
+		if current == written {
+			break
+		}
+		if current != expected {
+			return &ManifestConflictError{Expected: expected, Actual: current}, nil
+		}
+		err = fm.putManifest(ctx, imageRef, sys, content)
+		if err == nil {
+			break
+		}
+		if attempt >= policy.attempts() || !isRetryable(err) {
+			return nil, err
+		}
+		if err = policy.wait(ctx, attempt, retryAfter(err)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, delay := range []time.Duration{0, fm.manifestSettleDelay()} {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		manifest, current, err := fm.readManifest(ctx, imageRef, sys)
+		if err != nil {
+			return nil, err
+		}
+		if current == written {
+			continue
+		}
+		if manifest == nil || !strings.Contains(manifest.Annotations[annotationLineage], written.String()) {
+			return &ManifestConflictError{Expected: written, Actual: current}, nil
+		}
+	}
+	return nil, nil
+}
+
+// putManifest 把 content 写入 imageRef 指向的 tag
+func (fm *fileManager) putManifest(ctx context.Context, imageRef types.ImageReference, sys *types.SystemContext, content []byte) error {
+	return fm.withImageTimeout(ctx, func(ctx context.Context) error {
+		destImg, err := imageRef.NewImageDestination(ctx, sys)
+		if err != nil {
+			return err
+		}
+		defer destImg.Close()
+		if err = destImg.PutManifest(ctx, content, nil); err != nil {
+			return err
+		}
+		// oci layout 等后端在 Commit 时才更新 tag
+		return destImg.Commit(ctx, nil)
+	})
+}
+
+// putManifestRetrying 把 content 写入 imageRef 指向的 tag，写入失败后先检查 tag 是否已经指向 content，
+// 没有指向时才按重试策略再次写入。后端实现了 manifestLocker 时在锁内写入，避免与其它写入方同时修改 index.json
+func (fm *fileManager) putManifestRetrying(ctx context.Context, backend Backend, harborRepo string, imageRef types.ImageReference, sys *types.SystemContext, content []byte) error {
+	if locker, ok := backend.(manifestLocker); ok {
+		unlock, err := locker.lockManifests(ctx, harborRepo)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	policy := fm.retryPolicy()
+	written := digest.FromBytes(content)
+	for attempt := 1; ; attempt++ {
+		err := fm.putManifest(ctx, imageRef, sys, content)
+		if err == nil || attempt >= policy.attempts() || !isRetryable(err) {
+			return err
+		}
+		if err = policy.wait(ctx, attempt, retryAfter(err)); err != nil {
+			return err
+		}
+		current, err := fm.readManifestContent(ctx, imageRef, sys)
+		if err != nil {
+			return err
+		}
+		if current != nil && digest.FromBytes(current) == written {
+			return nil
+		}
+	}
+}
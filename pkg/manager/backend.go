@@ -0,0 +1,318 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	BackendHarbor    = "harbor"
+	BackendRegistry  = "registry"
+	BackendOCILayout = "oci-layout"
+)
+
+// Backend 是 FileManager 的存储后端。repo 参数与 FileManager 方法中的 harborRepo 一致，
+// 例如 hub.xxxx.com/vmimages/ubuntu-22.04，由后端自行解析
+type Backend interface {
+	// ImageReference 返回 repo:tag 对应的 containers/image 引用，用于读写 manifest
+	ImageReference(repo, tag string) (types.ImageReference, error)
+
+	// StatBlob 返回 blob 的大小，blob 不存在时第二个返回值为 false
+	StatBlob(ctx context.Context, repo string, dgst digest.Digest) (int64, bool, error)
+	// GetBlob 从 offset 开始读取 blob，返回实际的起始偏移量，不支持续读时为 0。
+	// GetBlob、GetBlobRange 不重试，调用方按重试策略从已读取的位置继续
+	GetBlob(ctx context.Context, repo string, dgst digest.Digest, offset int64) (io.ReadCloser, int64, error)
+	// GetBlobRange 读取 blob 的 [start, end) 区间，不支持时返回 ErrRangeNotSupported
+	GetBlobRange(ctx context.Context, repo string, dgst digest.Digest, start, end int64) (io.ReadCloser, error)
+
+	// StartUpload 创建一个可续传的上传会话
+	StartUpload(ctx context.Context, repo string) (string, error)
+	// UploadOffset 返回上传会话已经提交的字节数以及后续使用的会话，
+	// session 必须是最近一次返回的会话。会话已经失效时返回的错误满足 errors.Is(err, ErrNotFound) 或 errors.Is(err, os.ErrNotExist)，
+	// 或者是错误码为 BLOB_UPLOAD_INVALID 的 *RegistryError(registry 拒绝过期的会话)
+	UploadOffset(ctx context.Context, repo, session string) (string, int64, error)
+	// UploadChunk 上传 src 中 [offset, offset+size) 的数据，返回后续使用的会话
+	UploadChunk(ctx context.Context, repo, session string, src io.ReaderAt, offset, size int64) (string, error)
+	// CommitUpload 校验 digest 并结束上传会话
+	CommitUpload(ctx context.Context, repo, session string, dgst digest.Digest) error
+
+	// ListRepositories 列出以 prefix（例如 hub.xxxx.com/vmimages）开头、名称包含 filter 的仓库
+	ListRepositories(ctx context.Context, prefix, filter string) ([]string, error)
+	// ListTags 列出仓库中的 tag，仓库不存在时返回空列表
+	ListTags(ctx context.Context, repo string) ([]string, error)
+	// GetArtifact 返回 reference(tag 或 digest)对应的制品，不存在时返回 ErrNotFound
+	GetArtifact(ctx context.Context, repo, reference string) (*Artifact, error)
+	DeleteRepo(ctx context.Context, repo string) error
+	LatestArtifactDigest(ctx context.Context, repo string) (string, error)
+}
+
+// manifestLocker 由能够提供条件写入的后端实现：持有锁期间，其它同样加锁的写入方不能修改 repo 中的 tag，
+// 因此在锁内读取、比较并写入 manifest 即为一次条件写入
+type manifestLocker interface {
+	// lockManifests 等待并获得 repo 的写锁，返回释放锁的函数
+	lockManifests(ctx context.Context, repo string) (func(), error)
+}
+
+// NewBackend 根据 FmConfig 创建存储后端
+func NewBackend(config *FmConfig) (Backend, error) {
+	if config.Backend != nil {
+		return config.Backend, nil
+	}
+	switch config.BackendType {
+	case "", BackendHarbor:
+		return NewHarborBackend(config), nil
+	case BackendRegistry:
+		return NewRegistryBackend(config), nil
+	case BackendOCILayout:
+		if config.OCILayoutDir == "" {
+			return nil, fmt.Errorf("OCILayoutDir is required for backend %s", BackendOCILayout)
+		}
+		return NewOCILayoutBackend(config.OCILayoutDir), nil
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", config.BackendType)
+	}
+}
+
+// registryBackend 基于 Docker Registry HTTP API V2，适用于任何 Distribution 兼容的 registry
+type registryBackend struct {
+	credentials CredentialProvider
+	transport   TransportConfig
+	retry       RetryPolicy
+
+	mu      sync.Mutex
+	clients map[string]*registryClient
+}
+
+func NewRegistryBackend(config *FmConfig) Backend {
+	return newRegistryBackend(config)
+}
+
+func newRegistryBackend(config *FmConfig) *registryBackend {
+	return &registryBackend{
+		credentials: credentialProvider(config),
+		transport:   config.Transport,
+		retry:       config.Retry,
+		clients:     map[string]*registryClient{},
+	}
+}
+
+func (b *registryBackend) client(host string) (*registryClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	client, ok := b.clients[host]
+	if !ok {
+		httpClient, err := b.transport.httpClient(host)
+		if err != nil {
+			return nil, err
+		}
+		client = newRegistryClient(host, b.credentials)
+		client.scheme = b.transport.scheme(host)
+		client.client = httpClient
+		client.retry = b.retry
+		b.clients[host] = client
+	}
+	return client, nil
+}
+
+func (b *registryBackend) resolve(repo string) (*registryClient, string, error) {
+	host, path, err := splitRepository(repo)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := b.client(host)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, path, nil
+}
+
+func (b *registryBackend) ImageReference(repo, tag string) (types.ImageReference, error) {
+	repo = strings.TrimPrefix(strings.TrimPrefix(repo, "https://"), "http://")
+	return alltransports.ParseImageName(fmt.Sprintf("docker://%s:%s", repo, tag))
+}
+
+func (b *registryBackend) StatBlob(ctx context.Context, repo string, dgst digest.Digest) (int64, bool, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return 0, false, err
+	}
+	return client.statBlob(ctx, path, dgst)
+}
+
+func (b *registryBackend) GetBlob(ctx context.Context, repo string, dgst digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return nil, 0, err
+	}
+	return client.getBlob(ctx, path, dgst, offset)
+}
+
+func (b *registryBackend) GetBlobRange(ctx context.Context, repo string, dgst digest.Digest, start, end int64) (io.ReadCloser, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+	return client.getBlobRange(ctx, path, dgst, start, end)
+}
+
+func (b *registryBackend) StartUpload(ctx context.Context, repo string) (string, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return "", err
+	}
+	return client.startUpload(ctx, path)
+}
+
+func (b *registryBackend) UploadOffset(ctx context.Context, repo, session string) (string, int64, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return "", 0, err
+	}
+	return client.uploadOffset(ctx, path, session)
+}
+
+func (b *registryBackend) UploadChunk(ctx context.Context, repo, session string, src io.ReaderAt, offset, size int64) (string, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return "", err
+	}
+	return client.uploadChunk(ctx, path, session, src, offset, size)
+}
+
+func (b *registryBackend) CommitUpload(ctx context.Context, repo, session string, dgst digest.Digest) error {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return err
+	}
+	return client.commitUpload(ctx, path, session, dgst)
+}
+
+// ListRepositories 通过 _catalog 列出仓库，prefix 的第一段为 registry 主机名
+func (b *registryBackend) ListRepositories(ctx context.Context, prefix, filter string) ([]string, error) {
+	prefix = strings.Trim(strings.TrimPrefix(strings.TrimPrefix(prefix, "https://"), "http://"), "/")
+	host, pathPrefix, _ := strings.Cut(prefix, "/")
+	client, err := b.client(host)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := client.catalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, repo := range repos {
+		if (pathPrefix == "" || repo == pathPrefix || strings.HasPrefix(repo, pathPrefix+"/")) && strings.Contains(repo, filter) {
+			result = append(result, host+"/"+repo)
+		}
+	}
+	return result, nil
+}
+
+func (b *registryBackend) ListTags(ctx context.Context, repo string) ([]string, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := client.listTags(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// GetArtifact 通过 HEAD 请求读取 manifest 的 digest、媒体类型和大小，普通 registry 没有反查 tag 的接口，
+// 这里逐个查询仓库中的 tag，找出指向同一 manifest 的 tag
+func (b *registryBackend) GetArtifact(ctx context.Context, repo, reference string) (*Artifact, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+	desc, exists, err := client.manifestDescriptor(ctx, path, reference)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &RegistryError{Op: "get artifact", Repo: repo, Tag: reference, Status: http.StatusNotFound, Kind: ErrNotFound}
+	}
+	tags, err := client.listTags(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+	artifact := &Artifact{Digest: desc.Digest.String(), ManifestMediaType: desc.MediaType, MediaType: desc.MediaType, Size: int(max(desc.Size, 0))}
+	for _, tag := range tags {
+		dgst := desc.Digest
+		if tag != reference {
+			if dgst, _, err = client.manifestDigest(ctx, path, tag); err != nil {
+				return nil, err
+			}
+		}
+		if dgst == desc.Digest {
+			artifact.Tags = append(artifact.Tags, Tag{Name: tag})
+		}
+	}
+	return artifact, nil
+}
+
+// DeleteRepo 删除仓库中所有 tag 指向的 manifest，registry 的 GC 会清理剩余的 blob
+func (b *registryBackend) DeleteRepo(ctx context.Context, repo string) error {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return err
+	}
+	tags, err := client.listTags(ctx, path)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		dgst, exists, err := client.manifestDigest(ctx, path, tag)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err = client.deleteManifest(ctx, path, dgst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestArtifactDigest 普通 registry 没有推送时间，优先返回 latest tag 的 digest，
+// 否则返回按字典序最大的 tag 的 digest
+func (b *registryBackend) LatestArtifactDigest(ctx context.Context, repo string) (string, error) {
+	client, path, err := b.resolve(repo)
+	if err != nil {
+		return "", err
+	}
+	tags, err := client.listTags(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if len(tags) == 0 {
+		return "", nil
+	}
+	sort.Strings(tags)
+	tag := tags[len(tags)-1]
+	for _, t := range tags {
+		if t == "latest" {
+			tag = t
+		}
+	}
+	dgst, _, err := client.manifestDigest(ctx, path, tag)
+	if err != nil {
+		return "", err
+	}
+	return dgst.String(), nil
+}
@@ -0,0 +1,145 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// harborBackend 在 registryBackend 的基础上，使用 Harbor v2.0 REST API 完成仓库级操作
+type harborBackend struct {
+	*registryBackend
+}
+
+func NewHarborBackend(config *FmConfig) Backend {
+	return &harborBackend{registryBackend: newRegistryBackend(config)}
+}
+
+// harborClient 返回访问 harborHostname 的 REST 客户端，与 registry 请求共用同一个 http.Client
+func (b *harborBackend) harborClient(harborHostname string) (*HarborClient, error) {
+	client, err := b.client(harborHostname)
+	if err != nil {
+		return nil, err
+	}
+	harborClient := NewHarborClient(client.scheme+"://"+harborHostname, "", "", client.client)
+	harborClient.Credentials = b.credentials
+	harborClient.Retry = b.retry
+	return harborClient, nil
+}
+
+// fallbackToRegistry 判断 Harbor API 的错误是否退回 registry 接口：仓库或制品不存在，
+// 或者对端不是 Harbor、没有提供该接口。认证、权限错误直接返回，不用 registry 的结果掩盖
+func fallbackToRegistry(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var registryErr *RegistryError
+	return errors.As(err, &registryErr) && (registryErr.Status == http.StatusMethodNotAllowed || registryErr.Status == http.StatusNotImplemented)
+}
+
+// ListRepositories prefix 包含项目名时通过 Harbor API 列出项目下的仓库，否则退回 _catalog。
+// 与 ListTags 一样，项目不存在或者不是 Harbor 的 registry 时也退回 _catalog
+func (b *harborBackend) ListRepositories(ctx context.Context, prefix, filter string) ([]string, error) {
+	prefix = strings.Trim(strings.TrimPrefix(strings.TrimPrefix(prefix, "https://"), "http://"), "/")
+	harborHostname, projectPath, _ := strings.Cut(prefix, "/")
+	projectName, _, _ := strings.Cut(projectPath, "/")
+	if projectName == "" {
+		return b.registryBackend.ListRepositories(ctx, prefix, filter)
+	}
+	harborClient, err := b.harborClient(harborHostname)
+	if err != nil {
+		return nil, err
+	}
+	repositories, err := harborClient.ListRepositoriesByName(ctx, projectName, filter)
+	if err != nil {
+		if !fallbackToRegistry(err) {
+			return nil, err
+		}
+		return b.registryBackend.ListRepositories(ctx, prefix, filter)
+	}
+	var result []string
+	for _, repository := range repositories {
+		if repository.Name == projectPath || strings.HasPrefix(repository.Name, projectPath+"/") {
+			result = append(result, harborHostname+"/"+repository.Name)
+		}
+	}
+	return result, nil
+}
+
+// ListTags 通过 Harbor API 列出仓库中全部制品的 tag。仓库不存在或者不是 Harbor 的 registry 时
+// 退回 registry 的 tags/list，其它错误直接返回
+func (b *harborBackend) ListTags(ctx context.Context, repo string) ([]string, error) {
+	harborHostname, projectName, repoName, err := parseHarborURL(repo)
+	if err != nil {
+		return nil, err
+	}
+	harborClient, err := b.harborClient(harborHostname)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	artifacts := harborClient.ListArtifacts(ctx, projectName, repoName, nil)
+	for artifacts.Next() {
+		for _, tag := range artifacts.Artifact().Tags {
+			tags = append(tags, tag.Name)
+		}
+	}
+	if err = artifacts.Err(); err != nil {
+		if !fallbackToRegistry(err) {
+			return nil, err
+		}
+		return b.registryBackend.ListTags(ctx, repo)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// GetArtifact 通过 Harbor API 读取制品，制品的 tag 通过 /artifacts/{reference}/tags 分页读取完整列表。
+// 与 ListTags 一样只在制品不存在或者不是 Harbor 时退回 registryBackend
+func (b *harborBackend) GetArtifact(ctx context.Context, repo, reference string) (*Artifact, error) {
+	harborHostname, projectName, repoName, err := parseHarborURL(repo)
+	if err != nil {
+		return nil, err
+	}
+	harborClient, err := b.harborClient(harborHostname)
+	if err != nil {
+		return nil, err
+	}
+	artifact, err := harborClient.GetArtifact(ctx, projectName, repoName, reference)
+	if err != nil {
+		if !fallbackToRegistry(err) {
+			return nil, err
+		}
+		return b.registryBackend.GetArtifact(ctx, repo, reference)
+	}
+	if artifact.Tags, err = harborClient.ListArtifactTags(ctx, projectName, repoName, artifact.Digest); err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
+
+func (b *harborBackend) DeleteRepo(ctx context.Context, repo string) error {
+	harborHostname, projectName, repoName, err := parseHarborURL(repo)
+	if err != nil {
+		return err
+	}
+	harborClient, err := b.harborClient(harborHostname)
+	if err != nil {
+		return err
+	}
+	return harborClient.DeleteRepo(ctx, projectName, repoName)
+}
+
+func (b *harborBackend) LatestArtifactDigest(ctx context.Context, repo string) (string, error) {
+	harborHostname, projectName, repoName, err := parseHarborURL(repo)
+	if err != nil {
+		return "", err
+	}
+	harborClient, err := b.harborClient(harborHostname)
+	if err != nil {
+		return "", err
+	}
+	return harborClient.GetLatestArtifactDigest(ctx, projectName, repoName)
+}
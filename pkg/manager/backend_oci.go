@@ -0,0 +1,339 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ociLockStaleAfter 写入方异常退出后留下的锁文件超过该时间后视为失效
+	ociLockStaleAfter    = time.Minute
+	ociLockRetryInterval = 10 * time.Millisecond
+)
+
+// ociLayoutBackend 把每个仓库保存为本地目录 <root>/<host>/<path> 下的 OCI image layout
+type ociLayoutBackend struct {
+	root string
+}
+
+func NewOCILayoutBackend(root string) Backend {
+	return &ociLayoutBackend{root: root}
+}
+
+func (b *ociLayoutBackend) repoDir(repo string) (string, error) {
+	host, path, err := splitRepository(repo)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(b.root, host, filepath.FromSlash(path)), nil
+}
+
+func (b *ociLayoutBackend) blobPath(repo string, dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	dir, err := b.repoDir(repo)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+// ImageReference 返回仓库目录中 tag 的引用。containers/image 解析路径时要求目录的上级目录已经存在，
+// 这里预先创建仓库目录，没有 index.json 的空目录不会被当作仓库列出
+func (b *ociLayoutBackend) ImageReference(repo, tag string) (types.ImageReference, error) {
+	dir, err := b.repoDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	if err = createDirectorIfNotExist(dir); err != nil {
+		return nil, err
+	}
+	return layout.NewReference(dir, tag)
+}
+
+// lockManifests 以 O_EXCL 创建 <repo>/index.json.lock 作为仓库的写锁，可以跨进程生效。
+// containers/image 写入 tag 时会读取并重写整个 index.json，持有该锁的写入方之间不会互相覆盖
+func (b *ociLayoutBackend) lockManifests(ctx context.Context, repo string) (func(), error) {
+	dir, err := b.repoDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	if err = createDirectorIfNotExist(dir); err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(dir, "index.json.lock")
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_ = file.Close()
+			return func() { _ = os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > ociLockStaleAfter {
+			_ = os.Remove(lockPath)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(ociLockRetryInterval):
+		}
+	}
+}
+
+func (b *ociLayoutBackend) StatBlob(_ context.Context, repo string, dgst digest.Digest) (int64, bool, error) {
+	blobPath, err := b.blobPath(repo, dgst)
+	if err != nil {
+		return 0, false, err
+	}
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return info.Size(), true, nil
+}
+
+func (b *ociLayoutBackend) GetBlob(_ context.Context, repo string, dgst digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	blobPath, err := b.blobPath(repo, dgst)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, 0, err
+	}
+	return file, offset, nil
+}
+
+func (b *ociLayoutBackend) GetBlobRange(_ context.Context, repo string, dgst digest.Digest, start, end int64) (io.ReadCloser, error) {
+	blobPath, err := b.blobPath(repo, dgst)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, start, end-start), file}, nil
+}
+
+// StartUpload 在 <root>/.ingest 下创建临时文件作为上传会话
+func (b *ociLayoutBackend) StartUpload(_ context.Context, _ string) (string, error) {
+	ingestDir := filepath.Join(b.root, ".ingest")
+	if err := createDirectorIfNotExist(ingestDir); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(ingestDir, "upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return file.Name(), nil
+}
+
+func (b *ociLayoutBackend) UploadOffset(_ context.Context, _, session string) (string, int64, error) {
+	info, err := os.Stat(session)
+	if err != nil {
+		return "", 0, err
+	}
+	return session, info.Size(), nil
+}
+
+func (b *ociLayoutBackend) UploadChunk(_ context.Context, _, session string, src io.ReaderAt, offset, size int64) (string, error) {
+	file, err := os.OpenFile(session, os.O_WRONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err = io.Copy(io.NewOffsetWriter(file, offset), io.NewSectionReader(src, offset, size)); err != nil {
+		return "", err
+	}
+	return session, nil
+}
+
+func (b *ociLayoutBackend) CommitUpload(_ context.Context, repo, session string, dgst digest.Digest) error {
+	blobPath, err := b.blobPath(repo, dgst)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(session)
+	if err != nil {
+		return err
+	}
+	actual, err := dgst.Algorithm().FromReader(file)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	if actual != dgst {
+		_ = os.Remove(session)
+		return &DigestMismatchError{Path: blobPath, Expected: dgst, Actual: actual}
+	}
+	if err = createDirectorIfNotExist(filepath.Dir(blobPath)); err != nil {
+		return err
+	}
+	return os.Rename(session, blobPath)
+}
+
+// ListRepositories 列出 prefix 对应目录下所有包含 index.json 且名称包含 filter 的 OCI layout
+func (b *ociLayoutBackend) ListRepositories(_ context.Context, prefix, filter string) ([]string, error) {
+	prefix = strings.Trim(strings.TrimPrefix(strings.TrimPrefix(prefix, "https://"), "http://"), "/")
+	startDir := filepath.Join(b.root, filepath.FromSlash(prefix))
+	var repos []string
+	err := filepath.WalkDir(startDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == "blobs" || d.Name() == ".ingest" {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "index.json")); err == nil {
+			rel, err := filepath.Rel(b.root, path)
+			if err != nil {
+				return err
+			}
+			// 与 Harbor 一致，filter 匹配不含主机名的仓库名称
+			rel = filepath.ToSlash(rel)
+			if _, name, _ := strings.Cut(rel, "/"); strings.Contains(name, filter) {
+				repos = append(repos, rel)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+func (b *ociLayoutBackend) DeleteRepo(_ context.Context, repo string) error {
+	dir, err := b.repoDir(repo)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+type ociIndex struct {
+	Manifests []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Size        int64             `json:"size"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+// readIndex 读取仓库的 index.json，仓库不存在时返回 nil
+func (b *ociLayoutBackend) readIndex(repo string) (*ociIndex, error) {
+	dir, err := b.repoDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	index := &ociIndex{}
+	if err = json.Unmarshal(content, index); err != nil {
+		return nil, fmt.Errorf("invalid index.json in %s: %w", dir, err)
+	}
+	return index, nil
+}
+
+// ListTags 返回 index.json 中 org.opencontainers.image.ref.name 注解的值
+func (b *ociLayoutBackend) ListTags(_ context.Context, repo string) ([]string, error) {
+	index, err := b.readIndex(repo)
+	if err != nil || index == nil {
+		return nil, err
+	}
+	var tags []string
+	for _, m := range index.Manifests {
+		if tag := m.Annotations[imgspecv1.AnnotationRefName]; tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// GetArtifact 在 index.json 中查找 reference，reference 可以是 tag 或 digest
+func (b *ociLayoutBackend) GetArtifact(_ context.Context, repo, reference string) (*Artifact, error) {
+	index, err := b.readIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	var artifact *Artifact
+	if index != nil {
+		dgst := reference
+		for _, m := range index.Manifests {
+			if m.Annotations[imgspecv1.AnnotationRefName] == reference {
+				dgst = m.Digest
+			}
+		}
+		for _, m := range index.Manifests {
+			if m.Digest != dgst {
+				continue
+			}
+			if artifact == nil {
+				artifact = &Artifact{Digest: m.Digest, ManifestMediaType: m.MediaType, MediaType: m.MediaType, Size: int(m.Size)}
+			}
+			if tag := m.Annotations[imgspecv1.AnnotationRefName]; tag != "" {
+				artifact.Tags = append(artifact.Tags, Tag{Name: tag})
+			}
+		}
+	}
+	if artifact == nil {
+		return nil, &RegistryError{Op: "get artifact", Repo: repo, Tag: reference, Status: http.StatusNotFound, Kind: ErrNotFound}
+	}
+	sort.Slice(artifact.Tags, func(i, j int) bool { return artifact.Tags[i].Name < artifact.Tags[j].Name })
+	return artifact, nil
+}
+
+// LatestArtifactDigest 返回 index.json 中最后写入的 manifest
+func (b *ociLayoutBackend) LatestArtifactDigest(_ context.Context, repo string) (string, error) {
+	index, err := b.readIndex(repo)
+	if err != nil || index == nil {
+		return "", err
+	}
+	if len(index.Manifests) == 0 {
+		return "", nil
+	}
+	return index.Manifests[len(index.Manifests)-1].Digest, nil
+}
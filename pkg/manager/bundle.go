@@ -0,0 +1,220 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// 文件 layer 的 annotation，文件名使用 imgspecv1.AnnotationTitle
+const (
+	// AnnotationFileMode 文件权限，八进制，例如 0644
+	AnnotationFileMode = "vnd.wanjie.vmimage.file.mode"
+	// AnnotationFileModTime 文件修改时间，RFC3339Nano 格式
+	AnnotationFileModTime = "vnd.wanjie.vmimage.file.mtime"
+)
+
+// bundleFile 是 UploadFiles、UploadDirectory 上传的一个文件，title 是其在 tag 中的名称
+type bundleFile struct {
+	path  string
+	title string
+}
+
+// fileAnnotations 返回记录文件名、权限以及修改时间的 layer annotation
+func fileAnnotations(title string, fileInfo os.FileInfo) map[string]string {
+	return map[string]string{
+		imgspecv1.AnnotationTitle: title,
+		AnnotationFileMode:        fmt.Sprintf("%#o", fileInfo.Mode().Perm()),
+		AnnotationFileModTime:     fileInfo.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// UploadFiles 把多个文件作为一组上传到 harborRepo:tag，例如磁盘镜像、kernel、initrd、cloud-init seed 以及校验文件。
+// 每个文件以文件名作为 title，文件名不能重复。上传完成后 tag 中只包含这一组文件
+func (fm *fileManager) UploadFiles(ctx context.Context, localFilePaths []string, harborRepo, tag string, opts *UploadOptions) ([]types.BlobInfo, error) {
+	files := make([]bundleFile, 0, len(localFilePaths))
+	titles := make(map[string]bool, len(localFilePaths))
+	for _, localFilePath := range localFilePaths {
+		title := filepath.Base(localFilePath)
+		if titles[title] {
+			return nil, fmt.Errorf("duplicate file name %q", title)
+		}
+		titles[title] = true
+		files = append(files, bundleFile{path: localFilePath, title: title})
+	}
+	return fm.uploadBundle(ctx, files, harborRepo, tag, opts)
+}
+
+// UploadDirectory 上传 localDir 下的所有普通文件(包括子目录)，文件在 tag 中的名称是以 / 分隔的相对路径，
+// 符号链接等特殊文件会被跳过。上传完成后 tag 中只包含这些文件
+func (fm *fileManager) UploadDirectory(ctx context.Context, localDir, harborRepo, tag string, opts *UploadOptions) ([]types.BlobInfo, error) {
+	var files []bundleFile
+	err := filepath.WalkDir(localDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, bundleFile{path: path, title: filepath.ToSlash(rel)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fm.uploadBundle(ctx, files, harborRepo, tag, opts)
+}
+
+// uploadBundle 依次上传 files，全部成功后用一次 manifest 更新替换 tag 中的文件
+func (fm *fileManager) uploadBundle(ctx context.Context, files []bundleFile, harborRepo, tag string, opts *UploadOptions) ([]types.BlobInfo, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to upload")
+	}
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	blobInfos := make([]types.BlobInfo, 0, len(files))
+	layers := make([]imgspecv1.Descriptor, 0, len(files))
+	var total int64
+	for _, file := range files {
+		blobInfo, err := fm.putFile(ctx, file.path, file.title, harborRepo, tag, opts, fm.newProgressTracker(ctx, harborRepo, tag))
+		if err != nil {
+			return nil, fmt.Errorf("upload %s: %w", file.path, err)
+		}
+		blobInfos = append(blobInfos, blobInfo)
+		layers = append(layers, layerDescriptor(blobInfo))
+		total += blobInfo.Size
+	}
+
+	progress := fm.newProgressTracker(ctx, harborRepo, tag)
+	progress.setBlob("", total)
+	progress.phase(PhaseCommittingManifest, total, total)
+	// 只保留本次上传的文件
+	if err := fm.putArtifactManifest(ctx, harborRepo, tag, layers, len(layers)); err != nil {
+		return nil, err
+	}
+	progress.done()
+	return blobInfos, nil
+}
+
+// bundleMembers 返回 manifest 中带有文件名的 layer，同名文件只保留最新的一个，按文件名第一次出现的顺序排列
+func bundleMembers(manifest *imgspecv1.Manifest) []imgspecv1.Descriptor {
+	var members []imgspecv1.Descriptor
+	index := map[string]int{}
+	for _, layer := range fileLayers(manifest) {
+		title := layer.Annotations[imgspecv1.AnnotationTitle]
+		if title == "" {
+			continue
+		}
+		if i, ok := index[title]; ok {
+			members[i] = layer
+			continue
+		}
+		index[title] = len(members)
+		members = append(members, layer)
+	}
+	return members
+}
+
+// readBundle 读取 harborRepo:tag 中带有文件名的 layer
+func (fm *fileManager) readBundle(ctx context.Context, harborRepo, tag string) ([]imgspecv1.Descriptor, error) {
+	srcRef, err := fm.imageReference(harborRepo, tag)
+	if err != nil {
+		return nil, err
+	}
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	manifest, _, err := fm.readManifest(ctx, srcRef, sys)
+	if err != nil {
+		return nil, wrapImageError(err, "get manifest", harborRepo, tag)
+	}
+	if manifest == nil {
+		return nil, &RegistryError{Op: "get manifest", Repo: harborRepo, Tag: tag, Status: http.StatusNotFound, Kind: ErrNotFound}
+	}
+	return bundleMembers(manifest), nil
+}
+
+// DownloadFileByName 下载 harborRepo:tag 中名为 name 的文件，并恢复上传时记录的权限与修改时间
+func (fm *fileManager) DownloadFileByName(ctx context.Context, harborRepo, tag, name, targetFilePath string) (*types.BlobInfo, error) {
+	members, err := fm.readBundle(ctx, harborRepo, tag)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		if member.Annotations[imgspecv1.AnnotationTitle] == name {
+			return fm.downloadMember(ctx, harborRepo, tag, member, targetFilePath)
+		}
+	}
+	return nil, fmt.Errorf("file %q not found in %s:%s", name, harborRepo, tag)
+}
+
+// DownloadDirectory 把 harborRepo:tag 中所有带有文件名的文件下载到 targetDir，按名称中的 / 创建子目录，
+// 并恢复上传时记录的权限与修改时间。没有文件名的 layer(旧版本上传的文件)会被跳过
+func (fm *fileManager) DownloadDirectory(ctx context.Context, harborRepo, tag, targetDir string) ([]types.BlobInfo, error) {
+	members, err := fm.readBundle(ctx, harborRepo, tag)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no named files in %s:%s", harborRepo, tag)
+	}
+	// 先检查全部文件名，避免下载到一半才发现非法路径
+	for _, member := range members {
+		if title := member.Annotations[imgspecv1.AnnotationTitle]; !filepath.IsLocal(filepath.FromSlash(title)) {
+			return nil, fmt.Errorf("unsafe file name %q in %s:%s", title, harborRepo, tag)
+		}
+	}
+	blobInfos := make([]types.BlobInfo, 0, len(members))
+	for _, member := range members {
+		targetFilePath := filepath.Join(targetDir, filepath.FromSlash(member.Annotations[imgspecv1.AnnotationTitle]))
+		if err = createDirectorIfNotExist(filepath.Dir(targetFilePath)); err != nil {
+			return nil, err
+		}
+		blobInfo, err := fm.downloadMember(ctx, harborRepo, tag, member, targetFilePath)
+		if err != nil {
+			return nil, err
+		}
+		blobInfos = append(blobInfos, *blobInfo)
+	}
+	return blobInfos, nil
+}
+
+func (fm *fileManager) downloadMember(ctx context.Context, harborRepo, tag string, member imgspecv1.Descriptor, targetFilePath string) (*types.BlobInfo, error) {
+	if err := fm.downloadBlobToFile(ctx, harborRepo, member.Digest, targetFilePath, fm.newProgressTracker(ctx, harborRepo, tag)); err != nil {
+		return nil, err
+	}
+	if err := restoreFileAnnotations(targetFilePath, member.Annotations); err != nil {
+		return nil, err
+	}
+	return &types.BlobInfo{Digest: member.Digest, Size: member.Size, MediaType: member.MediaType, Annotations: member.Annotations}, nil
+}
+
+// restoreFileAnnotations 按 annotation 恢复文件权限与修改时间，其它工具写入的无法解析的值会被忽略
+func restoreFileAnnotations(path string, annotations map[string]string) error {
+	if value, ok := annotations[AnnotationFileMode]; ok {
+		if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+			if err = os.Chmod(path, os.FileMode(mode).Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	if value, ok := annotations[AnnotationFileModTime]; ok {
+		if modTime, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			if err = os.Chtimes(path, modTime, modTime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
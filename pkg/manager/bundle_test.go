@@ -0,0 +1,163 @@
+package manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestFileAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "vmlinuz")
+	if err := createFile(source, []byte("kernel")); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	if err := os.Chmod(source, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(source, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := fileAnnotations("boot/vmlinuz", fileInfo)
+	if annotations[imgspecv1.AnnotationTitle] != "boot/vmlinuz" || annotations[AnnotationFileMode] != "0755" ||
+		annotations[AnnotationFileModTime] != "2024-05-06T07:08:09.123456789Z" {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+
+	target := filepath.Join(dir, "restored")
+	if err = createFile(target, []byte("kernel")); err != nil {
+		t.Fatal(err)
+	}
+	if err = restoreFileAnnotations(target, annotations); err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo, err = os.Stat(target); err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Mode().Perm() != 0o755 || !fileInfo.ModTime().Equal(modTime) {
+		t.Fatalf("mode %v, mtime %v were not restored", fileInfo.Mode(), fileInfo.ModTime())
+	}
+	// 其它工具写入的无法解析的值被忽略
+	if err = restoreFileAnnotations(target, map[string]string{AnnotationFileMode: "rwx", AnnotationFileModTime: "yesterday"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBundleMembers(t *testing.T) {
+	named := func(title, content string) imgspecv1.Descriptor {
+		desc := imgspecv1.Descriptor{MediaType: MediaTypeVMImageLayer, Digest: digest.FromString(content), Size: int64(len(content))}
+		if title != "" {
+			desc.Annotations = map[string]string{imgspecv1.AnnotationTitle: title}
+		}
+		return desc
+	}
+	manifest := &imgspecv1.Manifest{Layers: []imgspecv1.Descriptor{
+		named("", "legacy"),
+		named("disk.qcow2", "disk v1"),
+		named("vmlinuz", "kernel"),
+		named("disk.qcow2", "disk v2"),
+	}}
+	members := bundleMembers(manifest)
+	if len(members) != 2 || members[0].Digest != digest.FromString("disk v2") || members[1].Digest != digest.FromString("kernel") {
+		t.Fatalf("unexpected members %+v", members)
+	}
+
+	// 一组文件替换 tag 中已有的全部文件，内容相同的文件也各自保留
+	config := imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeEmptyJSON, Digest: digest.FromString("{}"), Size: 2}
+	bundle := []imgspecv1.Descriptor{named("disk.qcow2", "disk v2"), named("seed.iso", ""), named("empty", "")}
+	result := buildArtifactManifest(manifest, config, bundle, time.Now(), len(bundle))
+	if len(result.Layers) != 3 {
+		t.Fatalf("unexpected layers %+v", result.Layers)
+	}
+	for i, layer := range result.Layers {
+		if layer.Annotations[imgspecv1.AnnotationTitle] != bundle[i].Annotations[imgspecv1.AnnotationTitle] {
+			t.Fatalf("unexpected layers %+v", result.Layers)
+		}
+	}
+}
+
+func TestUploadAndDownloadDirectory(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "release")
+
+	source := t.TempDir()
+	files := map[string][]byte{
+		"disk.qcow2":      header(4096, 0, "QFI\xfb\x00\x00\x00\x03"),
+		"boot/vmlinuz":    []byte("kernel"),
+		"boot/initrd.img": []byte("initrd"),
+		"seed.iso":        header(40<<10, 32769, "CD001"),
+		"SHA256SUMS":      []byte("checksums\n"),
+	}
+	for name, content := range files {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		if err := createDirectorIfNotExist(filepath.Dir(path)); err != nil {
+			t.Fatal(err)
+		}
+		if err := createFile(path, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(source, "boot", "vmlinuz"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	blobInfos, err := fm.UploadDirectory(ctx, source, harborRepo, "v1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobInfos) != len(files) {
+		t.Fatalf("unexpected blobInfos %+v", blobInfos)
+	}
+	for _, blobInfo := range blobInfos {
+		title := blobInfo.Annotations[imgspecv1.AnnotationTitle]
+		if blobInfo.Digest != digest.FromBytes(files[title]) {
+			t.Fatalf("unexpected blobInfo %+v", blobInfo)
+		}
+		if title == "seed.iso" && blobInfo.MediaType != MediaTypeISO {
+			t.Fatalf("media type of seed.iso is %s", blobInfo.MediaType)
+		}
+	}
+
+	target := t.TempDir()
+	if _, err = fm.DownloadDirectory(ctx, harborRepo, "v1", target); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		assertFileContent(t, filepath.Join(target, filepath.FromSlash(name)), content)
+	}
+	if fileInfo, err := os.Stat(filepath.Join(target, "boot", "vmlinuz")); err != nil || fileInfo.Mode().Perm() != 0o700 {
+		t.Fatalf("mode of vmlinuz was not restored: %v, %v", fileInfo, err)
+	}
+
+	kernel := filepath.Join(t.TempDir(), "kernel")
+	if _, err = fm.DownloadFileByName(ctx, harborRepo, "v1", "boot/vmlinuz", kernel); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, kernel, files["boot/vmlinuz"])
+	if _, err = fm.DownloadFileByName(ctx, harborRepo, "v1", "missing", kernel); err == nil {
+		t.Fatal("expected error for a missing file name")
+	}
+
+	// 再次上传一组文件替换之前的全部文件
+	if _, err = fm.UploadFiles(ctx, []string{filepath.Join(source, "disk.qcow2"), filepath.Join(source, "seed.iso")}, harborRepo, "v1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := fm.ListVersions(ctx, harborRepo, "v1"); err != nil || len(versions) != 2 {
+		t.Fatalf("ListVersions = %+v, %v", versions, err)
+	}
+	if _, err = fm.UploadFiles(ctx, []string{filepath.Join(source, "SHA256SUMS"), filepath.Join(source, "boot", "..", "SHA256SUMS")}, harborRepo, "v1", nil); err == nil {
+		t.Fatal("expected error for duplicate file names")
+	}
+}
@@ -0,0 +1,464 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// CacheStats 描述本地内容缓存的使用情况
+type CacheStats struct {
+	Dir       string
+	Entries   int
+	Size      int64
+	MaxSize   int64
+	Pinned    int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+type cacheEntry struct {
+	size     int64
+	lastUsed time.Time
+	// modTime 缓存文件的修改时间，与文件当前的修改时间不同说明内容被外部修改
+	modTime time.Time
+}
+
+// blobCache 是按 digest 寻址的本地 blob 存储，位于 RootCacheDir/blobs/sha256/。
+// 超过 maxSize 时按最近最少使用淘汰，被 pin 的 blob 不会被淘汰，大于 maxSize 的 blob 不缓存，
+// pin 标记保存在 RootCacheDir/blobs/pins/ 下，进程重启后依然有效
+type blobCache struct {
+	dir     string
+	pinDir  string
+	maxSize int64
+
+	mu        sync.Mutex
+	loaded    bool
+	entries   map[digest.Digest]*cacheEntry
+	pins      map[digest.Digest]bool
+	size      int64
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+func newBlobCache(rootCacheDir string, maxSize int64) *blobCache {
+	return &blobCache{
+		dir:     filepath.Join(rootCacheDir, "blobs", digest.SHA256.String()),
+		pinDir:  filepath.Join(rootCacheDir, "blobs", "pins"),
+		maxSize: maxSize,
+	}
+}
+
+func (c *blobCache) path(dgst digest.Digest) string {
+	return filepath.Join(c.dir, dgst.Encoded())
+}
+
+// load 在第一次使用时扫描缓存目录，以文件修改时间作为最近使用时间
+func (c *blobCache) load() error {
+	if c.loaded {
+		return nil
+	}
+	if err := createDirectorIfNotExist(c.dir); err != nil {
+		return err
+	}
+	if err := createDirectorIfNotExist(c.pinDir); err != nil {
+		return err
+	}
+	c.entries = map[digest.Digest]*cacheEntry{}
+	c.pins = map[digest.Digest]bool{}
+	c.size = 0
+
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, file.Name())
+		if file.IsDir() || dgst.Validate() != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[dgst] = &cacheEntry{size: info.Size(), lastUsed: info.ModTime(), modTime: info.ModTime()}
+		c.size += info.Size()
+	}
+
+	pins, err := os.ReadDir(c.pinDir)
+	if err != nil {
+		return err
+	}
+	for _, pin := range pins {
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, pin.Name())
+		if dgst.Validate() == nil {
+			c.pins[dgst] = true
+		}
+	}
+	c.loaded = true
+	return nil
+}
+
+// open 打开缓存中的 blob，未命中时返回 false
+func (c *blobCache) open(dgst digest.Digest) (*os.File, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return nil, 0, false
+	}
+	entry, ok := c.entries[dgst]
+	if !ok {
+		c.misses++
+		return nil, 0, false
+	}
+	file, err := os.Open(c.path(dgst))
+	if err != nil {
+		// 文件被外部删除
+		c.size -= entry.size
+		delete(c.entries, dgst)
+		c.misses++
+		return nil, 0, false
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != entry.size || !info.ModTime().Equal(entry.modTime) {
+		// 与下载目标共享的硬链接被外部修改，内容已经不可信
+		_ = file.Close()
+		_ = os.Remove(c.path(dgst))
+		c.size -= entry.size
+		delete(c.entries, dgst)
+		c.misses++
+		return nil, 0, false
+	}
+	now := time.Now()
+	entry.lastUsed = now
+	if err = os.Chtimes(c.path(dgst), now, now); err == nil {
+		if info, err := file.Stat(); err == nil {
+			entry.modTime = info.ModTime()
+		}
+	}
+	c.hits++
+	return file, entry.size, true
+}
+
+// add 将已经校验过的本地文件放入缓存，大于 maxSize 的文件不缓存。
+// 优先创建硬链接避免再复制一份，此时缓存与该文件共享内容：文件之后被修改时，open 发现大小或修改时间变化后丢弃缓存，
+// 命中缓存的 DownloadFile 也会重新校验 digest。不能创建硬链接(例如跨文件系统)时复制
+func (c *blobCache) add(dgst digest.Digest, srcPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if c.maxSize > 0 && info.Size() > c.maxSize {
+		return nil
+	}
+	if dgst.Algorithm() != digest.SHA256 {
+		return fmt.Errorf("blob cache only supports %s digests, got %s", digest.SHA256, dgst)
+	}
+	if err = createDirectorIfNotExist(c.dir); err != nil {
+		return err
+	}
+	linkPath := filepath.Join(c.dir, fmt.Sprintf(".tmp-%s-link-%d", dgst.Encoded(), time.Now().UnixNano()))
+	if err = os.Link(srcPath, linkPath); err == nil {
+		if err = os.Rename(linkPath, c.path(dgst)); err != nil {
+			_ = os.Remove(linkPath)
+			return err
+		}
+		c.insert(dgst, info.Size())
+		return nil
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	writer, err := c.newWriter(dgst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, src); err != nil {
+		writer.abort()
+		return err
+	}
+	return writer.commit()
+}
+
+func (c *blobCache) newWriter(dgst digest.Digest) (*cacheWriter, error) {
+	if dgst.Algorithm() != digest.SHA256 {
+		return nil, fmt.Errorf("blob cache only supports %s digests, got %s", digest.SHA256, dgst)
+	}
+	if err := createDirectorIfNotExist(c.dir); err != nil {
+		return nil, err
+	}
+	tmpFile, err := os.CreateTemp(c.dir, ".tmp-"+dgst.Encoded()+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{cache: c, dgst: dgst, file: tmpFile, verifier: dgst.Algorithm().Digester()}, nil
+}
+
+// insert 登记已经放入缓存目录的 blob，大于 maxSize 时直接删除，不淘汰其它 blob
+func (c *blobCache) insert(dgst digest.Digest, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return
+	}
+	if old, ok := c.entries[dgst]; ok {
+		c.size -= old.size
+		delete(c.entries, dgst)
+	}
+	info, err := os.Stat(c.path(dgst))
+	if err != nil || (c.maxSize > 0 && size > c.maxSize) {
+		_ = os.Remove(c.path(dgst))
+		return
+	}
+	c.entries[dgst] = &cacheEntry{size: size, lastUsed: time.Now(), modTime: info.ModTime()}
+	c.size += size
+	c.evict()
+}
+
+// evict 淘汰最久未使用且未被 pin 的 blob，直到总大小不超过 maxSize
+func (c *blobCache) evict() {
+	for c.maxSize > 0 && c.size > c.maxSize {
+		var victim digest.Digest
+		var oldest time.Time
+		for dgst, entry := range c.entries {
+			if c.pins[dgst] {
+				continue
+			}
+			if victim == "" || entry.lastUsed.Before(oldest) {
+				victim, oldest = dgst, entry.lastUsed
+			}
+		}
+		if victim == "" {
+			return
+		}
+		if err := os.Remove(c.path(victim)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		c.size -= c.entries[victim].size
+		delete(c.entries, victim)
+		c.evictions++
+	}
+}
+
+func (c *blobCache) remove(dgst digest.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[dgst]; ok {
+		_ = os.Remove(c.path(dgst))
+		c.size -= entry.size
+		delete(c.entries, dgst)
+	}
+}
+
+func (c *blobCache) pin(dgst digest.Digest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(c.pinDir, dgst.Encoded()), nil, 0o644); err != nil {
+		return err
+	}
+	c.pins[dgst] = true
+	return nil
+}
+
+func (c *blobCache) unpin(dgst digest.Digest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(c.pinDir, dgst.Encoded())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(c.pins, dgst)
+	c.evict()
+	return nil
+}
+
+func (c *blobCache) stats() (CacheStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return CacheStats{}, err
+	}
+	pinned := 0
+	for dgst := range c.pins {
+		if _, ok := c.entries[dgst]; ok {
+			pinned++
+		}
+	}
+	return CacheStats{
+		Dir:       c.dir,
+		Entries:   len(c.entries),
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+		Pinned:    pinned,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}, nil
+}
+
+// cacheWriter 将内容写入临时文件，digest 校验通过后才放入缓存
+type cacheWriter struct {
+	cache    *blobCache
+	dgst     digest.Digest
+	file     *os.File
+	verifier digest.Digester
+	size     int64
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.cache.maxSize > 0 && w.size+int64(len(p)) > w.cache.maxSize {
+		return 0, fmt.Errorf("blob %s is larger than the cache size %d", w.dgst, w.cache.maxSize)
+	}
+	n, err := w.file.Write(p)
+	w.verifier.Hash().Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *cacheWriter) abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+func (w *cacheWriter) commit() error {
+	if actual := w.verifier.Digest(); actual != w.dgst {
+		w.abort()
+		return &DigestMismatchError{Path: w.cache.path(w.dgst), Expected: w.dgst, Actual: actual}
+	}
+	if err := w.file.Close(); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.cache.path(w.dgst)); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+	w.cache.insert(w.dgst, w.size)
+	return nil
+}
+
+// cachingReader 在调用方读取 blob 的同时写入缓存，读到结尾才提交
+type cachingReader struct {
+	io.ReadCloser
+	writer *cacheWriter
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.writer != nil {
+		if n > 0 {
+			if _, werr := r.writer.Write(p[:n]); werr != nil {
+				r.writer.abort()
+				r.writer = nil
+			}
+		}
+		if errors.Is(err, io.EOF) && r.writer != nil {
+			// 缓存写入失败不影响读取
+			_ = r.writer.commit()
+			r.writer = nil
+		}
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	if r.writer != nil {
+		r.writer.abort()
+		r.writer = nil
+	}
+	return r.ReadCloser.Close()
+}
+
+func parseCacheDigest(digestStr string) (digest.Digest, error) {
+	if !strings.Contains(digestStr, ":") {
+		digestStr = digest.SHA256.String() + ":" + digestStr
+	}
+	return digest.Parse(digestStr)
+}
+
+// blobCache 返回内容缓存，未配置 CacheMaxSize 时返回 nil
+func (fm *fileManager) blobCache() *blobCache {
+	if fm.hifConf.CacheMaxSize <= 0 {
+		return nil
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.cache == nil {
+		fm.cache = newBlobCache(fm.rootCacheDir(), fm.hifConf.CacheMaxSize)
+	}
+	return fm.cache
+}
+
+func (fm *fileManager) openCachedBlob(dgst digest.Digest) (io.ReadCloser, int64, bool) {
+	cache := fm.blobCache()
+	if cache == nil || dgst.Validate() != nil {
+		return nil, 0, false
+	}
+	file, size, ok := cache.open(dgst)
+	if !ok {
+		return nil, 0, false
+	}
+	return file, size, true
+}
+
+// cacheBlobReader 让从远端读取的 blob 在读完后进入内容缓存
+func (fm *fileManager) cacheBlobReader(dgst digest.Digest, reader io.ReadCloser) io.ReadCloser {
+	cache := fm.blobCache()
+	if cache == nil || dgst.Validate() != nil {
+		return reader
+	}
+	writer, err := cache.newWriter(dgst)
+	if err != nil {
+		return reader
+	}
+	return &cachingReader{ReadCloser: reader, writer: writer}
+}
+
+func (fm *fileManager) CacheStats() (CacheStats, error) {
+	cache := fm.blobCache()
+	if cache == nil {
+		return CacheStats{}, nil
+	}
+	return cache.stats()
+}
+
+func (fm *fileManager) PinBlob(digestStr string) error {
+	cache := fm.blobCache()
+	if cache == nil {
+		return fmt.Errorf("blob cache is disabled, set CacheMaxSize to enable it")
+	}
+	dgst, err := parseCacheDigest(digestStr)
+	if err != nil {
+		return err
+	}
+	return cache.pin(dgst)
+}
+
+func (fm *fileManager) UnpinBlob(digestStr string) error {
+	cache := fm.blobCache()
+	if cache == nil {
+		return fmt.Errorf("blob cache is disabled, set CacheMaxSize to enable it")
+	}
+	dgst, err := parseCacheDigest(digestStr)
+	if err != nil {
+		return err
+	}
+	return cache.unpin(dgst)
+}
@@ -0,0 +1,350 @@
+package manager
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// KubeVirt containerDisk 的约定：磁盘文件位于镜像的 /disk 目录下，属主为 qemu 用户 107:107
+const (
+	containerDiskDir = "disk"
+	containerDiskUID = 107
+)
+
+// tarBlockSize tar 的块大小，文件内容按块对齐
+const tarBlockSize = 512
+
+const mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// ContainerDiskOptions PublishContainerDisk、ImportContainerDisk 的参数
+type ContainerDiskOptions struct {
+	// Name 磁盘在 /disk 目录下的文件名，默认使用本地文件名
+	Name string
+	// Architecture 镜像的 CPU 架构，默认 runtime.GOARCH。导入多架构镜像时按该架构选择
+	Architecture string
+}
+
+func (opts *ContainerDiskOptions) architecture() string {
+	if opts == nil || opts.Architecture == "" {
+		return runtime.GOARCH
+	}
+	return opts.Architecture
+}
+
+// containerDiskTarHeader 返回磁盘文件之前的 tar 头：/disk 目录以及磁盘文件本身，属主均为 107:107
+func containerDiskTarHeader(name string, size int64, modTime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: containerDiskDir + "/", Mode: 0o555, Uid: containerDiskUID, Gid: containerDiskUID, ModTime: modTime, Format: tar.FormatPAX},
+		{Typeflag: tar.TypeReg, Name: containerDiskDir + "/" + name, Mode: 0o440, Uid: containerDiskUID, Gid: containerDiskUID, Size: size, ModTime: modTime, Format: tar.FormatPAX},
+	}
+	for _, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+	}
+	// 不调用 Close：磁盘内容、对齐填充以及结束块由调用方在流中拼接
+	return buf.Bytes(), nil
+}
+
+// containerDiskLayer 返回 containerDisk layer 的 tar 流及其长度，磁盘内容直接从 disk 读取，不生成临时文件
+func containerDiskLayer(disk io.Reader, name string, size int64, modTime time.Time) (io.Reader, int64, error) {
+	header, err := containerDiskTarHeader(name, size, modTime)
+	if err != nil {
+		return nil, 0, err
+	}
+	padding := (tarBlockSize - size%tarBlockSize) % tarBlockSize
+	// 文件内容按 512 字节对齐，最后是两个全零的结束块
+	trailer := make([]byte, padding+2*tarBlockSize)
+	total := int64(len(header)) + size + int64(len(trailer))
+	return io.MultiReader(bytes.NewReader(header), io.LimitReader(disk, size), bytes.NewReader(trailer)), total, nil
+}
+
+// PublishContainerDisk 把本地磁盘镜像发布为 KubeVirt 可以直接使用的 containerDisk：
+// 一个未压缩的 tar layer，其中只有属主为 107:107 的 /disk/<name>，以及普通的 OCI 镜像 config。
+// 与 UploadFile 不同，harborRepo:tag 会被整个替换为该镜像，返回 tar layer 的信息
+func (fm *fileManager) PublishContainerDisk(ctx context.Context, localDiskPath, harborRepo, tag string, opts *ContainerDiskOptions) (*types.BlobInfo, error) {
+	if opts == nil {
+		opts = &ContainerDiskOptions{}
+	}
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(localDiskPath)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return nil, fmt.Errorf("invalid containerDisk name %q", name)
+	}
+
+	disk, err := os.Open(localDiskPath)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Close()
+	fileInfo, err := disk.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", localDiskPath)
+	}
+	// KubeVirt 只能直接使用 qcow2 或 raw 磁盘
+	mediaType, err := DetectMediaType(disk)
+	if err != nil {
+		return nil, err
+	}
+	switch mediaType {
+	case MediaTypeQCOW2, MediaTypeRaw, MediaTypeVMImageLayer:
+	default:
+		return nil, fmt.Errorf("%s is %s, containerDisk requires a qcow2 or raw disk", localDiskPath, mediaType)
+	}
+
+	backend, err := fm.getBackend()
+	if err != nil {
+		return nil, err
+	}
+	layerReader, layerSize, err := containerDiskLayer(disk, name, fileInfo.Size(), fileInfo.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	progress := fm.newProgressTracker(ctx, harborRepo, tag)
+	layer, err := fm.putBlobStream(ctx, layerReader, layerSize, harborRepo, progress)
+	if err != nil {
+		return nil, err
+	}
+	layer.MediaType = imgspecv1.MediaTypeImageLayer
+
+	// 未压缩的 layer，diff ID 就是 layer 的 digest
+	created := time.Now().UTC()
+	configContent, err := json.Marshal(imgspecv1.Image{
+		Created:  &created,
+		Platform: imgspecv1.Platform{Architecture: opts.architecture(), OS: "linux"},
+		RootFS:   imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer.Digest}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	config, err := pushBytes(ctx, fm.retryPolicy(), backend, harborRepo, imgspecv1.MediaTypeImageConfig, configContent)
+	if err != nil {
+		return nil, err
+	}
+	manifest := imgspecv1.Manifest{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []imgspecv1.Descriptor{{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size}},
+		Annotations: map[string]string{
+			imgspecv1.AnnotationCreated: created.Format(time.RFC3339),
+		},
+	}
+	manifest.SchemaVersion = 2
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	progress.phase(PhaseCommittingManifest, layer.Size, layer.Size)
+	imageRef, err := backend.ImageReference(harborRepo, tag)
+	if err != nil {
+		return nil, err
+	}
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	if err = fm.putManifestRetrying(ctx, backend, harborRepo, imageRef, sys, content); err != nil {
+		return nil, wrapImageError(err, "put manifest", harborRepo, tag)
+	}
+	progress.done()
+	return &layer, nil
+}
+
+// ImportContainerDisk 从已有的 containerDisk 镜像 harborRepo:tag 中取出 /disk 下的磁盘文件，保存到 targetFilePath。
+// 多架构镜像按 opts.Architecture 选择，layer 通过 GetDownloadReaderWithBlob 读取，支持未压缩与 gzip 压缩的 layer。
+// 返回磁盘文件本身的 digest、大小以及识别出的媒体类型
+func (fm *fileManager) ImportContainerDisk(ctx context.Context, harborRepo, tag, targetFilePath string, opts *ContainerDiskOptions) (*types.BlobInfo, error) {
+	srcRef, err := fm.imageReference(harborRepo, tag)
+	if err != nil {
+		return nil, err
+	}
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	var manifest *imgspecv1.Manifest
+	err = fm.retryPolicy().retry(ctx, func() (err error) {
+		manifest, err = fm.readImageManifest(ctx, srcRef, sys, opts.architecture())
+		return err
+	})
+	if err != nil {
+		return nil, wrapImageError(err, "get manifest", harborRepo, tag)
+	}
+
+	// 上层的 layer 覆盖下层，从最上层开始查找
+	for i := len(manifest.Layers) - 1; i >= 0; i-- {
+		layer := manifest.Layers[i]
+		if layer.MediaType == imgspecv1.MediaTypeEmptyJSON {
+			continue
+		}
+		blobInfo, err := fm.extractContainerDisk(ctx, harborRepo, tag, layer, targetFilePath)
+		if err != nil {
+			return nil, err
+		}
+		if blobInfo != nil {
+			return blobInfo, nil
+		}
+	}
+	return nil, fmt.Errorf("no disk found under /%s in %s:%s", containerDiskDir, harborRepo, tag)
+}
+
+// readImageManifest 读取 imageRef 的镜像 manifest，imageRef 指向镜像索引时选择 linux/architecture 对应的镜像
+func (fm *fileManager) readImageManifest(ctx context.Context, imageRef types.ImageReference, sys *types.SystemContext, architecture string) (*imgspecv1.Manifest, error) {
+	var imageSource types.ImageSource
+	err := fm.withImageTimeout(ctx, func(ctx context.Context) (err error) {
+		imageSource, err = imageRef.NewImageSource(ctx, sys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer imageSource.Close()
+
+	var content []byte
+	var mimeType string
+	err = fm.withImageTimeout(ctx, func(ctx context.Context) (err error) {
+		content, mimeType, err = imageSource.GetManifest(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mimeType == imgspecv1.MediaTypeImageIndex || mimeType == mediaTypeDockerManifestList {
+		var index imgspecv1.Index
+		if err = json.Unmarshal(content, &index); err != nil {
+			return nil, err
+		}
+		instance, err := selectPlatform(index.Manifests, architecture)
+		if err != nil {
+			return nil, err
+		}
+		err = fm.withImageTimeout(ctx, func(ctx context.Context) (err error) {
+			content, _, err = imageSource.GetManifest(ctx, &instance)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseManifest(content)
+}
+
+// selectPlatform 返回镜像索引中 linux/architecture 对应的 manifest digest
+func selectPlatform(manifests []imgspecv1.Descriptor, architecture string) (digest.Digest, error) {
+	for _, desc := range manifests {
+		if desc.Platform != nil && desc.Platform.OS == "linux" && desc.Platform.Architecture == architecture {
+			return desc.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no image for linux/%s in the image index", architecture)
+}
+
+// extractContainerDisk 在 layer 中查找 /disk 下的第一个普通文件并写入 targetFilePath，layer 中没有磁盘文件时返回 nil。
+// 找到磁盘后仍会读完整个 layer，校验 layer 的 digest 后才提交目标文件
+func (fm *fileManager) extractContainerDisk(ctx context.Context, harborRepo, tag string, layer imgspecv1.Descriptor, targetFilePath string) (*types.BlobInfo, error) {
+	reader, _, err := fm.GetDownloadReaderWithBlob(ctx, harborRepo, tag, &types.BlobInfo{Digest: layer.Digest, Size: layer.Size, MediaType: layer.MediaType})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	verifier := layer.Digest.Algorithm().Digester()
+	raw := bufio.NewReader(io.TeeReader(reader, verifier.Hash()))
+	// 按内容识别压缩格式，不依赖各种工具写入的 layer 媒体类型
+	magic, _ := raw.Peek(sniffHeaderSize)
+	var tarStream io.Reader = raw
+	switch detectMediaType(magic) {
+	case MediaTypeGzip:
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		tarStream = gz
+	case MediaTypeTar:
+	default:
+		return nil, fmt.Errorf("unsupported containerDisk layer %s (%s)", layer.Digest, layer.MediaType)
+	}
+
+	var partFile *os.File
+	var blobInfo *types.BlobInfo
+	committed := false
+	defer func() {
+		// 出错时清理未完成的 .part 文件
+		if partFile != nil && !committed {
+			_ = partFile.Close()
+			_ = os.Remove(partFile.Name())
+		}
+	}()
+	tr := tar.NewReader(tarStream)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if partFile != nil || header.Typeflag != tar.TypeReg || path.Dir(name) != containerDiskDir {
+			continue
+		}
+		if partFile, err = os.Create(targetFilePath + ".part"); err != nil {
+			return nil, err
+		}
+		diskDigester := digest.Canonical.Digester()
+		head := bufio.NewReaderSize(tr, sniffHeaderSize)
+		sniffed, _ := head.Peek(sniffHeaderSize)
+		mediaType := detectMediaType(sniffed)
+		size, err := io.Copy(&hashingWriter{w: partFile, h: diskDigester.Hash()}, head)
+		if err != nil {
+			return nil, err
+		}
+		blobInfo = &types.BlobInfo{
+			Digest:      diskDigester.Digest(),
+			Size:        size,
+			MediaType:   mediaType,
+			Annotations: map[string]string{imgspecv1.AnnotationTitle: path.Base(name)},
+		}
+	}
+	if partFile == nil {
+		return nil, nil
+	}
+	// 读完 gzip 尾部以及剩余的填充，保证 digest 覆盖整个 layer
+	if _, err = io.Copy(io.Discard, raw); err != nil {
+		return nil, err
+	}
+	if actual := verifier.Digest(); actual != layer.Digest {
+		return nil, &DigestMismatchError{Path: targetFilePath, Expected: layer.Digest, Actual: actual}
+	}
+	if err = commitPartFile(partFile, targetFilePath); err != nil {
+		return nil, err
+	}
+	committed = true
+	return blobInfo, nil
+}
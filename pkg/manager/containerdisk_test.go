@@ -0,0 +1,163 @@
+package manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestContainerDiskLayer(t *testing.T) {
+	for _, size := range []int{0, 1, 512, 4097} {
+		disk := header(size, 0, "")
+		reader, total, err := containerDiskLayer(bytes.NewReader(disk), "disk.qcow2", int64(size), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(layer)) != total || total%tarBlockSize != 0 {
+			t.Fatalf("size %d: layer is %d bytes, declared %d", size, len(layer), total)
+		}
+
+		tr := tar.NewReader(bytes.NewReader(layer))
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			if hdr.Uid != containerDiskUID || hdr.Gid != containerDiskUID {
+				t.Fatalf("size %d: %s is owned by %d:%d", size, hdr.Name, hdr.Uid, hdr.Gid)
+			}
+			names = append(names, hdr.Name)
+			if hdr.Typeflag == tar.TypeReg {
+				content, err := io.ReadAll(tr)
+				if err != nil || !bytes.Equal(content, disk) {
+					t.Fatalf("size %d: unexpected disk content, %v", size, err)
+				}
+			}
+		}
+		if len(names) != 2 || names[0] != "disk/" || names[1] != "disk/disk.qcow2" {
+			t.Fatalf("size %d: unexpected entries %v", size, names)
+		}
+	}
+
+	manifests := []imgspecv1.Descriptor{
+		{Digest: digest.FromString("arm64"), Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm64"}},
+		{Digest: digest.FromString("amd64"), Platform: &imgspecv1.Platform{OS: "linux", Architecture: "amd64"}},
+	}
+	if dgst, err := selectPlatform(manifests, "amd64"); err != nil || dgst != digest.FromString("amd64") {
+		t.Fatalf("selectPlatform = %s, %v", dgst, err)
+	}
+	if _, err := selectPlatform(manifests, "s390x"); err == nil {
+		t.Fatal("expected error for a missing platform")
+	}
+}
+
+func TestPublishAndImportContainerDisk(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "fedora-container-disk")
+
+	source := filepath.Join(t.TempDir(), "fedora.qcow2")
+	disk := header(70<<10, 0, "QFI\xfb\x00\x00\x00\x03")
+	if err := createFile(source, disk); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := fm.PublishContainerDisk(ctx, source, harborRepo, "39", &ContainerDiskOptions{Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.MediaType != imgspecv1.MediaTypeImageLayer {
+		t.Fatalf("unexpected layer %+v", layer)
+	}
+
+	target := filepath.Join(t.TempDir(), "imported.qcow2")
+	blobInfo, err := fm.ImportContainerDisk(ctx, harborRepo, "39", target, &ContainerDiskOptions{Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, target, disk)
+	if blobInfo.Digest != digest.FromBytes(disk) || blobInfo.MediaType != MediaTypeQCOW2 || blobInfo.Annotations[imgspecv1.AnnotationTitle] != "fedora.qcow2" {
+		t.Fatalf("unexpected blobInfo %+v", blobInfo)
+	}
+
+	// 其它工具构建的多架构、gzip 压缩的 containerDisk
+	layerReader, _, err := containerDiskLayer(bytes.NewReader(disk), "disk.img", int64(len(disk)), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err = io.Copy(gz, layerReader); err != nil {
+		t.Fatal(err)
+	}
+	if err = gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config := []byte(`{"architecture":"arm64","os":"linux"}`)
+	manifest := imgspecv1.Manifest{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers: []imgspecv1.Descriptor{{
+			MediaType: imgspecv1.MediaTypeImageLayerGzip, Digest: digest.FromBytes(compressed.Bytes()), Size: int64(compressed.Len()),
+		}},
+	}
+	manifest.SchemaVersion = 2
+	image, _ := json.Marshal(manifest)
+	registry.putManifest(defaultHarborProject+"/fedora-container-disk", "arm64", imgspecv1.MediaTypeImageManifest, image, config, compressed.Bytes())
+	index, _ := json.Marshal(imgspecv1.Index{
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{{
+			MediaType: imgspecv1.MediaTypeImageManifest, Digest: digest.FromBytes(image), Size: int64(len(image)),
+			Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm64"},
+		}},
+	})
+	registry.putManifest(defaultHarborProject+"/fedora-container-disk", "multiarch", imgspecv1.MediaTypeImageIndex, index)
+
+	if _, err = fm.ImportContainerDisk(ctx, harborRepo, "multiarch", target, &ContainerDiskOptions{Architecture: "arm64"}); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, target, disk)
+	if _, err = fm.ImportContainerDisk(ctx, harborRepo, "multiarch", target, &ContainerDiskOptions{Architecture: "amd64"}); err == nil {
+		t.Fatal("expected error for a missing platform")
+	}
+
+	// 截断的 layer 解压失败时不留下 .part 文件
+	truncated := compressed.Bytes()[:compressed.Len()-16]
+	manifest.Layers[0].Digest, manifest.Layers[0].Size = digest.FromBytes(truncated), int64(len(truncated))
+	image, _ = json.Marshal(manifest)
+	registry.putManifest(defaultHarborProject+"/fedora-container-disk", "truncated", imgspecv1.MediaTypeImageManifest, image, config, truncated)
+	truncatedTarget := filepath.Join(t.TempDir(), "truncated.qcow2")
+	if _, err = fm.ImportContainerDisk(ctx, harborRepo, "truncated", truncatedTarget, &ContainerDiskOptions{Architecture: "arm64"}); err == nil {
+		t.Fatal("expected error for a truncated layer")
+	}
+	if _, err = os.Stat(truncatedTarget + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("%s.part should be removed, stat err: %v", truncatedTarget, err)
+	}
+
+	// 压缩过的磁盘不能直接发布
+	compressedDisk := filepath.Join(t.TempDir(), "fedora.qcow2.gz")
+	if err = createFile(compressedDisk, compressed.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.PublishContainerDisk(ctx, compressedDisk, harborRepo, "bad", nil); err == nil {
+		t.Fatal("expected error for a compressed disk")
+	}
+}
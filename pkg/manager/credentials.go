@@ -0,0 +1,409 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUserNameEnv = "HARBOR_USERNAME"
+	DefaultPasswordEnv = "HARBOR_PASSWORD"
+)
+
+// Credentials 访问 registry 使用的凭据
+type Credentials struct {
+	UserName string
+	Password string
+	// IdentityToken OAuth2 refresh token，对应 docker config 中的 identitytoken
+	IdentityToken string
+}
+
+func (c Credentials) empty() bool {
+	return c.UserName == "" && c.Password == "" && c.IdentityToken == ""
+}
+
+// CredentialProvider 返回访问 registry 主机(例如 hub.xxxx.com)使用的凭据，
+// 没有凭据时返回零值。每次请求前都会调用，实现方可以在这里处理凭据轮换
+type CredentialProvider interface {
+	Credentials(ctx context.Context, host string) (Credentials, error)
+}
+
+// CredentialProviderFunc 把函数适配为 CredentialProvider
+type CredentialProviderFunc func(ctx context.Context, host string) (Credentials, error)
+
+func (f CredentialProviderFunc) Credentials(ctx context.Context, host string) (Credentials, error) {
+	return f(ctx, host)
+}
+
+// StaticCredentials 对所有 registry 返回同一组账号密码
+func StaticCredentials(userName, password string) CredentialProvider {
+	return CredentialProviderFunc(func(context.Context, string) (Credentials, error) {
+		return Credentials{UserName: userName, Password: password}, nil
+	})
+}
+
+// RobotAccountCredentials 使用 Harbor 机器人账号，name 形如 robot$project+ci
+func RobotAccountCredentials(name, secret string) CredentialProvider {
+	return StaticCredentials(name, secret)
+}
+
+// EnvCredentials 从环境变量读取账号密码，参数为空时使用 HARBOR_USERNAME、HARBOR_PASSWORD。
+// 每次调用都重新读取环境变量
+func EnvCredentials(userNameEnv, passwordEnv string) CredentialProvider {
+	if userNameEnv == "" {
+		userNameEnv = DefaultUserNameEnv
+	}
+	if passwordEnv == "" {
+		passwordEnv = DefaultPasswordEnv
+	}
+	return CredentialProviderFunc(func(context.Context, string) (Credentials, error) {
+		return Credentials{UserName: os.Getenv(userNameEnv), Password: os.Getenv(passwordEnv)}, nil
+	})
+}
+
+// credentialInvalidator 由缓存凭据的 CredentialProvider 实现，registry 拒绝凭据(401)后丢弃 host 的缓存
+type credentialInvalidator interface {
+	invalidateCredentials(host string)
+}
+
+// invalidateCredentials 通知 provider 丢弃 host 缓存的凭据，provider 没有缓存时什么都不做
+func invalidateCredentials(provider CredentialProvider, host string) {
+	if invalidator, ok := provider.(credentialInvalidator); ok {
+		invalidator.invalidateCredentials(host)
+	}
+}
+
+// ChainCredentials 依次尝试每个 provider，返回第一组非空凭据
+func ChainCredentials(providers ...CredentialProvider) CredentialProvider {
+	return chainCredentials(providers)
+}
+
+type chainCredentials []CredentialProvider
+
+func (c chainCredentials) Credentials(ctx context.Context, host string) (Credentials, error) {
+	for _, provider := range c {
+		if provider == nil {
+			continue
+		}
+		creds, err := provider.Credentials(ctx, host)
+		if err != nil {
+			return Credentials{}, err
+		}
+		if !creds.empty() {
+			return creds, nil
+		}
+	}
+	return Credentials{}, nil
+}
+
+func (c chainCredentials) invalidateCredentials(host string) {
+	for _, provider := range c {
+		invalidateCredentials(provider, host)
+	}
+}
+
+// watchedFile 缓存文件内容，文件的修改时间或大小变化后重新读取
+type watchedFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	content []byte
+}
+
+// read 返回文件内容，文件不存在时返回 nil
+func (f *watchedFile) read() ([]byte, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.content != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.content, nil
+	}
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.content, f.modTime, f.size = content, info.ModTime(), info.Size()
+	return content, nil
+}
+
+// FileCredentials 从 JSON 文件读取凭据，文件更新后自动使用新的凭据，适合由外部轮换的 secret。
+// 支持 {"username": "...", "password": "..."} 以及 Harbor 导出的机器人账号 {"name": "...", "secret": "..."}
+func FileCredentials(path string) CredentialProvider {
+	file := &watchedFile{path: path}
+	return CredentialProviderFunc(func(context.Context, string) (Credentials, error) {
+		content, err := file.read()
+		if err != nil || content == nil {
+			return Credentials{}, err
+		}
+		var secret struct {
+			UserName string `json:"username"`
+			Password string `json:"password"`
+			Name     string `json:"name"`
+			Secret   string `json:"secret"`
+		}
+		if err = json.Unmarshal(content, &secret); err != nil {
+			return Credentials{}, fmt.Errorf("invalid credentials file %s: %w", path, err)
+		}
+		if secret.UserName == "" && secret.Name != "" {
+			return Credentials{UserName: secret.Name, Password: secret.Secret}, nil
+		}
+		return Credentials{UserName: secret.UserName, Password: secret.Password}, nil
+	})
+}
+
+// dockerConfig 是 ~/.docker/config.json 与 containers auth.json 的公共部分
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// DefaultDockerConfigPaths 返回 docker/podman 默认的认证文件路径，按优先级排序
+func DefaultDockerConfigPaths() []string {
+	var paths []string
+	if authFile := os.Getenv("REGISTRY_AUTH_FILE"); authFile != "" {
+		paths = append(paths, authFile)
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		paths = append(paths, filepath.Join(runtimeDir, "containers", "auth.json"))
+	}
+	home, _ := os.UserHomeDir()
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" && home != "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "containers", "auth.json"))
+	}
+	if dockerConfigDir := os.Getenv("DOCKER_CONFIG"); dockerConfigDir != "" {
+		paths = append(paths, filepath.Join(dockerConfigDir, "config.json"))
+	} else if home != "" {
+		paths = append(paths, filepath.Join(home, ".docker", "config.json"))
+	}
+	return paths
+}
+
+// DockerConfigCredentials 从 docker config.json / auth.json 读取凭据，
+// 支持 auths、credHelpers 与 credsStore。paths 为空时使用 DefaultDockerConfigPaths。
+// credential helper 的结果按 host 缓存 credentialHelperTTL
+func DockerConfigCredentials(paths ...string) CredentialProvider {
+	if len(paths) == 0 {
+		paths = DefaultDockerConfigPaths()
+	}
+	provider := &dockerConfigCredentials{}
+	for _, path := range paths {
+		provider.files = append(provider.files, &watchedFile{path: path})
+	}
+	return provider
+}
+
+type dockerConfigCredentials struct {
+	files   []*watchedFile
+	helpers helperCache
+}
+
+func (p *dockerConfigCredentials) Credentials(ctx context.Context, host string) (Credentials, error) {
+	for _, file := range p.files {
+		content, err := file.read()
+		if err != nil {
+			return Credentials{}, err
+		}
+		if content == nil {
+			continue
+		}
+		config := &dockerConfig{}
+		if err = json.Unmarshal(content, config); err != nil {
+			return Credentials{}, fmt.Errorf("invalid docker config %s: %w", file.path, err)
+		}
+		creds, found, err := config.credentials(ctx, host, &p.helpers)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("docker config %s: %w", file.path, err)
+		}
+		if found {
+			return creds, nil
+		}
+	}
+	return Credentials{}, nil
+}
+
+func (p *dockerConfigCredentials) invalidateCredentials(host string) {
+	p.helpers.invalidate(host)
+}
+
+// dockerConfigKeys 返回 host 在 docker config 中可能使用的 key
+func dockerConfigKeys(host string) []string {
+	host = registryHost(host)
+	if host == "docker.io" || host == "index.docker.io" || host == "registry-1.docker.io" {
+		return []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+	}
+	return []string{host}
+}
+
+func (c *dockerConfig) credentials(ctx context.Context, host string, helpers *helperCache) (Credentials, bool, error) {
+	keys := dockerConfigKeys(host)
+	for key, helper := range c.CredHelpers {
+		for _, k := range keys {
+			if registryHost(key) == k {
+				creds, err := helpers.get(ctx, helper, key, host)
+				return creds, !creds.empty(), err
+			}
+		}
+	}
+	for key, auth := range c.Auths {
+		for _, k := range keys {
+			if registryHost(key) != k {
+				continue
+			}
+			creds := Credentials{IdentityToken: auth.IdentityToken}
+			if auth.Auth != "" {
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				if err != nil {
+					return Credentials{}, false, fmt.Errorf("invalid auth for %s: %w", key, err)
+				}
+				userName, password, _ := strings.Cut(string(decoded), ":")
+				creds.UserName, creds.Password = userName, password
+			}
+			if !creds.empty() {
+				return creds, true, nil
+			}
+		}
+	}
+	if c.CredsStore != "" {
+		serverURL := keys[0]
+		if len(keys) > 1 {
+			// docker login 把 Docker Hub 的凭据保存在这个 key 下
+			serverURL = "https://index.docker.io/v1/"
+		}
+		creds, err := helpers.get(ctx, c.CredsStore, serverURL, host)
+		return creds, !creds.empty(), err
+	}
+	return Credentials{}, false, nil
+}
+
+// CredentialHelperCredentials 使用 docker-credential-<helper> 获取凭据，例如 ecr-login、pass、secretservice。
+// 结果按 host 缓存 credentialHelperTTL，registry 拒绝凭据后重新执行 helper
+func CredentialHelperCredentials(helper string) CredentialProvider {
+	return &helperCredentials{helper: helper}
+}
+
+type helperCredentials struct {
+	helper  string
+	helpers helperCache
+}
+
+func (p *helperCredentials) Credentials(ctx context.Context, host string) (Credentials, error) {
+	return p.helpers.get(ctx, p.helper, host, host)
+}
+
+func (p *helperCredentials) invalidateCredentials(host string) {
+	p.helpers.invalidate(host)
+}
+
+// credentialHelperTTL credential helper 结果的缓存时间。helper 通常要访问钥匙串或云厂商接口，
+// 不在每个请求前都执行；凭据轮换后最迟在 TTL 之后或者 registry 返回 401 时生效
+const credentialHelperTTL = time.Minute
+
+// helperCache 按 helper 与 serverURL 缓存 credential helper 的结果，零值可以直接使用
+type helperCache struct {
+	mu      sync.Mutex
+	entries map[string]helperCacheEntry
+}
+
+type helperCacheEntry struct {
+	host    string
+	creds   Credentials
+	expires time.Time
+}
+
+// get 返回 host 使用的 helper 凭据，缓存过期或不存在时执行 helper。执行失败的结果不缓存
+func (c *helperCache) get(ctx context.Context, helper, serverURL, host string) (Credentials, error) {
+	key := helper + "\x00" + serverURL
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.creds, nil
+	}
+
+	creds, err := credentialHelper(ctx, helper, serverURL)
+	if err != nil {
+		return Credentials{}, err
+	}
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]helperCacheEntry)
+	}
+	c.entries[key] = helperCacheEntry{host: registryHost(host), creds: creds, expires: time.Now().Add(credentialHelperTTL)}
+	c.mu.Unlock()
+	return creds, nil
+}
+
+// invalidate 丢弃 host 的全部缓存
+func (c *helperCache) invalidate(host string) {
+	host = registryHost(host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if entry.host == host {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// credentialHelper 按 docker credential helper 协议执行 `docker-credential-<helper> get`，
+// 未找到凭据时返回零值
+func credentialHelper(ctx context.Context, helper, serverURL string) (Credentials, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return Credentials{}, nil
+		}
+		return Credentials{}, fmt.Errorf("docker-credential-%s get %s: %w: %s", helper, serverURL, err, message)
+	}
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return Credentials{}, fmt.Errorf("docker-credential-%s get %s: %w", helper, serverURL, err)
+	}
+	// 按照约定，用户名为 <token> 时 Secret 是 identity token
+	if resp.Username == "<token>" {
+		return Credentials{IdentityToken: resp.Secret}, nil
+	}
+	return Credentials{UserName: resp.Username, Password: resp.Secret}, nil
+}
+
+// credentialProvider 返回 FmConfig 中配置的 CredentialProvider，未配置时使用 HarborUserName/HarborUserPassword
+func credentialProvider(config *FmConfig) CredentialProvider {
+	if config.Credentials != nil {
+		return config.Credentials
+	}
+	return StaticCredentials(config.HarborUserName, config.HarborUserPassword)
+}
@@ -0,0 +1,174 @@
+package manager
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func writeJSONFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertCredentials(t *testing.T, provider CredentialProvider, host string, expected Credentials) {
+	t.Helper()
+	creds, err := provider.Credentials(context.Background(), host)
+	if err != nil {
+		t.Fatalf("%s: %v", host, err)
+	}
+	if creds != expected {
+		t.Fatalf("%s: got %+v, want %+v", host, creds, expected)
+	}
+}
+
+// installCredentialHelper 在 PATH 中安装一个返回固定凭据的 docker-credential-<name>
+func installCredentialHelper(t *testing.T, name, output string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nread server\nif [ \"$server\" = \"missing.example.com\" ]; then echo 'credentials not found in native keychain'; exit 1; fi\necho '" + output + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDockerConfigCredentials(t *testing.T) {
+	installCredentialHelper(t, "fake", `{"ServerURL":"","Username":"helper-user","Secret":"helper-secret"}`)
+	installCredentialHelper(t, "token", `{"ServerURL":"","Username":"<token>","Secret":"refresh-token"}`)
+
+	dir := t.TempDir()
+	authFile := filepath.Join(dir, "auth.json")
+	dockerConfigFile := filepath.Join(dir, "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("robot$vmimages+ci:s3cret"))
+	writeJSONFile(t, authFile, `{"auths": {"https://hub.example.com": {"auth": "`+auth+`"}}}`)
+	writeJSONFile(t, dockerConfigFile, `{
+		"auths": {
+			"hub.example.com": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("shadowed:x"))+`"},
+			"dev.example.com:5000": {"identitytoken": "dev-token"}
+		},
+		"credHelpers": {"lab.example.com": "fake", "oauth.example.com": "token", "missing.example.com": "fake"}
+	}`)
+
+	provider := DockerConfigCredentials(authFile, dockerConfigFile, filepath.Join(dir, "not-exist.json"))
+	assertCredentials(t, provider, "hub.example.com", Credentials{UserName: "robot$vmimages+ci", Password: "s3cret"})
+	assertCredentials(t, provider, "dev.example.com:5000", Credentials{IdentityToken: "dev-token"})
+	assertCredentials(t, provider, "lab.example.com", Credentials{UserName: "helper-user", Password: "helper-secret"})
+	assertCredentials(t, provider, "oauth.example.com", Credentials{IdentityToken: "refresh-token"})
+	assertCredentials(t, provider, "missing.example.com", Credentials{})
+	assertCredentials(t, provider, "other.example.com", Credentials{})
+
+	writeJSONFile(t, dockerConfigFile, `{"credsStore": "fake"}`)
+	assertCredentials(t, DockerConfigCredentials(dockerConfigFile), "other.example.com", Credentials{UserName: "helper-user", Password: "helper-secret"})
+	assertCredentials(t, CredentialHelperCredentials("fake"), "hub.example.com", Credentials{UserName: "helper-user", Password: "helper-secret"})
+}
+
+func TestFileCredentialsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "robot.json")
+	provider := FileCredentials(path)
+	assertCredentials(t, provider, "hub.example.com", Credentials{})
+
+	writeJSONFile(t, path, `{"username": "ci", "password": "first"}`)
+	assertCredentials(t, provider, "hub.example.com", Credentials{UserName: "ci", Password: "first"})
+
+	// Harbor 导出的机器人账号格式
+	writeJSONFile(t, path, `{"name": "robot$vmimages+ci", "secret": "rotated-secret"}`)
+	assertCredentials(t, provider, "hub.example.com", Credentials{UserName: "robot$vmimages+ci", Password: "rotated-secret"})
+
+	writeJSONFile(t, path, `not json`)
+	if _, err := provider.Credentials(context.Background(), "hub.example.com"); err == nil {
+		t.Fatal("expected error for invalid credentials file")
+	}
+}
+
+func TestEnvAndChainCredentials(t *testing.T) {
+	t.Setenv(DefaultUserNameEnv, "")
+	t.Setenv(DefaultPasswordEnv, "")
+	provider := ChainCredentials(EnvCredentials("", ""), RobotAccountCredentials("robot$ci", "fallback"))
+	assertCredentials(t, provider, "hub.example.com", Credentials{UserName: "robot$ci", Password: "fallback"})
+
+	t.Setenv(DefaultUserNameEnv, "env-user")
+	t.Setenv(DefaultPasswordEnv, "env-password")
+	assertCredentials(t, provider, "hub.example.com", Credentials{UserName: "env-user", Password: "env-password"})
+
+	assertCredentials(t, credentialProvider(&FmConfig{HarborUserName: "a", HarborUserPassword: "b"}), "hub.example.com", Credentials{UserName: "a", Password: "b"})
+}
+
+func TestRegistryClientRereadsRotatedCredentials(t *testing.T) {
+	registry := newFakeRegistry(t)
+	path := filepath.Join(t.TempDir(), "robot.json")
+	writeJSONFile(t, path, `{"name": "robot$ci", "secret": "expired"}`)
+
+	backend := newRegistryBackend(&FmConfig{
+		Credentials: FileCredentials(path),
+		Transport:   TransportConfig{PlainHTTPRegistries: []string{registry.host()}},
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "rotation")
+	dgst := digest.FromString("missing")
+	if _, _, err := backend.StatBlob(ctx, harborRepo, dgst); err == nil {
+		t.Fatal("expected token request to fail with expired secret")
+	}
+
+	writeJSONFile(t, path, `{"name": "`+registry.username+`", "secret": "`+registry.password+`"}`)
+	_, exists, err := backend.StatBlob(ctx, harborRepo, dgst)
+	if err != nil {
+		t.Fatalf("rotated secret was not picked up: %v", err)
+	}
+	if exists {
+		t.Fatal("blob should not exist")
+	}
+}
+
+func TestCredentialHelperCache(t *testing.T) {
+	registry := newFakeRegistry(t)
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret.json")
+	script := "#!/bin/sh\ncat '" + secretFile + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-rotating"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv(DefaultUserNameEnv, "")
+	t.Setenv(DefaultPasswordEnv, "")
+	writeJSONFile(t, secretFile, `{"Username":"`+registry.username+`","Secret":"expired"}`)
+	dockerConfigFile := filepath.Join(dir, "config.json")
+	writeJSONFile(t, dockerConfigFile, `{"credHelpers": {"`+registry.host()+`": "rotating"}}`)
+	provider := ChainCredentials(EnvCredentials("", ""), DockerConfigCredentials(dockerConfigFile))
+
+	backend := newRegistryBackend(&FmConfig{
+		Credentials: provider,
+		Transport:   TransportConfig{PlainHTTPRegistries: []string{registry.host()}},
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "helper-cache")
+	dgst := digest.FromString("missing")
+	if _, _, err := backend.StatBlob(ctx, harborRepo, dgst); err == nil {
+		t.Fatal("expected token request to fail with expired secret")
+	}
+
+	// 401 之后丢弃缓存，重新执行 helper 取到轮换后的凭据
+	writeJSONFile(t, secretFile, `{"Username":"`+registry.username+`","Secret":"`+registry.password+`"}`)
+	if _, _, err := backend.StatBlob(ctx, harborRepo, dgst); err != nil {
+		t.Fatalf("rotated secret was not picked up: %v", err)
+	}
+
+	// TTL 内不再执行 helper
+	writeJSONFile(t, secretFile, `{"Username":"other","Secret":"other"}`)
+	assertCredentials(t, provider, registry.host(), Credentials{UserName: registry.username, Password: registry.password})
+	invalidateCredentials(provider, registry.host())
+	assertCredentials(t, provider, registry.host(), Credentials{UserName: "other", Password: "other"})
+
+	helper := CredentialHelperCredentials("rotating")
+	assertCredentials(t, helper, "hub.example.com", Credentials{UserName: "other", Password: "other"})
+	writeJSONFile(t, secretFile, `{"Username":"next","Secret":"next"}`)
+	assertCredentials(t, helper, "hub.example.com", Credentials{UserName: "other", Password: "other"})
+	invalidateCredentials(helper, "https://hub.example.com/vmimages")
+	assertCredentials(t, helper, "hub.example.com", Credentials{UserName: "next", Password: "next"})
+}
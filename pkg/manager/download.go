@@ -0,0 +1,351 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultMinParallelDownloadSize 小于该大小的 blob 不值得切分并行下载
+const defaultMinParallelDownloadSize int64 = 64 << 20
+
+func (fm *fileManager) minParallelDownloadSize() int64 {
+	if fm.minParallelSize <= 0 {
+		return defaultMinParallelDownloadSize
+	}
+	return fm.minParallelSize
+}
+
+// downloadBlobToFile 将 blob 下载到 <target>.part，中断后从 .part 的当前长度继续。
+// 下载过程中同步计算 digest，校验通过并 fsync 后才原子地重命名为目标文件，
+// 校验失败时删除 .part 并返回 ErrDigestMismatch
+func (fm *fileManager) downloadBlobToFile(ctx context.Context, harborRepo string, dgst digest.Digest, targetFilePath string, progress *progressTracker) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	// 命中内容缓存时直接从本地复制，缓存内容损坏时丢弃并重新下载
+	if reader, size, ok := fm.openCachedBlob(dgst); ok {
+		progress.setBlob(dgst, size)
+		progress.phase(PhaseCacheHit, 0, size)
+		err := copyToFileVerified(&progressReader{Reader: reader, tracker: progress}, dgst, targetFilePath)
+		_ = reader.Close()
+		if err == nil {
+			progress.done()
+		}
+		if !errors.Is(err, ErrDigestMismatch) {
+			return err
+		}
+		fm.blobCache().remove(dgst)
+	}
+
+	backend, err := fm.getBackend()
+	if err != nil {
+		return err
+	}
+
+	blobSize, exists, err := backend.StatBlob(ctx, harborRepo, dgst)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("blob %s not found in %s", dgst, harborRepo)
+	}
+	progress.setBlob(dgst, blobSize)
+
+	// 并行模式：按 Range 切分后并发下载，服务端不支持 Range 时退回顺序下载
+	if fm.hifConf.DownloadConcurrency > 1 && blobSize >= fm.minParallelDownloadSize() {
+		err = fm.downloadBlobParallel(ctx, backend, harborRepo, dgst, blobSize, targetFilePath, progress)
+		if err == nil {
+			progress.done()
+		}
+		if !errors.Is(err, ErrRangeNotSupported) {
+			return err
+		}
+	}
+
+	partPath := targetFilePath + ".part"
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func(partFile *os.File) {
+		_ = partFile.Close()
+	}(partFile)
+
+	offset, err := partFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if blobSize >= 0 && offset > blobSize {
+		offset = 0
+	}
+
+	// 续传时先把已下载的部分计入 digest
+	verifier := dgst.Algorithm().Digester()
+	if offset > 0 {
+		if _, err = io.Copy(verifier.Hash(), io.NewSectionReader(partFile, 0, offset)); err != nil {
+			return err
+		}
+	}
+
+	progress.phase(PhaseDownloading, offset, blobSize)
+	policy := fm.retryPolicy()
+	failures := 0
+	for blobSize < 0 || offset < blobSize {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		next, n, err := fetchBlobFrom(ctx, backend, harborRepo, dgst, partFile, offset, &verifier, progress)
+		offset = next
+		if err == nil && blobSize < 0 {
+			break
+		}
+		if err != nil && !isRetryable(err) {
+			return err
+		}
+		if n > 0 {
+			// 有进展时重置失败计数，保证不稳定的链路也能把大文件下完
+			failures = 0
+			continue
+		}
+		failures++
+		if failures >= policy.attempts() {
+			if err == nil {
+				err = fmt.Errorf("unexpected end of blob %s at offset %d", dgst, offset)
+			}
+			return err
+		}
+		if err = policy.wait(ctx, failures, retryAfter(err)); err != nil {
+			return err
+		}
+	}
+
+	// 顺序下载时 digest 已经在下载过程中算好，这里只需要比较并 fsync
+	progress.phase(PhaseVerifying, offset, offset)
+	if err = fm.commitDownload(partFile, dgst, verifier.Digest(), targetFilePath); err != nil {
+		return err
+	}
+	progress.done()
+	return nil
+}
+
+// commitDownload 校验 digest，通过后提交 .part 文件并放入内容缓存
+func (fm *fileManager) commitDownload(partFile *os.File, expected, actual digest.Digest, targetFilePath string) error {
+	if actual != expected {
+		_ = partFile.Close()
+		_ = os.Remove(partFile.Name())
+		return &DigestMismatchError{Path: targetFilePath, Expected: expected, Actual: actual}
+	}
+	if err := commitPartFile(partFile, targetFilePath); err != nil {
+		return err
+	}
+	// 放入内容缓存，失败不影响下载结果
+	if cache := fm.blobCache(); cache != nil {
+		_ = cache.add(expected, targetFilePath)
+	}
+	return nil
+}
+
+// downloadBlobParallel 将 blob 切分为 DownloadConcurrency 个区间并发下载到预分配的 <target>.parallel 文件，
+// 每个区间独立重试，全部完成后对整个文件做 digest 校验。预分配的文件中间有空洞，不能像 .part 一样按长度续传，
+// 因此不与顺序下载共用 .part，失败时直接删除
+func (fm *fileManager) downloadBlobParallel(ctx context.Context, backend Backend, repo string, dgst digest.Digest, blobSize int64, targetFilePath string, progress *progressTracker) error {
+	partPath := targetFilePath + ".parallel"
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func(partFile *os.File) {
+		_ = partFile.Close()
+		if !committed {
+			_ = os.Remove(partPath)
+		}
+	}(partFile)
+
+	// 预分配文件
+	if err = partFile.Truncate(blobSize); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress.phase(PhaseDownloading, 0, blobSize)
+	concurrency := int64(fm.hifConf.DownloadConcurrency)
+	rangeSize := (blobSize + concurrency - 1) / concurrency
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for start := int64(0); start < blobSize; start += rangeSize {
+		end := min(start+rangeSize, blobSize)
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			if err := fetchBlobRange(ctx, fm.retryPolicy(), backend, repo, dgst, partFile, start, end, progress); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+
+	// 优先返回真正的失败原因，而不是其它区间被取消产生的错误
+	for rangeErr := range errs {
+		if err == nil || errors.Is(err, context.Canceled) {
+			err = rangeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	progress.phase(PhaseVerifying, 0, blobSize)
+	verifier := dgst.Algorithm().Digester()
+	if _, err = io.Copy(verifier.Hash(), &progressReader{Reader: io.NewSectionReader(partFile, 0, blobSize), tracker: progress}); err != nil {
+		return err
+	}
+	if err = fm.commitDownload(partFile, dgst, verifier.Digest(), targetFilePath); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// fetchBlobRange 下载 [start, end) 区间，遇到可重试的错误时按 policy 退避后从该区间已写入的位置继续
+func fetchBlobRange(ctx context.Context, policy RetryPolicy, backend Backend, repo string, dgst digest.Digest, partFile *os.File, start, end int64, progress *progressTracker) error {
+	failures := 0
+	for pos := start; pos < end; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reader, err := backend.GetBlobRange(ctx, repo, dgst, pos, end)
+		if errors.Is(err, ErrRangeNotSupported) {
+			return err
+		}
+		var n int64
+		if err == nil {
+			n, err = io.Copy(io.NewOffsetWriter(partFile, pos), &progressReader{Reader: io.LimitReader(reader, end-pos), tracker: progress})
+			_ = reader.Close()
+			pos += n
+		}
+		if err != nil && !isRetryable(err) {
+			return err
+		}
+		if n > 0 {
+			failures = 0
+			continue
+		}
+		failures++
+		if failures >= policy.attempts() {
+			if err == nil {
+				err = fmt.Errorf("unexpected end of blob %s at offset %d", dgst, pos)
+			}
+			return err
+		}
+		if err = policy.wait(ctx, failures, retryAfter(err)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyToFileVerified 将 reader 的内容经过校验后原子地写入目标文件。
+// 使用单独的临时文件，不影响之前中断的下载留下的 .part
+func copyToFileVerified(reader io.Reader, dgst digest.Digest, targetFilePath string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(targetFilePath), filepath.Base(targetFilePath)+".cache-*")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tmpFile.Close()
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+	// 与 .part 文件的权限一致
+	if err = tmpFile.Chmod(0o644); err != nil {
+		return err
+	}
+
+	verifier := dgst.Algorithm().Digester()
+	if _, err = io.Copy(&hashingWriter{w: tmpFile, h: verifier.Hash()}, reader); err != nil {
+		return err
+	}
+	if actual := verifier.Digest(); actual != dgst {
+		return &DigestMismatchError{Path: targetFilePath, Expected: dgst, Actual: actual}
+	}
+	if err = commitPartFile(tmpFile, targetFilePath); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// fetchBlobFrom 从 offset 处续传，返回 .part 文件的新长度以及本次写入的字节数
+func fetchBlobFrom(ctx context.Context, backend Backend, repo string, dgst digest.Digest, partFile *os.File, offset int64, verifier *digest.Digester, progress *progressTracker) (int64, int64, error) {
+	reader, start, err := backend.GetBlob(ctx, repo, dgst, offset)
+	if err != nil {
+		return offset, 0, err
+	}
+	defer reader.Close()
+
+	// 服务端忽略了 Range，只能从头开始
+	if start != offset {
+		offset = 0
+		*verifier = dgst.Algorithm().Digester()
+		progress.rewind()
+	}
+	// 丢弃上次失败时可能残留的半截写入
+	if err = partFile.Truncate(offset); err != nil {
+		return offset, 0, err
+	}
+	if _, err = partFile.Seek(offset, io.SeekStart); err != nil {
+		return offset, 0, err
+	}
+	n, err := io.Copy(&hashingWriter{w: partFile, h: (*verifier).Hash()}, &progressReader{Reader: reader, tracker: progress})
+	return offset + n, n, err
+}
+
+// hashingWriter 只把真正写入成功的字节计入 hash，保证续传时 hash 与文件内容一致
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+// commitPartFile fsync 后将 .part 文件原子地重命名为目标文件
+func commitPartFile(partFile *os.File, targetFilePath string) error {
+	if err := partFile.Sync(); err != nil {
+		return err
+	}
+	if err := partFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partFile.Name(), targetFilePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(targetFilePath))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
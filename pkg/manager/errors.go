@@ -0,0 +1,254 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrDigestMismatch 表示下载得到的内容与期望的 digest 不一致
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// DigestMismatchError 描述一次校验失败，可以通过 errors.Is(err, ErrDigestMismatch) 判断
+type DigestMismatchError struct {
+	Path     string
+	Expected digest.Digest
+	Actual   digest.Digest
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s, expected %s, got %s", ErrDigestMismatch, e.Path, e.Expected, e.Actual)
+}
+
+func (e *DigestMismatchError) Is(target error) bool {
+	return target == ErrDigestMismatch
+}
+
+// ErrRangeNotSupported 表示后端不支持按区间读取 blob，例如 registry 忽略了 Range 请求，
+// 调用方可以通过 errors.Is 判断后退回顺序读取
+var ErrRangeNotSupported = errors.New("registry does not support range requests")
+
+// ErrManifestConflict 表示并发写入同一个 tag 时，重试后仍然检测到冲突
+var ErrManifestConflict = errors.New("manifest conflict")
+
+// ManifestConflictError 描述一次 manifest 更新冲突，可以通过 errors.Is(err, ErrManifestConflict) 或 errors.Is(err, ErrConflict) 判断。
+//
+// registry 不支持条件写入，冲突只能在写入后立即以及等待 FmConfig.ManifestSettleDelay 后检查 tag 发现：
+// 其它写入方在此之前读取了旧 manifest、在此之后才写入时，本次写入的文件会被覆盖而不会返回该错误。
+// oci-layout 后端在锁文件保护下条件写入，同样使用本库写入时不受此限制
+type ManifestConflictError struct {
+	Repo     string
+	Tag      string
+	Attempts int
+	// Expected 读取时 tag 指向的 manifest，Actual 检测到冲突时 tag 指向的 manifest，为空表示 tag 不存在
+	Expected digest.Digest
+	Actual   digest.Digest
+}
+
+func (e *ManifestConflictError) Error() string {
+	return fmt.Sprintf("%s: %s:%s changed concurrently after %d attempts, expected %q, got %q",
+		ErrManifestConflict, e.Repo, e.Tag, e.Attempts, e.Expected, e.Actual)
+}
+
+func (e *ManifestConflictError) Is(target error) bool {
+	return target == ErrManifestConflict || target == ErrConflict
+}
+
+// registry 与 Harbor 请求失败的分类，可以通过 errors.Is 判断，
+// 详细信息(操作、仓库、tag、HTTP 状态码)通过 errors.As 取得 *RegistryError
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrForbidden     = errors.New("forbidden")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrConflict      = errors.New("conflict")
+)
+
+// RegistryError 描述一次 registry 或 Harbor API 请求的失败
+type RegistryError struct {
+	// Op 失败的操作，例如 get manifest、list artifacts
+	Op   string
+	Repo string
+	Tag  string
+	// Status HTTP 状态码，containers/image 没有提供时为 0
+	Status int
+	// Code、Message 来自响应中的 {"errors":[{"code":...,"message":...}]}
+	Code    string
+	Message string
+	// RetryAfter 服务端通过 Retry-After 要求的等待时间
+	RetryAfter time.Duration
+	// Kind 是 ErrNotFound 等分类之一，无法分类时为 nil
+	Kind error
+	// Err 是 containers/image 返回的原始错误
+	Err error
+}
+
+func (e *RegistryError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Repo != "" {
+		b.WriteString(" " + e.Repo)
+		if e.Tag != "" {
+			b.WriteString(":" + e.Tag)
+		}
+	}
+	b.WriteString(": ")
+	if e.Kind != nil {
+		b.WriteString(e.Kind.Error())
+	} else {
+		b.WriteString("failed")
+	}
+	if e.Status != 0 {
+		fmt.Fprintf(&b, ", status code %d", e.Status)
+	}
+	if e.Code != "" {
+		b.WriteString(", " + e.Code)
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	} else if e.Err != nil {
+		b.WriteString(": " + e.Err.Error())
+	}
+	return b.String()
+}
+
+func (e *RegistryError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// harborErrorCodes 是 Harbor 在 /v2 接口中使用、但 errcode 没有注册的错误码。
+// containers/image 用 errcode 解析错误响应，未注册的错误码只剩 UNKNOWN 与消息，HTTP 状态码也会丢失，
+// 注册后 wrapImageError 可以按错误码及其状态码分类
+var harborErrorCodes = []errcode.ErrorDescriptor{
+	{Value: "NOT_FOUND", Message: "not found", HTTPStatusCode: http.StatusNotFound},
+	{Value: "FORBIDDEN", Message: "forbidden", HTTPStatusCode: http.StatusForbidden},
+	{Value: "CONFLICT", Message: "conflict", HTTPStatusCode: http.StatusConflict},
+	{Value: "BAD_REQUEST", Message: "bad request", HTTPStatusCode: http.StatusBadRequest},
+	{Value: "METHOD_NOT_ALLOWED", Message: "method not allowed", HTTPStatusCode: http.StatusMethodNotAllowed},
+	{Value: "TOO_MANY_REQUEST", Message: "too many requests", HTTPStatusCode: http.StatusTooManyRequests},
+}
+
+func init() {
+	for _, descriptor := range harborErrorCodes {
+		// 其它依赖可能已经注册过同名的错误码，重复注册会 panic
+		if errcode.ParseErrorCode(descriptor.Value) == errcode.ErrorCodeUnknown {
+			errcode.Register("harbor", descriptor)
+		}
+	}
+}
+
+// errorKind 按 HTTP 状态码以及 registry/Harbor 的错误码对失败分类。
+// Harbor 超出存储配额时返回 403 DENIED，只能从消息中区分
+func errorKind(status int, code, message string) error {
+	switch code {
+	case "MANIFEST_UNKNOWN", "NAME_UNKNOWN", "BLOB_UNKNOWN", "BLOB_UPLOAD_UNKNOWN", "NOT_FOUND":
+		return ErrNotFound
+	case "UNAUTHORIZED":
+		return ErrUnauthorized
+	case "TOOMANYREQUESTS":
+		return ErrRateLimited
+	case "CONFLICT":
+		return ErrConflict
+	case "DENIED", "FORBIDDEN":
+		status = http.StatusForbidden
+	}
+	switch status {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		lower := strings.ToLower(message)
+		if strings.Contains(lower, "exceed") && (strings.Contains(lower, "quota") || strings.Contains(lower, "upper limit")) {
+			return ErrQuotaExceeded
+		}
+		return ErrForbidden
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return ErrConflict
+	}
+	return nil
+}
+
+// newHTTPError 读取失败响应中的错误信息，返回 *RegistryError
+func newHTTPError(resp *http.Response, op, repo, tag string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &RegistryError{Op: op, Repo: repo, Tag: tag, Status: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	var errorBody struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &errorBody) == nil && len(errorBody.Errors) > 0 {
+		e.Code, e.Message = errorBody.Errors[0].Code, errorBody.Errors[0].Message
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	e.Kind = errorKind(e.Status, e.Code, e.Message)
+	return e
+}
+
+// wrapImageError 对 containers/image 返回的错误分类，能够分类或者得知 HTTP 状态码时包装为 *RegistryError，否则原样返回
+func wrapImageError(err error, op, repo, tag string) error {
+	var registryErr *RegistryError
+	if err == nil || errors.As(err, &registryErr) {
+		return err
+	}
+	e := &RegistryError{Op: op, Repo: repo, Tag: tag, Err: err}
+	var unauthorized docker.ErrUnauthorizedForCredentials
+	var imageNotFound layout.ImageNotFoundError
+	var errs errcode.Errors
+	var coder errcode.ErrorCoder
+	switch {
+	case errors.As(err, &unauthorized):
+		e.Status, e.Kind = http.StatusUnauthorized, ErrUnauthorized
+	case errors.Is(err, docker.ErrTooManyRequests):
+		e.Status, e.Kind = http.StatusTooManyRequests, ErrRateLimited
+	case errors.Is(err, os.ErrNotExist):
+		// oci layout 中不存在的文件
+		e.Kind = ErrNotFound
+	case errors.As(err, &imageNotFound):
+		// oci layout 的 index.json 中没有对应的 tag
+		e.Kind = ErrNotFound
+	case errors.As(err, &errs) && len(errs) > 0:
+		return wrapImageError(errs[0], op, repo, tag)
+	case errors.As(err, &coder):
+		descriptor := coder.ErrorCode().Descriptor()
+		e.Code = descriptor.Value
+		var codeErr errcode.Error
+		if errors.As(err, &codeErr) {
+			e.Message = codeErr.Message
+		}
+		if coder.ErrorCode() == errcode.ErrorCodeUnknown {
+			// 既没有可识别的错误码也没有状态码，不按消息猜测，原样返回
+			break
+		}
+		e.Status = descriptor.HTTPStatusCode
+		e.Kind = errorKind(e.Status, e.Code, e.Message)
+	default:
+		if e.Status = imageErrorStatus(err); e.Status != 0 {
+			e.Kind = errorKind(e.Status, "", "")
+		}
+	}
+	if e.Kind == nil && e.Status == 0 {
+		return err
+	}
+	return e
+}
@@ -0,0 +1,120 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestNewHTTPError(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		body   string
+		kind   error
+		code   string
+	}{
+		{http.StatusNotFound, `{"errors":[{"code":"NOT_FOUND","message":"repository vmimages/ubuntu not found"}]}`, ErrNotFound, "NOT_FOUND"},
+		{http.StatusUnauthorized, `{"errors":[{"code":"UNAUTHORIZED","message":"unauthorized"}]}`, ErrUnauthorized, "UNAUTHORIZED"},
+		{http.StatusForbidden, `{"errors":[{"code":"FORBIDDEN","message":"forbidden"}]}`, ErrForbidden, "FORBIDDEN"},
+		{http.StatusForbidden, `{"errors":[{"code":"DENIED","message":"adding 1.2 GiB of storage resource, which when updated to current usage of 9.5 GiB will exceed the configured upper limit of 10.0 GiB."}]}`, ErrQuotaExceeded, "DENIED"},
+		{http.StatusTooManyRequests, `rate limit`, ErrRateLimited, ""},
+		{http.StatusConflict, `{"errors":[{"code":"CONFLICT","message":"already exists"}]}`, ErrConflict, "CONFLICT"},
+		{http.StatusInternalServerError, `oops`, nil, ""},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Body: io.NopCloser(strings.NewReader(tc.body))}
+		err := newHTTPError(resp, "list artifacts", "vmimages/ubuntu", "22.04")
+		var registryErr *RegistryError
+		if !errors.As(err, &registryErr) {
+			t.Fatalf("%d: expected RegistryError, got %v", tc.status, err)
+		}
+		if registryErr.Kind != tc.kind || registryErr.Status != tc.status || registryErr.Code != tc.code || registryErr.Tag != "22.04" {
+			t.Fatalf("%d: unexpected error %+v", tc.status, registryErr)
+		}
+		if tc.kind != nil && !errors.Is(fmt.Errorf("wrapped: %w", err), tc.kind) {
+			t.Fatalf("%d: errors.Is(%v, %v) = false", tc.status, err, tc.kind)
+		}
+	}
+}
+
+func TestWrapImageError(t *testing.T) {
+	// Harbor 的 NOT_FOUND 经 errcode 解析后保留错误码
+	var harborErrors errcode.Errors
+	if err := json.Unmarshal([]byte(`{"errors":[{"code":"NOT_FOUND","message":"artifact vmimages/ubuntu:latest not found"}]}`), &harborErrors); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		err  error
+		kind error
+	}{
+		{fmt.Errorf("reading manifest latest: %w", harborErrors), ErrNotFound},
+		{fmt.Errorf("reading manifest latest: %w", errcode.Error{Code: errcode.ErrorCodeUnknown, Message: "artifact vmimages/ubuntu:latest not found"}), nil},
+		{fmt.Errorf("reading manifest latest: %w", errcode.Errors{errcode.ErrorCodeDenied.WithMessage("requested access to the resource is denied")}), ErrForbidden},
+		{errcode.ErrorCodeTooManyRequests, ErrRateLimited},
+		{docker.ErrUnauthorizedForCredentials{Err: errors.New("401")}, ErrUnauthorized},
+		{fmt.Errorf("pinging registry: %w", docker.ErrTooManyRequests), ErrRateLimited},
+		{fmt.Errorf("reading manifest latest: %w", layout.ImageNotFoundError{}), ErrNotFound},
+		{errors.New("connection refused"), nil},
+	} {
+		err := wrapImageError(tc.err, "get manifest", "hub.example.com/vmimages/ubuntu", "latest")
+		if tc.kind == nil {
+			if err != tc.err {
+				t.Fatalf("unclassified error %v was wrapped as %v", tc.err, err)
+			}
+			continue
+		}
+		var registryErr *RegistryError
+		if !errors.Is(err, tc.kind) || !errors.As(err, &registryErr) || registryErr.Op != "get manifest" || registryErr.Repo != "hub.example.com/vmimages/ubuntu" {
+			t.Fatalf("wrapImageError(%v) = %v, want %v", tc.err, err, tc.kind)
+		}
+	}
+}
+
+func TestRegistryAndHarborErrors(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+
+	harborClient := NewHarborClient(registry.server.URL, fakeUserName, fakePassword, nil)
+	_, err := harborClient.GetArtifactsByPage(ctx, defaultHarborProject, "missing", 10, 1)
+	var registryErr *RegistryError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &registryErr) || registryErr.Status != http.StatusNotFound || registryErr.Op != "list artifacts" {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	harborClient.Password = "wrong"
+	if err = harborClient.DeleteRepo(ctx, defaultHarborProject, "missing"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	registry.password = "rotated"
+	backend, err := fm.getBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = backend.StatBlob(ctx, testRepo(registry, "ubuntu"), digest.FromString("blob")); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	// 非 Bearer 质询直接返回 401，错误中带仓库路径
+	basic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer basic.Close()
+	client := newRegistryClient(strings.TrimPrefix(basic.URL, "http://"), StaticCredentials("", ""))
+	client.scheme = "http"
+	_, _, err = client.statBlob(ctx, "vmimages/ubuntu", digest.FromString("blob"))
+	if !errors.Is(err, ErrUnauthorized) || !errors.As(err, &registryErr) || registryErr.Repo != "vmimages/ubuntu" {
+		t.Fatalf("expected unauthorized for vmimages/ubuntu, got %v", err)
+	}
+}
@@ -0,0 +1,727 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	fakeUserName = "robot$ci"
+	fakePassword = "secret"
+	fakeToken    = "fake-token"
+)
+
+type fakeManifest struct {
+	mediaType string
+	content   []byte
+	digest    digest.Digest
+	id        int
+	pushTime  time.Time
+}
+
+type fakeRepository struct {
+	tags      map[string]digest.Digest
+	manifests map[digest.Digest]*fakeManifest
+}
+
+// fakeRegistry 是一个内存中的 OCI Distribution registry，同时模拟 Harbor v2.0
+// 的 artifacts/repositories 接口，registry 使用 Bearer token，Harbor API 使用 Basic 认证
+type fakeRegistry struct {
+	t        *testing.T
+	server   *httptest.Server
+	username string
+	password string
+
+	mu      sync.Mutex
+	blobs   map[digest.Digest][]byte
+	repos   map[string]*fakeRepository
+	uploads map[string][]byte
+	nextID  int
+	// projects 通过 /api/v2.0/projects 创建的项目，仓库接口不要求项目存在
+	projects map[string]*fakeProject
+
+	// 以下字段用于观察与注入故障
+	patchOffsets []int64
+	blobRanges   []string
+	blobGets     int
+	// blobRequests 读取 blob 的 GET 请求数，包括 failBlobGets 注入的失败
+	blobRequests int
+	// failBlobGets 接下来的多少次读取 blob 返回 503
+	failBlobGets int
+	failPatches  int
+	// lostPatches 接下来的多少次 PATCH 在写入数据后返回 500，模拟响应丢失
+	lostPatches int
+	// unavailable 接下来的多少个请求返回 503 和 Retry-After
+	unavailable int
+	// stalledManifests 接下来的多少次读取 manifest 在客户端断开或 2s 后才响应，模拟没有响应的 registry
+	stalledManifests int
+	// lostManifestPuts 接下来的多少次 manifest 写入在生效后返回 502，模拟响应丢失
+	lostManifestPuts int
+	manifestPuts     int
+	// resourceNamePaths 带有 X-Is-Resource-Name 请求头的 Harbor API 请求路径
+	resourceNamePaths []string
+	// harborAPIStatus 不为 0 时 Harbor API 请求都返回该状态码，模拟没有权限或者不是 Harbor 的 registry
+	harborAPIStatus int
+	// omitLinks 为 true 时列出制品不返回 Link 头，模拟旧版本 Harbor
+	omitLinks bool
+	// clobberTags 为 true 时每次写入 tag 后立即用另一个 manifest 覆盖，模拟并发写入方
+	clobberTags bool
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		t:        t,
+		username: fakeUserName,
+		password: fakePassword,
+		blobs:    map[digest.Digest][]byte{},
+		repos:    map[string]*fakeRepository{},
+		uploads:  map[string][]byte{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// host 返回 127.0.0.1:port，可直接拼成 harborRepo
+func (r *fakeRegistry) host() string {
+	u, _ := url.Parse(r.server.URL)
+	return u.Host
+}
+
+func (r *fakeRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	unavailable := r.unavailable > 0
+	if unavailable {
+		r.unavailable--
+	}
+	stalled := r.stalledManifests > 0 && req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/manifests/")
+	if stalled {
+		r.stalledManifests--
+	}
+	if req.Header.Get("X-Is-Resource-Name") != "" {
+		r.resourceNamePaths = append(r.resourceNamePaths, req.URL.Path)
+	}
+	r.mu.Unlock()
+	if stalled {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+	if unavailable {
+		w.Header().Set("Retry-After", "0")
+		writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "injected failure")
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/service/token":
+		r.serveToken(w, req)
+	case strings.HasPrefix(req.URL.Path, "/api/v2.0/"):
+		if r.harborAPIStatus != 0 {
+			http.Error(w, http.StatusText(r.harborAPIStatus), r.harborAPIStatus)
+			return
+		}
+		if user, pass, ok := req.BasicAuth(); !ok || user != r.username || pass != r.password {
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "unauthorized")
+			return
+		}
+		if strings.Contains(req.URL.Path, "/repositories") {
+			r.serveHarbor(w, req)
+		} else {
+			r.serveProjects(w, req)
+		}
+	case strings.HasPrefix(req.URL.Path, "/v2/"):
+		if req.Header.Get("Authorization") != "Bearer "+fakeToken {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/service/token",service="fake-registry"`, r.server.URL))
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		r.serveRegistry(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if user, pass, ok := req.BasicAuth(); !ok || user != r.username || pass != r.password {
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"token": fakeToken})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func (r *fakeRegistry) repo(name string, create bool) *fakeRepository {
+	repo, ok := r.repos[name]
+	if !ok && create {
+		repo = &fakeRepository{tags: map[string]digest.Digest{}, manifests: map[digest.Digest]*fakeManifest{}}
+		r.repos[name] = repo
+	}
+	return repo
+}
+
+func (r *fakeRegistry) serveRegistry(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+	case path == "_catalog":
+		names := make([]string, 0, len(r.repos))
+		for name := range r.repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"repositories": names})
+	case strings.HasSuffix(path, "/tags/list"):
+		r.serveTags(w, strings.TrimSuffix(path, "/tags/list"))
+	case strings.Contains(path, "/blobs/uploads/"):
+		i := strings.LastIndex(path, "/blobs/uploads/")
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		r.serveBlob(w, req, digest.Digest(path[i+len("/blobs/"):]))
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *fakeRegistry) serveTags(w http.ResponseWriter, name string) {
+	repo := r.repo(name, false)
+	if repo == nil {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+	tags := make([]string, 0, len(repo.tags))
+	for tag := range repo.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "tags": tags})
+}
+
+// uploadLocation 返回上传会话地址，与 docker/distribution 一样用 _state 记录已提交的偏移量
+func uploadLocation(name, uuid string, offset int) string {
+	return fmt.Sprintf("/v2/%s/blobs/uploads/%s?_state=%s.%d", name, uuid, uuid, offset)
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, name, uuid string) {
+	if req.Method == http.MethodPost {
+		r.nextID++
+		uuid = strconv.Itoa(r.nextID)
+		r.uploads[uuid] = nil
+		w.Header().Set("Location", uploadLocation(name, uuid, 0))
+		w.Header().Set("Docker-Upload-UUID", uuid)
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	data, ok := r.uploads[uuid]
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown")
+		return
+	}
+	// _state 中的偏移量与会话不一致时拒绝请求并取消会话
+	if state := req.URL.Query().Get("_state"); state != fmt.Sprintf("%s.%d", uuid, len(data)) {
+		delete(r.uploads, uuid)
+		writeRegistryError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", "blob upload invalid")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Location", uploadLocation(name, uuid, len(data)))
+		w.Header().Set("Range", uploadRange(data))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		if r.failPatches > 0 {
+			r.failPatches--
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "injected failure")
+			return
+		}
+		if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+			start, _, _ := strings.Cut(contentRange, "-")
+			offset, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || offset != int64(len(data)) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			r.patchOffsets = append(r.patchOffsets, offset)
+		}
+		body, _ := io.ReadAll(req.Body)
+		r.uploads[uuid] = append(data, body...)
+		if r.lostPatches > 0 {
+			r.lostPatches--
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "injected failure after the chunk was written")
+			return
+		}
+		w.Header().Set("Location", uploadLocation(name, uuid, len(r.uploads[uuid])))
+		w.Header().Set("Range", uploadRange(r.uploads[uuid]))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		data = append(data, body...)
+		expected, err := digest.Parse(req.URL.Query().Get("digest"))
+		if err != nil || digest.FromBytes(data) != expected {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+			return
+		}
+		delete(r.uploads, uuid)
+		r.blobs[expected] = data
+		r.repo(name, true)
+		w.Header().Set("Location", "/v2/"+name+"/blobs/"+expected.String())
+		w.Header().Set("Docker-Content-Digest", expected.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func uploadRange(data []byte) string {
+	if len(data) == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", len(data)-1)
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, dgst digest.Digest) {
+	data, ok := r.blobs[dgst]
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	if req.Method == http.MethodGet {
+		r.blobRequests++
+		if r.failBlobGets > 0 {
+			r.failBlobGets--
+			writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "injected failure")
+			return
+		}
+		r.blobGets++
+		r.blobRanges = append(r.blobRanges, req.Header.Get("Range"))
+	}
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, name, ref string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		m := r.lookupManifest(name, ref)
+		if m == nil {
+			writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("artifact %s:%s not found", name, ref))
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", m.digest.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(m.content)
+		}
+	case http.MethodPut:
+		content, _ := io.ReadAll(req.Body)
+		mediaType := req.Header.Get("Content-Type")
+		if mediaType == "" {
+			var probe struct {
+				MediaType string `json:"mediaType"`
+			}
+			_ = json.Unmarshal(content, &probe)
+			mediaType = probe.MediaType
+		}
+		// 与真实 registry 一样，manifest 引用的 blob 必须已经上传
+		var refs struct {
+			Config struct {
+				Digest digest.Digest `json:"digest"`
+			} `json:"config"`
+			Layers []struct {
+				Digest digest.Digest `json:"digest"`
+			} `json:"layers"`
+		}
+		_ = json.Unmarshal(content, &refs)
+		for _, ref := range append(refs.Layers, refs.Config) {
+			if _, ok := r.blobs[ref.Digest]; ref.Digest != "" && !ok {
+				writeRegistryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+ref.Digest.String())
+				return
+			}
+		}
+		dgst := digest.FromBytes(content)
+		repo := r.repo(name, true)
+		m, ok := repo.manifests[dgst]
+		if !ok {
+			r.nextID++
+			m = &fakeManifest{mediaType: mediaType, content: content, digest: dgst, id: r.nextID, pushTime: time.Now()}
+			repo.manifests[dgst] = m
+		}
+		if _, err := digest.Parse(ref); err != nil {
+			repo.tags[ref] = dgst
+			if r.clobberTags {
+				r.nextID++
+				content := []byte(fmt.Sprintf(`{"schemaVersion": 2, "layers": [], "annotations": {"id": "%d"}}`, r.nextID))
+				clobber := &fakeManifest{mediaType: mediaType, content: content, digest: digest.FromBytes(content), id: r.nextID, pushTime: time.Now()}
+				repo.manifests[clobber.digest] = clobber
+				repo.tags[ref] = clobber.digest
+			}
+		}
+		r.manifestPuts++
+		if r.lostManifestPuts > 0 {
+			r.lostManifestPuts--
+			writeRegistryError(w, http.StatusBadGateway, "UNKNOWN", "injected failure")
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Location", "/v2/"+name+"/manifests/"+dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		repo := r.repo(name, false)
+		dgst, err := digest.Parse(ref)
+		if repo == nil || err != nil || repo.manifests[dgst] == nil {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		delete(repo.manifests, dgst)
+		for tag, tagged := range repo.tags {
+			if tagged == dgst {
+				delete(repo.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// putManifest 直接写入 blob 与 manifest，模拟其它工具(oras、旧版本)推送的制品
+func (r *fakeRegistry) putManifest(name, tag, mediaType string, content []byte, blobs ...[]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, blob := range blobs {
+		r.blobs[digest.FromBytes(blob)] = blob
+	}
+	dgst := digest.FromBytes(content)
+	repo := r.repo(name, true)
+	r.nextID++
+	repo.manifests[dgst] = &fakeManifest{mediaType: mediaType, content: content, digest: dgst, id: r.nextID, pushTime: time.Now()}
+	repo.tags[tag] = dgst
+}
+
+func (r *fakeRegistry) lookupManifest(name, ref string) *fakeManifest {
+	repo := r.repo(name, false)
+	if repo == nil {
+		return nil
+	}
+	if dgst, err := digest.Parse(ref); err == nil {
+		return repo.manifests[dgst]
+	}
+	dgst, ok := repo.tags[ref]
+	if !ok {
+		return nil
+	}
+	return repo.manifests[dgst]
+}
+
+// serveHarbor 模拟 /api/v2.0/projects/{project}/repositories[/{repo}[/artifacts[/{reference}[/tags]]]]
+func (r *fakeRegistry) serveHarbor(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v2.0/projects/"), "/")
+	if len(parts) < 2 || parts[1] != "repositories" {
+		writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+	project := parts[0]
+	switch {
+	case len(parts) == 2 && req.Method == http.MethodGet:
+		filter := strings.TrimPrefix(req.URL.Query().Get("q"), "name=~")
+		var repositories []Repository
+		for name, repo := range r.repos {
+			if strings.HasPrefix(name, project+"/") && strings.Contains(name, filter) {
+				repositories = append(repositories, Repository{Name: name, ArtifactCount: len(repo.manifests)})
+			}
+		}
+		sort.Slice(repositories, func(i, j int) bool { return repositories[i].Name < repositories[j].Name })
+		writeJSON(w, http.StatusOK, repositories)
+	case len(parts) == 3 && req.Method == http.MethodDelete:
+		name := project + "/" + parts[2]
+		if r.repo(name, false) == nil {
+			writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "repository "+name+" not found")
+			return
+		}
+		delete(r.repos, name)
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 4 && parts[3] == "artifacts" && req.Method == http.MethodGet:
+		repo := r.repo(project+"/"+parts[2], false)
+		if repo == nil {
+			writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "repository not found")
+			return
+		}
+		tags := map[digest.Digest][]Tag{}
+		for name, dgst := range repo.tags {
+			tags[dgst] = append(tags[dgst], Tag{Name: name})
+		}
+		query := req.URL.Query()
+		manifests := make([]*fakeManifest, 0, len(repo.manifests))
+		for _, m := range repo.manifests {
+			if matchArtifactQuery(query.Get("q"), m, tags[m.digest]) {
+				manifests = append(manifests, m)
+			}
+		}
+		// 与 Harbor 一致，默认按推送顺序倒序
+		sort.Slice(manifests, func(i, j int) bool { return manifests[i].id > manifests[j].id })
+		switch query.Get("sort") {
+		case "push_time":
+			sort.SliceStable(manifests, func(i, j int) bool { return manifests[i].pushTime.Before(manifests[j].pushTime) })
+		case "-push_time":
+			sort.SliceStable(manifests, func(i, j int) bool { return manifests[i].pushTime.After(manifests[j].pushTime) })
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(manifests)))
+		pageSize, _ := strconv.Atoi(query.Get("page_size"))
+		page, _ := strconv.Atoi(query.Get("page"))
+		if pageSize > 0 && page > 0 {
+			start := min((page-1)*pageSize, len(manifests))
+			if start+pageSize < len(manifests) && !r.omitLinks {
+				query.Set("page", strconv.Itoa(page+1))
+				w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, req.URL.Path, query.Encode()))
+			}
+			manifests = manifests[start:min(start+pageSize, len(manifests))]
+		}
+		artifacts := make([]Artifact, 0, len(manifests))
+		for _, m := range manifests {
+			sort.Slice(tags[m.digest], func(i, j int) bool { return tags[m.digest][i].Name < tags[m.digest][j].Name })
+			artifacts = append(artifacts, Artifact{
+				Digest:            m.digest.String(),
+				ID:                m.id,
+				ManifestMediaType: m.mediaType,
+				MediaType:         m.mediaType,
+				PushTime:          m.pushTime.UTC().Format(time.RFC3339),
+				Size:              len(m.content),
+				Tags:              tags[m.digest],
+			})
+		}
+		writeJSON(w, http.StatusOK, artifacts)
+	case len(parts) >= 5 && parts[3] == "artifacts" && req.Method == http.MethodGet:
+		m := r.lookupManifest(project+"/"+parts[2], parts[4])
+		if m == nil {
+			writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "artifact not found")
+			return
+		}
+		var tags []Tag
+		for name, dgst := range r.repo(project+"/"+parts[2], false).tags {
+			if dgst == m.digest {
+				tags = append(tags, Tag{Name: name, ArtifactID: m.id})
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+		if len(parts) == 6 && parts[5] == "tags" {
+			writeJSON(w, http.StatusOK, tags)
+			return
+		}
+		writeJSON(w, http.StatusOK, Artifact{
+			Digest:            m.digest.String(),
+			ID:                m.id,
+			ManifestMediaType: m.mediaType,
+			MediaType:         m.mediaType,
+			PushTime:          m.pushTime.UTC().Format(time.RFC3339),
+			Size:              len(m.content),
+			Tags:              tags,
+			Labels:            []Label{{ID: 1, Name: "golden", Scope: "g"}},
+		})
+	default:
+		writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+	}
+}
+
+type fakeProject struct {
+	id           int
+	metadata     map[string]string
+	storageLimit int64
+}
+
+// serveProjects 模拟 /api/v2.0/projects[/{project}[/summary]] 与 /api/v2.0/quotas[/{id}]
+func (r *fakeRegistry) serveProjects(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.projects == nil {
+		r.projects = map[string]*fakeProject{}
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v2.0/"), "/")
+	if parts[0] == "projects" && len(parts) > 1 && req.Header.Get("X-Is-Resource-Name") != "true" {
+		writeRegistryError(w, http.StatusBadRequest, "BAD_REQUEST", "project is referenced by name without X-Is-Resource-Name")
+		return
+	}
+	var body struct {
+		ProjectName  string            `json:"project_name"`
+		Metadata     map[string]string `json:"metadata"`
+		StorageLimit *int64            `json:"storage_limit"`
+		Hard         map[string]int64  `json:"hard"`
+	}
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+			return
+		}
+	}
+	var project *fakeProject
+	if len(parts) > 1 {
+		if parts[0] == "projects" {
+			project = r.projects[parts[1]]
+		} else {
+			for _, p := range r.projects {
+				if strconv.Itoa(p.id) == parts[1] {
+					project = p
+				}
+			}
+		}
+		if project == nil {
+			writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", parts[0]+" "+parts[1]+" not found")
+			return
+		}
+	}
+	switch {
+	case parts[0] == "projects" && len(parts) == 1 && req.Method == http.MethodPost:
+		if r.projects[body.ProjectName] != nil {
+			writeRegistryError(w, http.StatusConflict, "CONFLICT", "project "+body.ProjectName+" already exists")
+			return
+		}
+		r.nextID++
+		project = &fakeProject{id: r.nextID, metadata: map[string]string{"public": "false"}, storageLimit: -1}
+		for key, value := range body.Metadata {
+			project.metadata[key] = value
+		}
+		if body.StorageLimit != nil {
+			project.storageLimit = *body.StorageLimit
+		}
+		r.projects[body.ProjectName] = project
+		w.WriteHeader(http.StatusCreated)
+	case parts[0] == "projects" && len(parts) == 2 && req.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"project_id": project.id,
+			"name":       parts[1],
+			"owner_name": r.username,
+			"repo_count": len(r.projectRepos(parts[1])),
+			"metadata":   project.metadata,
+		})
+	case parts[0] == "projects" && len(parts) == 2 && req.Method == http.MethodPut:
+		for key, value := range body.Metadata {
+			project.metadata[key] = value
+		}
+		w.WriteHeader(http.StatusOK)
+	case parts[0] == "projects" && len(parts) == 2 && req.Method == http.MethodDelete:
+		if len(r.projectRepos(parts[1])) > 0 {
+			writeRegistryError(w, http.StatusPreconditionFailed, "PRECONDITION", "the project contains repositories, can not be deleted")
+			return
+		}
+		delete(r.projects, parts[1])
+		w.WriteHeader(http.StatusOK)
+	case parts[0] == "projects" && len(parts) == 3 && parts[2] == "summary" && req.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"repo_count": len(r.projectRepos(parts[1])),
+			"quota":      r.projectQuota(parts[1], project),
+		})
+	case parts[0] == "quotas" && len(parts) == 1 && req.Method == http.MethodGet:
+		quotas := []projectQuota{}
+		for name, p := range r.projects {
+			if strconv.Itoa(p.id) == req.URL.Query().Get("reference_id") {
+				quotas = append(quotas, r.projectQuota(name, p))
+			}
+		}
+		writeJSON(w, http.StatusOK, quotas)
+	case parts[0] == "quotas" && len(parts) == 2 && req.Method == http.MethodPut:
+		project.storageLimit = body.Hard["storage"]
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+	}
+}
+
+// projectRepos 返回项目中的仓库
+func (r *fakeRegistry) projectRepos(projectName string) []*fakeRepository {
+	var repos []*fakeRepository
+	for name, repo := range r.repos {
+		if strings.HasPrefix(name, projectName+"/") {
+			repos = append(repos, repo)
+		}
+	}
+	return repos
+}
+
+// projectQuota 以项目中全部 manifest 的大小之和作为已用存储
+func (r *fakeRegistry) projectQuota(projectName string, project *fakeProject) projectQuota {
+	var used int64
+	for _, repo := range r.projectRepos(projectName) {
+		for _, m := range repo.manifests {
+			used += int64(len(m.content))
+		}
+	}
+	return projectQuota{ID: project.id, Hard: map[string]int64{"storage": project.storageLimit}, Used: map[string]int64{"storage": used}}
+}
+
+// matchArtifactQuery 支持 Harbor q= 语法中的 tags、media_type 与 push_time 范围
+func matchArtifactQuery(q string, m *fakeManifest, tags []Tag) bool {
+	if q == "" {
+		return true
+	}
+	for _, term := range strings.Split(q, ",") {
+		key, value, _ := strings.Cut(term, "=")
+		switch key {
+		case "tags":
+			fuzzy := strings.HasPrefix(value, "~")
+			matched := false
+			for _, tag := range tags {
+				if tag.Name == value || fuzzy && strings.Contains(tag.Name, value[1:]) {
+					matched = true
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "media_type":
+			if m.mediaType != value {
+				return false
+			}
+		case "push_time":
+			after, before, _ := strings.Cut(strings.Trim(value, "[]"), "~")
+			pushTime := m.pushTime.UTC().Format(harborTimeLayout)
+			if after != "" && pushTime < after || before != "" && pushTime > before {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -1,88 +1,14 @@
 package manager
 
 import (
-	"context"
-	"crypto/sha256"
-	"encoding/hex"
-	"fmt"
+	"errors"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
-
-	"github.com/containers/image/v5/copy"
-	"github.com/containers/image/v5/directory"
-	"github.com/containers/image/v5/signature"
-	"github.com/containers/image/v5/transports/alltransports"
-	"github.com/containers/image/v5/types"
 )
 
 const defaultRootHarborCacheDir = "/var/lib/harbor-file-cache/"
 
-func createOCIImageLayout(ociImageDir string) error {
-	err := createDirectorIfNotExist(ociImageDir)
-	if err != nil {
-		return err
-	}
-	// 创建OCI镜像目录结构
-	blobsDir := filepath.Join(ociImageDir, "blobs")
-	if err = os.MkdirAll(blobsDir, os.ModePerm); err != nil {
-		return err
-	}
-
-	blobsShaDir := filepath.Join(blobsDir, "sha256")
-	if err = os.MkdirAll(blobsShaDir, os.ModePerm); err != nil {
-		return err
-	}
-	// 创建空的 config 文件
-	configContent := []byte(`{
-		"user": "1000:1000",
-		"Cmd": ["echo", "Hello, OCI Image!"]
-	}`)
-	configDigest, err := createDigestFile(blobsShaDir, configContent)
-	if err != nil {
-		return err
-	}
-
-	if err = createFile(filepath.Join(ociImageDir, configDigest), configContent); err != nil {
-		return err
-	}
-
-	// 生成 manifest 文件
-	manifestJSON := []byte(fmt.Sprintf(`{
-        "schemaVersion": 2,
-		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-        "config": {
-            "mediaType": "application/vnd.oci.image.config.v1+json",
-            "digest": "sha256:%s",
-            "size": %d
-        },
-        "layers": [
-        ]
-    }`, configDigest, len(configContent)))
-
-	if err = createFile(filepath.Join(ociImageDir, "manifest.json"), manifestJSON); err != nil {
-		return err
-	}
-
-	// 创建config.json示例
-	configJSON := []byte(fmt.Sprintf(`{
-		"mediaType": "application/vnd.oci.image.config.v1+json",
-		"digest": "%s",
-		"size": %d,
-		"config": {
-			"user": "1000:1000",
-			"Cmd": ["echo", "Hello, OCI Image!"]
-		}
-	}`, configDigest, len(string(configContent))))
-
-	if err = createFile(filepath.Join(blobsDir, "sha256", configDigest), configJSON); err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func createFile(filePath string, content []byte) error {
 	file, err := os.Create(filePath)
 	if err != nil {
@@ -98,109 +24,10 @@ func createFile(filePath string, content []byte) error {
 	return nil
 }
 
-func createDigestFile(directory string, content []byte) (string, error) {
-	digest := sha256.Sum256(content)
-	digestStr := hex.EncodeToString(digest[:])
-	filePath := directory + "/" + digestStr
-
-	file, err := os.Create(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	_, err = file.Write(content)
-	if err != nil {
-		return "", err
-	}
-
-	return digestStr, nil
-}
-
-// 检查远程 Harbor 仓库是否已存在
-func checkRemoteRepoExists(ctx context.Context, harborUsername, harborPassword, harborRepo string) (bool, error) {
-	harborImage := fmt.Sprintf("docker://%s", harborRepo)
-
-	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: harborUsername,
-			Password: harborPassword,
-		},
-	}
-
-	// 解析仓库地址
-	refCtx, err := alltransports.ParseImageName(harborImage)
-	if err != nil {
-		return false, fmt.Errorf("error checkRemoteRepoExists call alltransports.ParseImageName: %s", err.Error())
-	}
-
-	// 获取远程镜像
-	_, err = refCtx.NewImageSource(ctx, sys)
-	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			return false, nil
-		}
-		return false, fmt.Errorf("error checkRemoteRepoExists call checkRemoteRepoExists NewImageSource: %s", err.Error())
-	}
-
-	// 图像存在于本地
-	return true, nil
-}
-
-// 上传 OCI 镜像目录到远程仓库
-func uploadLocalImageToHarbor(ctx context.Context, imageDirectory, harborUsername, harborPassword, harborRepo, harborTag string) error {
-	// 使用github.com/containers/image库上传镜像到Harbor
-	harborImage := fmt.Sprintf("docker://%s:%s", harborRepo, harborTag)
-
-	// 创建一个简单的默认策略
-	defaultPolicy := `{
-		"default": [
-			{
-				"type": "insecureAcceptAnything"
-			}
-		]
-	}`
-
-	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: harborUsername,
-			Password: harborPassword,
-		},
-	}
-
-	// 创建一个签名策略
-	policy, err := signature.NewPolicyFromBytes([]byte(defaultPolicy))
-	if err != nil {
-		return fmt.Errorf("error uploadLocalImageToHarbor call signature.NewPolicyFromBytes, can not create signature policy: %s", err.Error())
-	}
-
-	policyContext, err := signature.NewPolicyContext(policy)
-	if err != nil {
-		return fmt.Errorf("error uploadLocalImageToHarbor call signature.NewPolicyContext: %s", err.Error())
-	}
-
-	destCtx, err := alltransports.ParseImageName(harborImage)
-	if err != nil {
-		return fmt.Errorf("error uploadLocalImageToHarbor call alltransports.ParseImageName: %s", err.Error())
-	}
-
-	srcCtx, err := directory.NewReference(imageDirectory)
-	if err != nil {
-		return fmt.Errorf("error uploadLocalImageToHarbor call directory.NewReference: %s", err.Error())
-	}
-
-	_, err = copy.Image(ctx, policyContext, destCtx, srcCtx, &copy.Options{
-		ReportWriter:   nil, // 如果需要的话，可以提供一个报告写入器
-		DestinationCtx: sys,
-		SourceCtx:      sys,
-	})
-	if err != nil {
-		return fmt.Errorf("error uploadLocalImageToHarbor copy.Image: %s", err.Error())
-	}
-
-	return nil
+// isImageNotFound 判断 NewImageSource、GetManifest 的错误是否表示镜像不存在，
+// docker 传输与 oci layout 的错误都按 wrapImageError 分类
+func isImageNotFound(err error) bool {
+	return errors.Is(wrapImageError(err, "", "", ""), ErrNotFound)
 }
 
 func initRootCacheDir(cacheDir string) error {
@@ -260,7 +87,8 @@ func extractHostnameAndPathFromURL(inputURL string) (string, string, error) {
 	if err != nil {
 		return "", "", err
 	}
-	hostname := parsedURL.Hostname()
+	// 保留端口，Harbor 可能部署在非标准端口上
+	hostname := parsedURL.Host
 	path := parsedURL.Path
 	return hostname, path, nil
 }
@@ -1,12 +1,17 @@
 package manager
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Artifact struct {
@@ -29,119 +34,548 @@ type Artifact struct {
 		Created      string   `json:"created"`
 		Os           string   `json:"os"`
 	} `json:"extra_attrs"`
-	Icon              string      `json:"icon"`
-	ID                int         `json:"id"`
-	Labels            interface{} `json:"labels"`
-	ManifestMediaType string      `json:"manifest_media_type"`
-	MediaType         string      `json:"media_type"`
-	ProjectID         int         `json:"project_id"`
-	PullTime          string      `json:"pull_time"`
-	PushTime          string      `json:"push_time"`
-	References        interface{} `json:"references"`
-	RepositoryID      int         `json:"repository_id"`
-	Size              int         `json:"size"`
-	Tags              interface{} `json:"tags"`
-	Type              string      `json:"type"`
-}
-
-func GetArtifactsByPage(_ context.Context, baseHarborUrl, projectName, repoName, harborUserName, harborUserPassword string, pageSize, page int) ([]Artifact, error) {
-	harborReqURL := fmt.Sprintf(
-		"%s/api/v2.0/projects/%s/repositories/%s/artifacts?with_tag=false&with_scan_overview=true&with_label=true&with_accessory=false&page_size=%d&page=%d",
-		strings.TrimRight(baseHarborUrl, "/"), projectName, repoName, pageSize, page)
-
-	fmt.Println(harborReqURL)
-
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", harborReqURL, nil)
+	Icon              string                  `json:"icon"`
+	ID                int                     `json:"id"`
+	Labels            []Label                 `json:"labels"`
+	ManifestMediaType string                  `json:"manifest_media_type"`
+	MediaType         string                  `json:"media_type"`
+	ProjectID         int                     `json:"project_id"`
+	PullTime          string                  `json:"pull_time"`
+	PushTime          string                  `json:"push_time"`
+	References        interface{}             `json:"references"`
+	RepositoryID      int                     `json:"repository_id"`
+	ScanOverview      map[string]ScanOverview `json:"scan_overview,omitempty"`
+	Size              int                     `json:"size"`
+	Tags              []Tag                   `json:"tags"`
+	Type              string                  `json:"type"`
+}
+
+// Tag 是制品上的一个 tag
+type Tag struct {
+	ArtifactID   int    `json:"artifact_id"`
+	ID           int    `json:"id"`
+	Immutable    bool   `json:"immutable"`
+	Name         string `json:"name"`
+	PullTime     string `json:"pull_time"`
+	PushTime     string `json:"push_time"`
+	RepositoryID int    `json:"repository_id"`
+}
+
+// Label 是 Harbor 中全局或项目级的标签
+type Label struct {
+	Color        string `json:"color"`
+	CreationTime string `json:"creation_time"`
+	Description  string `json:"description"`
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	ProjectID    int    `json:"project_id"`
+	Scope        string `json:"scope"`
+	UpdateTime   string `json:"update_time"`
+}
+
+// ScanOverview 是制品漏洞扫描结果的概要，Artifact.ScanOverview 以报告的媒体类型为键
+type ScanOverview struct {
+	CompletePercent int    `json:"complete_percent"`
+	Duration        int64  `json:"duration"`
+	EndTime         string `json:"end_time"`
+	ReportID        string `json:"report_id"`
+	ScanStatus      string `json:"scan_status"`
+	Scanner         struct {
+		Name    string `json:"name"`
+		Vendor  string `json:"vendor"`
+		Version string `json:"version"`
+	} `json:"scanner"`
+	// Severity 是发现的最高漏洞等级，例如 Critical、High、None
+	Severity  string `json:"severity"`
+	StartTime string `json:"start_time"`
+	Summary   struct {
+		Fixable int `json:"fixable"`
+		// Summary 是各漏洞等级的数量
+		Summary map[string]int `json:"summary"`
+		Total   int            `json:"total"`
+	} `json:"summary"`
+}
+
+// HarborClient 访问 Harbor v2.0 REST API
+type HarborClient struct {
+	// BaseURL 例如 https://hub.xxxx.com
+	BaseURL  string
+	UserName string
+	Password string
+	// Credentials 设置后每次请求前从中获取凭据，忽略 UserName/Password
+	Credentials CredentialProvider
+	// HTTPClient 为 nil 时使用 http.DefaultClient
+	HTTPClient *http.Client
+	// Retry GET 请求遇到 5xx、429 或连接错误时的重试策略，零值使用默认值
+	Retry RetryPolicy
+}
+
+func NewHarborClient(baseHarborUrl, harborUserName, harborUserPassword string, httpClient *http.Client) *HarborClient {
+	return &HarborClient{
+		BaseURL:    strings.TrimRight(baseHarborUrl, "/"),
+		UserName:   harborUserName,
+		Password:   harborUserPassword,
+		HTTPClient: httpClient,
+	}
+}
+
+// NewHarborClientWithConfig 创建访问 harborHostname 的 REST 客户端，使用 config 中的凭据和 Transport
+func NewHarborClientWithConfig(config *FmConfig, harborHostname string) (*HarborClient, error) {
+	httpClient, err := config.Transport.httpClient(harborHostname)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(harborUserName, harborUserPassword)
+	client := NewHarborClient(config.Transport.scheme(harborHostname)+"://"+harborHostname, "", "", httpClient)
+	client.Credentials = credentialProvider(config)
+	client.Retry = config.Retry
+	return client, nil
+}
 
-	resp, err := client.Do(req)
+// ParseHarborRepo 把 hub.xxxx.com/vmimages/ubuntu 拆分为 Harbor 主机名、项目名和仓库名
+func ParseHarborRepo(harborRepo string) (string, string, string, error) {
+	return parseHarborURL(harborRepo)
+}
+
+// do 发送请求，header 中的字段追加到请求头。GET 请求遇到 5xx、429 或连接错误时按 Retry 重试，删除等其它请求只发送一次
+func (c *HarborClient) do(ctx context.Context, method, apiPath string, header http.Header) (*http.Response, error) {
+	if !idempotentMethod(method) {
+		return c.doOnce(ctx, method, apiPath, nil, header)
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doOnce(ctx, method, apiPath, nil, header)
+		last := attempt >= c.Retry.attempts()
+		if err != nil && (last || !isRetryable(err)) {
+			return nil, err
+		}
+		var wait time.Duration
+		if err == nil {
+			if last || !retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			wait = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		if err = c.Retry.wait(ctx, attempt, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// doJSON 以 JSON 编码 body 作为请求体发送 POST/PUT 请求，只发送一次
+func (c *HarborClient) doJSON(ctx context.Context, method, apiPath string, body interface{}, header http.Header) (*http.Response, error) {
+	content, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
 	}
-	defer func(Body io.ReadCloser) {
-		err = Body.Close()
-		if err != nil {
+	return c.doOnce(ctx, method, apiPath, content, header)
+}
 
+func (c *HarborClient) doOnce(ctx context.Context, method, apiPath string, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.BaseURL, "/")+apiPath, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	userName, password := c.UserName, c.Password
+	if c.Credentials != nil {
+		creds, err := c.Credentials.Credentials(ctx, req.URL.Host)
+		if err != nil {
+			return nil, err
 		}
-	}(resp.Body)
+		userName, password = creds.UserName, creds.Password
+	}
+	req.SetBasicAuth(userName, password)
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && c.Credentials != nil {
+		invalidateCredentials(c.Credentials, req.URL.Host)
+	}
+	return resp, err
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to delete repo. Status code: %d, project name: %s, repo name: %s", resp.StatusCode, projectName, repoName)
+func (c *HarborClient) GetArtifactsByPage(ctx context.Context, projectName, repoName string, pageSize, page int) ([]Artifact, error) {
+	artifacts, _, _, err := c.getArtifacts(ctx, artifactsPath(projectName, repoName, &ListArtifactsOptions{PageSize: pageSize, Page: page}), projectName+"/"+repoName)
+	return artifacts, err
+}
+
+// GetLatestArtifactDigest 返回仓库中最后推送的制品的 digest，仓库为空时返回空字符串
+func (c *HarborClient) GetLatestArtifactDigest(ctx context.Context, projectName, repoName string) (string, error) {
+	artifacts := c.ListArtifacts(ctx, projectName, repoName, &ListArtifactsOptions{Sort: "-push_time", PageSize: 1})
+	if !artifacts.Next() {
+		return "", artifacts.Err()
 	}
+	return artifacts.Artifact().Digest, nil
+}
 
-	defer func(Body io.ReadCloser) {
-		err = Body.Close()
-		if err != nil {
+// ArtifactFilter 描述 Harbor 的 q= 查询条件，零值字段不参与过滤
+type ArtifactFilter struct {
+	// Tag 精确匹配的 tag，以 ~ 开头时为模糊匹配，例如 ~22.04
+	Tag string
+	// LabelIDs 制品必须同时带有的标签 ID
+	LabelIDs []int
+	// MediaType 精确匹配的 manifest 媒体类型
+	MediaType string
+	// PushedAfter、PushedBefore 推送时间的范围，只设置一端时另一端不限
+	PushedAfter  time.Time
+	PushedBefore time.Time
+}
+
+// harborTimeLayout 是 q= 查询中时间值的格式
+const harborTimeLayout = "2006-01-02 15:04:05"
+
+// Query 返回 Harbor q= 查询语法的条件，例如 tags=~22.04,push_time=[2024-01-01 00:00:00~]
+func (f ArtifactFilter) Query() string {
+	var terms []string
+	if f.Tag != "" {
+		terms = append(terms, "tags="+f.Tag)
+	}
+	if len(f.LabelIDs) > 0 {
+		ids := make([]string, 0, len(f.LabelIDs))
+		for _, id := range f.LabelIDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		terms = append(terms, "labels=("+strings.Join(ids, " ")+")")
+	}
+	if f.MediaType != "" {
+		terms = append(terms, "media_type="+f.MediaType)
+	}
+	if !f.PushedAfter.IsZero() || !f.PushedBefore.IsZero() {
+		var after, before string
+		if !f.PushedAfter.IsZero() {
+			after = f.PushedAfter.UTC().Format(harborTimeLayout)
+		}
+		if !f.PushedBefore.IsZero() {
+			before = f.PushedBefore.UTC().Format(harborTimeLayout)
+		}
+		terms = append(terms, "push_time=["+after+"~"+before+"]")
+	}
+	return strings.Join(terms, ",")
+}
+
+// ListArtifactsOptions 是 ListArtifacts 的参数
+type ListArtifactsOptions struct {
+	Filter ArtifactFilter
+	// Query 直接使用的 q= 条件，与 Filter 生成的条件合并
+	Query string
+	// Sort 排序字段，多个字段用逗号分隔，- 前缀表示倒序，例如 -push_time
+	Sort string
+	// PageSize 每次请求的数量，默认 100
+	PageSize int
+	// Page 从第几页开始，默认 1
+	Page int
+}
 
+const defaultArtifactPageSize = 100
+
+// artifactsPath 返回列出制品的第一页请求路径，总是带上 tag、标签和扫描概要
+func artifactsPath(projectName, repoName string, opts *ListArtifactsOptions) string {
+	query := url.Values{}
+	query.Set("with_tag", "true")
+	query.Set("with_label", "true")
+	query.Set("with_scan_overview", "true")
+	query.Set("with_accessory", "false")
+	query.Set("page_size", strconv.Itoa(defaultArtifactPageSize))
+	query.Set("page", "1")
+	if opts.PageSize > 0 {
+		query.Set("page_size", strconv.Itoa(opts.PageSize))
+	}
+	if opts.Page > 0 {
+		query.Set("page", strconv.Itoa(opts.Page))
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	var terms []string
+	for _, term := range []string{opts.Filter.Query(), opts.Query} {
+		if term != "" {
+			terms = append(terms, term)
 		}
-	}(resp.Body)
+	}
+	if len(terms) > 0 {
+		query.Set("q", strings.Join(terms, ","))
+	}
+	return fmt.Sprintf("/api/v2.0/projects/%s/repositories/%s/artifacts?%s", projectName, repoName, query.Encode())
+}
+
+// getArtifacts 请求一页制品，返回 Link 头中下一页的路径(没有时为空)以及 X-Total-Count(没有时为 -1)
+func (c *HarborClient) getArtifacts(ctx context.Context, apiPath, repo string) ([]Artifact, string, int, error) {
+	resp, err := c.do(ctx, http.MethodGet, apiPath, nil)
+	if err != nil {
+		return nil, "", -1, err
+	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP request failed with status code: %d", resp.StatusCode)
+		return nil, "", -1, newHTTPError(resp, "list artifacts", repo, "")
 	}
 
 	var artifacts []Artifact
-	err = json.NewDecoder(resp.Body).Decode(&artifacts)
+	if err = json.NewDecoder(resp.Body).Decode(&artifacts); err != nil {
+		return nil, "", -1, err
+	}
+	total, err := strconv.Atoi(resp.Header.Get("X-Total-Count"))
 	if err != nil {
-		fmt.Printf("Error decoding JSON response: %v\n", err)
-		return nil, err
+		total = -1
 	}
-
-	return artifacts, nil
+	return artifacts, nextLink(resp.Header), total, nil
 }
 
-func GetLatestArtifactDigest(ctx context.Context, baseHarborUrl, projectName, repoName, harborUserName, harborUserPassword string) (string, error) {
-	artifacts, err := GetArtifactsByPage(ctx, baseHarborUrl, projectName, repoName, harborUserName, harborUserPassword, 1, 1)
-	if err != nil {
-		return "", err
+// linkPattern 匹配 Link 头中的一项，例如 </api/v2.0/...?page=2>; rel="next"
+var linkPattern = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?([^",;]*)"?`)
+
+// nextLink 返回 Link 头中 rel="next" 的路径和查询参数
+func nextLink(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, match := range linkPattern.FindAllStringSubmatch(value, -1) {
+			if match[2] != "next" {
+				continue
+			}
+			u, err := url.Parse(match[1])
+			if err != nil {
+				return ""
+			}
+			return u.RequestURI()
+		}
 	}
+	return ""
+}
+
+// ArtifactIterator 逐个返回 ListArtifacts 的结果，需要时才请求下一页：
+//
+//	artifacts := client.ListArtifacts(ctx, "vmimages", "ubuntu", &manager.ListArtifactsOptions{Sort: "-push_time"})
+//	for artifacts.Next() {
+//		fmt.Println(artifacts.Artifact().Digest)
+//	}
+//	if err := artifacts.Err(); err != nil {
+//		return err
+//	}
+type ArtifactIterator struct {
+	ctx    context.Context
+	client *HarborClient
+	repo   string
+	// next 是下一页的请求路径，为空表示没有更多页
+	next     string
+	pageSize int
+	page     []Artifact
+	current  Artifact
+	seen     int
+	total    int
+	err      error
+}
 
-	if len(artifacts) == 0 {
-		return "", nil
+// ListArtifacts 列出 projectName/repoName 中的制品，按 Harbor 返回的 Link 头翻页，
+// 没有 Link 头时根据 X-Total-Count 或者不满一页判断是否结束。opts 可以为 nil
+func (c *HarborClient) ListArtifacts(ctx context.Context, projectName, repoName string, opts *ListArtifactsOptions) *ArtifactIterator {
+	if opts == nil {
+		opts = &ListArtifactsOptions{}
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultArtifactPageSize
 	}
+	page := max(opts.Page, 1)
+	return &ArtifactIterator{
+		ctx:      ctx,
+		client:   c,
+		repo:     projectName + "/" + repoName,
+		next:     artifactsPath(projectName, repoName, opts),
+		pageSize: pageSize,
+		seen:     (page - 1) * pageSize,
+		total:    -1,
+	}
+}
 
-	// 找到具有最大 ID 值的 digest
-	maxID := -1
-	maxDigest := ""
-	for _, artifact := range artifacts {
-		if artifact.ID > maxID {
-			maxID = artifact.ID
-			maxDigest = artifact.Digest
+// Next 前进到下一个制品，没有更多制品或者请求失败时返回 false
+func (it *ArtifactIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.next == "" {
+			return false
+		}
+		artifacts, next, total, err := it.client.getArtifacts(it.ctx, it.next, it.repo)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		requested := it.next
+		it.page, it.next = artifacts, next
+		it.seen += len(artifacts)
+		if total >= 0 {
+			it.total = total
+		}
+		// 没有 Link 头的旧版本 Harbor
+		if it.next == "" && len(artifacts) == it.pageSize && (it.total < 0 || it.seen < it.total) {
+			it.next = nextPage(requested)
+		}
+		if len(artifacts) == 0 {
+			it.next = ""
 		}
 	}
-	//maxDigest = strings.TrimPrefix(maxDigest, "sha256:")
-	//fmt.Println(maxDigest)
-	return maxDigest, nil
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
 }
 
-func DeleteHarborRepo(_ context.Context, baseHarborUrl, projectName, repoName, harborUserName, harborUserPassword string) error {
-	repoAPI := strings.TrimRight(baseHarborUrl, "/") + "/api/v2.0/projects/" + projectName + "/repositories/" + repoName
-
-	client := &http.Client{}
-	req, err := http.NewRequest("DELETE", repoAPI, nil)
+// nextPage 把请求路径中的 page 参数加一
+func nextPage(apiPath string) string {
+	u, err := url.Parse(apiPath)
 	if err != nil {
-		return err
+		return ""
 	}
-	req.SetBasicAuth(harborUserName, harborUserPassword)
+	query := u.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	query.Set("page", strconv.Itoa(max(page, 1)+1))
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
 
-	resp, err := client.Do(req)
+// Artifact 返回 Next 前进到的制品
+func (it *ArtifactIterator) Artifact() Artifact {
+	return it.current
+}
+
+// Err 返回翻页过程中遇到的错误
+func (it *ArtifactIterator) Err() error {
+	return it.err
+}
+
+// Total 返回 Harbor 通过 X-Total-Count 报告的制品总数，尚未请求或者服务端没有返回时为 -1
+func (it *ArtifactIterator) Total() int {
+	return it.total
+}
+
+func (c *HarborClient) DeleteRepo(ctx context.Context, projectName, repoName string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/v2.0/projects/"+projectName+"/repositories/"+repoName, nil)
 	if err != nil {
 		return err
 	}
-	defer func(Body io.ReadCloser) {
-		err = Body.Close()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError(resp, "delete repository", projectName+"/"+repoName, "")
+	}
+	return nil
+}
+
+type Repository struct {
+	ArtifactCount int    `json:"artifact_count"`
+	CreationTime  string `json:"creation_time"`
+	Description   string `json:"description"`
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	ProjectID     int    `json:"project_id"`
+	PullCount     int    `json:"pull_count"`
+	UpdateTime    string `json:"update_time"`
+}
+
+func (c *HarborClient) ListRepositories(ctx context.Context, projectName string) ([]Repository, error) {
+	return c.ListRepositoriesByName(ctx, projectName, "")
+}
+
+// ListRepositoriesByName 列出项目中名称包含 filter 的仓库，filter 为空时列出全部仓库
+func (c *HarborClient) ListRepositoriesByName(ctx context.Context, projectName, filter string) ([]Repository, error) {
+	query := url.Values{}
+	query.Set("page_size", "100")
+	if filter != "" {
+		query.Set("q", "name=~"+filter)
+	}
+	var repositories []Repository
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v2.0/projects/%s/repositories?%s", projectName, query.Encode()), nil)
 		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = newHTTPError(resp, "list repositories", projectName, "")
+			_ = resp.Body.Close()
+			return nil, err
+		}
 
+		var pageRepositories []Repository
+		err = json.NewDecoder(resp.Body).Decode(&pageRepositories)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, pageRepositories...)
+		if len(pageRepositories) < 100 {
+			return repositories, nil
 		}
-	}(resp.Body)
+	}
+}
+
+// GetArtifact 返回 reference(tag 或 digest)对应的制品，包含 tag、标签和扫描概要
+func (c *HarborClient) GetArtifact(ctx context.Context, projectName, repoName, reference string) (*Artifact, error) {
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf(
+		"/api/v2.0/projects/%s/repositories/%s/artifacts/%s?with_tag=true&with_label=true&with_scan_overview=true&with_accessory=false",
+		projectName, repoName, url.PathEscape(reference)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to delete repo. Status code: %d, project name: %s, repo name: %s", resp.StatusCode, projectName, repoName)
+		return nil, newHTTPError(resp, "get artifact", projectName+"/"+repoName, reference)
 	}
+	artifact := &Artifact{}
+	if err = json.NewDecoder(resp.Body).Decode(artifact); err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
 
-	return nil
+// ListArtifactTags 列出 reference 对应制品上的全部 tag
+func (c *HarborClient) ListArtifactTags(ctx context.Context, projectName, repoName, reference string) ([]Tag, error) {
+	var tags []Tag
+	for page := 1; ; page++ {
+		resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v2.0/projects/%s/repositories/%s/artifacts/%s/tags?page_size=100&page=%d",
+			projectName, repoName, url.PathEscape(reference), page), nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = newHTTPError(resp, "list tags", projectName+"/"+repoName, reference)
+			_ = resp.Body.Close()
+			return nil, err
+		}
+
+		var pageTags []Tag
+		err = json.NewDecoder(resp.Body).Decode(&pageTags)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, pageTags...)
+		if len(pageTags) < 100 {
+			return tags, nil
+		}
+	}
+}
+
+func GetArtifactsByPage(ctx context.Context, baseHarborUrl, projectName, repoName, harborUserName, harborUserPassword string, pageSize, page int) ([]Artifact, error) {
+	return NewHarborClient(baseHarborUrl, harborUserName, harborUserPassword, nil).GetArtifactsByPage(ctx, projectName, repoName, pageSize, page)
+}
+
+func GetLatestArtifactDigest(ctx context.Context, baseHarborUrl, projectName, repoName, harborUserName, harborUserPassword string) (string, error) {
+	return NewHarborClient(baseHarborUrl, harborUserName, harborUserPassword, nil).GetLatestArtifactDigest(ctx, projectName, repoName)
+}
+
+func DeleteHarborRepo(ctx context.Context, baseHarborUrl, projectName, repoName, harborUserName, harborUserPassword string) error {
+	return NewHarborClient(baseHarborUrl, harborUserName, harborUserPassword, nil).DeleteRepo(ctx, projectName, repoName)
+}
+
+func ListHarborRepositories(ctx context.Context, baseHarborUrl, projectName, harborUserName, harborUserPassword string) ([]Repository, error) {
+	return NewHarborClient(baseHarborUrl, harborUserName, harborUserPassword, nil).ListRepositories(ctx, projectName)
 }
@@ -2,22 +2,34 @@ package manager
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
-	"github.com/containers/image/v5/pkg/blobinfocache"
-	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
 	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type FileManager interface {
 	CreateRepositoryIfNotExist(ctx context.Context, harborRepo string, tag string) error
 	UploadFile(ctx context.Context, localFilePath, harborRepo, tag string) (*types.BlobInfo, error)
+	UploadFileWithOptions(ctx context.Context, localFilePath, harborRepo, tag string, opts *UploadOptions) (*types.BlobInfo, error)
+	UploadReader(ctx context.Context, r io.Reader, size int64, harborRepo, tag string, opts *UploadOptions) (*types.BlobInfo, error)
+	UploadFiles(ctx context.Context, localFilePaths []string, harborRepo, tag string, opts *UploadOptions) ([]types.BlobInfo, error)
+	UploadDirectory(ctx context.Context, localDir, harborRepo, tag string, opts *UploadOptions) ([]types.BlobInfo, error)
+	// DownloadFile、DownloadFileWithInfo 下载 tag 中最新上传的文件(最后一个 layer)。manifest 无法区分 UploadFiles
+	// 上传的一组文件和追加的多个版本，对一组文件只会得到其中最后一个，不会报错；
+	// 按文件名下载或下载全部文件使用 DownloadFileByName、DownloadDirectory
 	DownloadFile(ctx context.Context, harborRepo, tag string, targetFilePath string) error
+	DownloadFileWithInfo(ctx context.Context, harborRepo, tag string, targetFilePath string) (*types.BlobInfo, error)
+	DownloadFileByName(ctx context.Context, harborRepo, tag, name, targetFilePath string) (*types.BlobInfo, error)
+	DownloadDirectory(ctx context.Context, harborRepo, tag, targetDir string) ([]types.BlobInfo, error)
+	PublishContainerDisk(ctx context.Context, localDiskPath, harborRepo, tag string, opts *ContainerDiskOptions) (*types.BlobInfo, error)
+	ImportContainerDisk(ctx context.Context, harborRepo, tag, targetFilePath string, opts *ContainerDiskOptions) (*types.BlobInfo, error)
 	GetDownloadReader(ctx context.Context, harborRepo, tag string) (io.ReadCloser, int64, error)
 	DownloadFileWithBlobDigest(ctx context.Context, harborRepo, tag, digestStr string, targetFilePath string) error
 	GetDownloadReaderWithBlobDigest(ctx context.Context, harborRepo, tag, digestStr string) (io.ReadCloser, int64, error)
@@ -26,28 +38,89 @@ type FileManager interface {
 	DeleteImage(ctx context.Context, harborRepo, tag string) error
 	DeleteRepo(ctx context.Context, harborRepo string) error
 	GetLatestLayerDigest(ctx context.Context, harborRepo, tag string) (string, error)
+	GetLatestLayer(ctx context.Context, harborRepo, tag string) (*types.BlobInfo, error)
+	ListVersions(ctx context.Context, harborRepo, tag string) ([]Version, error)
 	GetLatestArtifactDigest(ctx context.Context, harborRepo string) (string, error)
 	GetBlobDigest(ctx context.Context, harborRepo, tag string) (string, error)
+	ListTags(ctx context.Context, harborRepo string) ([]string, error)
+	ListRepositories(ctx context.Context, project, filter string) ([]string, error)
+	GetArtifact(ctx context.Context, harborRepo, reference string) (*Artifact, error)
+	CacheStats() (CacheStats, error)
+	PinBlob(digestStr string) error
+	UnpinBlob(digestStr string) error
 }
 
 type fileManager struct {
 	hifConf *FmConfig
+
+	mu      sync.Mutex
+	backend Backend
+	cache   *blobCache
+	// minParallelSize 并行下载的最小 blob 大小，默认 defaultMinParallelDownloadSize，测试中调小以覆盖并行下载
+	minParallelSize int64
 }
 
 type FmConfig struct {
 	HarborUserName     string
 	HarborUserPassword string
 	RootCacheDir       string
+	// Credentials 凭据来源，设置后忽略 HarborUserName/HarborUserPassword，
+	// 例如 DockerConfigCredentials()、FileCredentials(path)
+	Credentials CredentialProvider
+	// UploadChunkSize 分片上传时每个 PATCH 请求的大小，默认 32MiB
+	UploadChunkSize int64
+	// CacheMaxSize 本地内容缓存(RootCacheDir/blobs)的最大字节数，<=0 时不缓存文件内容
+	CacheMaxSize int64
+	// DownloadConcurrency 大于 1 时 DownloadFile* 按 Range 并发下载大文件
+	DownloadConcurrency int
+	// BackendType 存储后端类型：harbor(默认)、registry、oci-layout
+	BackendType string
+	// OCILayoutDir BackendType 为 oci-layout 时保存仓库的本地目录
+	OCILayoutDir string
+	// Backend 自定义存储后端，设置后忽略 BackendType
+	Backend Backend
+	// Versioning 同一个 tag 多次上传时的处理方式，默认 VersioningAppend，可被 UploadOptions 覆盖
+	Versioning VersioningPolicy
+	// ManifestRetries 并发更新同一个 tag 发生冲突时的最大重试次数，默认 5
+	ManifestRetries int
+	// ManifestSettleDelay 写入 manifest 后再次检查 tag 是否被并发写入覆盖前的等待时间，默认 100ms，
+	// 应覆盖其它写入方从读取 manifest 到写入完成的耗时，参见 ManifestConflictError。oci-layout 后端使用条件写入，不需要等待
+	ManifestSettleDelay time.Duration
+	// Progress 接收上传、下载的进度，可被 WithProgress 设置的 context 覆盖
+	Progress ProgressSink
+	// Retry 遇到 5xx、429 或连接错误时的重试策略，零值使用默认值
+	Retry RetryPolicy
+	// Transport 证书、代理、超时以及 http/insecure registry 列表
+	Transport TransportConfig
+	// Registries 按 registry 主机名(例如 hub.xxxx.com、127.0.0.1:5000)覆盖以上配置，
+	// 值中为零值的字段沿用外层配置，Transport、Retry 按字段合并；账号密码、客户端证书与私钥作为整体覆盖。仅对 New 生效
+	Registries map[string]*FmConfig
+}
+
+// UploadOptions 是 UploadFileWithOptions、UploadReader、UploadFiles、UploadDirectory 的可选参数
+type UploadOptions struct {
+	// MediaType 文件 layer 的媒体类型，为空时根据文件头自动识别，参见 DetectMediaType。
+	// 对 UploadFiles、UploadDirectory 上传的所有文件生效
+	MediaType string
+	// Versioning 覆盖 FmConfig.Versioning，UploadFiles、UploadDirectory 总是替换 tag 中的全部文件，不受影响
+	Versioning VersioningPolicy
+	// Title 文件名，记录在 layer 的 org.opencontainers.image.title 中。UploadFileWithOptions 默认使用本地文件名；
+	// UploadReader 没有设置时 layer 没有文件名，oras pull、DownloadFileByName 无法获取该文件。
+	// UploadFiles、UploadDirectory 总是使用各自的文件名
+	Title string
 }
 
 var fmanager *fileManager
 
 var fmOnce sync.Once
 
+// SimpleNewOnce 返回进程内共享的 FileManager，只有第一次调用的参数生效。
+//
+// Deprecated: 使用 New 创建相互独立的客户端
 func SimpleNewOnce(harborUserName, harborUserPassword, rootCacheDir string) FileManager {
 	fmOnce.Do(func() {
 		fmanager = &fileManager{
-			&FmConfig{
+			hifConf: &FmConfig{
 				HarborUserName:     harborUserName,
 				HarborUserPassword: harborUserPassword,
 				RootCacheDir:       rootCacheDir,
@@ -57,238 +130,309 @@ func SimpleNewOnce(harborUserName, harborUserPassword, rootCacheDir string) File
 	return fmanager
 }
 
+// NewOnce 返回进程内共享的 FileManager，只有第一次调用的配置生效。
+//
+// Deprecated: 使用 New 创建相互独立的客户端
 func NewOnce(config *FmConfig) FileManager {
 	fmOnce.Do(func() {
 		fmanager = &fileManager{
-			config,
+			hifConf: config,
 		}
 	})
 	return fmanager
 }
 
-func (fm *fileManager) CreateRepositoryIfNotExist(ctx context.Context, harborRepo, tag string) error {
-	// 检查远程仓库是否已存在
-	exists, err := checkRemoteRepoExists(ctx, fm.hifConf.HarborUserName, fm.hifConf.HarborUserPassword, harborRepo)
-	if err != nil {
-		return err
+// New 根据 config 创建一个独立的 FileManager，多次调用互不影响。
+// config.Registries 不为空时返回按 registry 主机名路由的 FileManager
+func New(config *FmConfig) (FileManager, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config is nil")
 	}
-
-	if !exists {
-		_, ociImageName := extractProjectNameAndRepoName(harborRepo)
-		ociImageDir := "/tmp/" + ociImageName
-		err = createOCIImageLayout(ociImageDir)
-		if err != nil {
-			return err
-		}
-		// 上传第一个image，必要操作
-		err = uploadLocalImageToHarbor(ctx, ociImageDir, fm.hifConf.HarborUserName, fm.hifConf.HarborUserPassword, harborRepo, tag)
-		if err != nil {
-			return err
-		}
+	if len(config.Registries) > 0 {
+		return newRegistryRouter(config)
 	}
-
-	return nil
+	return newFileManager(config)
 }
 
-func (fm *fileManager) UploadFile(ctx context.Context, localFilePath, harborRepo, tag string) (*types.BlobInfo, error) {
-	// 打开本地文件
-	localFile, err := os.Open(localFilePath)
-	if err != nil {
+func newFileManager(config *FmConfig) (*fileManager, error) {
+	if _, err := config.Versioning.keep(); err != nil {
 		return nil, err
 	}
-	defer localFile.Close()
-
-	// 准备上传的目标路径
-	destRef := fmt.Sprintf("%s:%s", harborRepo, tag)
-
-	// 使用 containers/image 库上传文件到Harbor
-	imageRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", destRef))
-	if err != nil {
+	conf := *config
+	fm := &fileManager{hifConf: &conf}
+	// 提前创建存储后端，配置错误在构造时返回
+	if _, err := fm.getBackend(); err != nil {
 		return nil, err
 	}
+	return fm, nil
+}
 
-	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: fm.hifConf.HarborUserName,
-			Password: fm.hifConf.HarborUserPassword,
-		},
-		BlobInfoCacheDir:                    fm.hifConf.RootCacheDir,
-		DockerRegistryPushPrecomputeDigests: true,
+func (fm *fileManager) getBackend() (Backend, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.backend == nil {
+		backend, err := NewBackend(fm.hifConf)
+		if err != nil {
+			return nil, err
+		}
+		fm.backend = backend
 	}
+	return fm.backend, nil
+}
 
-	destImg, err := imageRef.NewImageDestination(ctx, sys)
+// systemContext 创建访问 harborRepo 时 containers/image 使用的 SystemContext，
+// 设置凭据以及 Transport 中的证书和 insecure 配置
+func (fm *fileManager) systemContext(ctx context.Context, harborRepo string) (*types.SystemContext, error) {
+	sys := &types.SystemContext{
+		BlobInfoCacheDir: fm.hifConf.RootCacheDir,
+	}
+	host := registryHost(harborRepo)
+	creds, err := credentialProvider(fm.hifConf).Credentials(ctx, host)
 	if err != nil {
 		return nil, err
 	}
-
-	// 获取文件信息
-	fileInfo, err := localFile.Stat()
+	// 没有凭据时交给 containers/image 自己查找 auth.json
+	if !creds.empty() {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username:      creds.UserName,
+			Password:      creds.Password,
+			IdentityToken: creds.IdentityToken,
+		}
+	}
+	transport := &fm.hifConf.Transport
+	// containers/image 在跳过证书校验时才会退回到 http，plain http 的 registry 只能同时跳过证书校验
+	if transport.isInsecure(host) || transport.isPlainHTTP(host) {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	certPath, err := transport.dockerCertPath(fm.rootCacheDir())
 	if err != nil {
 		return nil, err
 	}
-	// 获取文件大小
-	fileSize := fileInfo.Size()
+	sys.DockerCertPath = certPath
+	// containers/image 不支持单独设置代理，这里只校验配置，与 REST 请求报告相同的错误
+	if _, err = transport.proxyURL(); err != nil {
+		return nil, err
+	}
+	return sys, nil
+}
 
-	// 使用 PutBlob 上传文件，并命中本地缓存， none.NoCache
-	blobInfo, err := destImg.PutBlob(ctx, localFile, types.BlobInfo{Size: fileSize}, blobinfocache.DefaultCache(sys), false)
+func (fm *fileManager) imageReference(harborRepo, tag string) (types.ImageReference, error) {
+	backend, err := fm.getBackend()
 	if err != nil {
 		return nil, err
 	}
+	return backend.ImageReference(harborRepo, tag)
+}
 
-	err = updateManifest(ctx, imageRef, sys, &blobInfo, destImg, fileSize)
+// CreateRepositoryIfNotExist 只校验仓库地址。UploadFile 在第一次上传时会直接创建制品 manifest，
+// 不再需要预先推送镜像，保留该方法用于兼容。Harbor 项目需要已经存在，可以先用 HarborClient.EnsureProject 创建
+func (fm *fileManager) CreateRepositoryIfNotExist(ctx context.Context, harborRepo, tag string) error {
+	_, err := fm.imageReference(harborRepo, tag)
+	return err
+}
+
+func (fm *fileManager) UploadFile(ctx context.Context, localFilePath, harborRepo, tag string) (*types.BlobInfo, error) {
+	return fm.UploadFileWithOptions(ctx, localFilePath, harborRepo, tag, nil)
+}
+
+// UploadFileWithOptions 上传本地文件，layer 上记录文件名、权限以及修改时间
+func (fm *fileManager) UploadFileWithOptions(ctx context.Context, localFilePath, harborRepo, tag string, opts *UploadOptions) (*types.BlobInfo, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	title := opts.Title
+	if title == "" {
+		title = filepath.Base(localFilePath)
+	}
+	progress := fm.newProgressTracker(ctx, harborRepo, tag)
+	blobInfo, err := fm.putFile(ctx, localFilePath, title, harborRepo, tag, opts, progress)
 	if err != nil {
 		return nil, err
 	}
-
+	if err = fm.tagLayer(ctx, harborRepo, tag, blobInfo, opts, progress); err != nil {
+		return nil, err
+	}
+	progress.done()
 	return &blobInfo, nil
 }
 
-func updateManifest(ctx context.Context, imageRef types.ImageReference, sys *types.SystemContext, blobInfo *types.BlobInfo, destImg types.ImageDestination, fileSize int64) error {
-	// Create an image source based on the reference
-	imageSource, err := imageRef.NewImageSource(ctx, sys)
+// putFile 上传本地文件的内容，返回带有媒体类型以及文件 annotation 的 BlobInfo，不修改 manifest
+func (fm *fileManager) putFile(ctx context.Context, localFilePath, title, harborRepo, tag string, opts *UploadOptions, progress *progressTracker) (types.BlobInfo, error) {
+	// 打开本地文件
+	localFile, err := os.Open(localFilePath)
 	if err != nil {
-		return err
+		return types.BlobInfo{}, err
 	}
-	defer imageSource.Close()
+	defer localFile.Close()
 
-	// Get the existing manifest
-	originalManifest, _, err := imageSource.GetManifest(ctx, nil)
+	// 获取文件信息
+	fileInfo, err := localFile.Stat()
 	if err != nil {
-		return err
+		return types.BlobInfo{}, err
 	}
 
-	// Unmarshal the original manifest
-	var manifest map[string]interface{}
-	if err = json.Unmarshal([]byte(originalManifest), &manifest); err != nil {
-		return err
+	// 分片上传文件，中断后再次调用会从上次提交的位置继续
+	blobInfo, err := fm.putBlobResumable(ctx, localFile, fileInfo, harborRepo, tag, progress)
+	if err != nil {
+		return types.BlobInfo{}, err
 	}
 
-	// Create a new layer to add
-	newLayer := map[string]interface{}{
-		"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
-		"digest":    blobInfo.Digest,
-		"size":      fileSize,
+	blobInfo.MediaType = opts.MediaType
+	if blobInfo.MediaType == "" {
+		if blobInfo.MediaType, err = DetectMediaType(localFile); err != nil {
+			return types.BlobInfo{}, err
+		}
 	}
+	blobInfo.Annotations = fileAnnotations(title, fileInfo)
+	return blobInfo, nil
+}
 
-	// Append the new layer to the "layers" field in the manifest
-	layers, exists := manifest["layers"].([]interface{})
-	if exists {
-		manifest["layers"] = append(layers, newLayer)
-	} else {
-		manifest["layers"] = []interface{}{newLayer}
+// tagLayer 把已上传的 blob 按 opts 中的版本策略写入 harborRepo:tag
+func (fm *fileManager) tagLayer(ctx context.Context, harborRepo, tag string, blobInfo types.BlobInfo, opts *UploadOptions, progress *progressTracker) error {
+	policy := opts.Versioning
+	if policy == "" {
+		policy = fm.hifConf.Versioning
 	}
-
-	// Marshal the updated manifest back to JSON
-	updatedManifest, err := json.Marshal(manifest)
+	keep, err := policy.keep()
 	if err != nil {
 		return err
 	}
+	progress.phase(PhaseCommittingManifest, blobInfo.Size, blobInfo.Size)
+	return fm.putArtifactManifest(ctx, harborRepo, tag, []imgspecv1.Descriptor{layerDescriptor(blobInfo)}, keep)
+}
 
-	// Push the updated manifest back to the remote repository
-	if err = destImg.PutManifest(ctx, updatedManifest, nil); err != nil {
-		return err
-	}
-	return nil
+func layerDescriptor(blobInfo types.BlobInfo) imgspecv1.Descriptor {
+	return imgspecv1.Descriptor{MediaType: blobInfo.MediaType, Digest: blobInfo.Digest, Size: blobInfo.Size, Annotations: blobInfo.Annotations}
 }
 
 func (fm *fileManager) GetBlobDigest(ctx context.Context, harborRepo, tag string) (string, error) {
-	// 准备上传的目标路径
-	destRef := fmt.Sprintf("%s:%s", harborRepo, tag)
 	// 使用 containers/image 库上传文件到Harbor
-	imageRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", destRef))
+	imageRef, err := fm.imageReference(harborRepo, tag)
 	if err != nil {
 		return "", err
 	}
 
 	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: fm.hifConf.HarborUserName,
-			Password: fm.hifConf.HarborUserPassword,
-		},
-		BlobInfoCacheDir:                    fm.hifConf.RootCacheDir,
-		DockerRegistryPushPrecomputeDigests: true,
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return "", err
 	}
 
 	// Create an image source based on the reference
-	imageSource, err := imageRef.NewImageSource(ctx, sys)
+	imageSource, err := fm.newImageSource(ctx, imageRef, sys)
 	if err != nil {
-		return "", err
+		return "", wrapImageError(err, "get manifest", harborRepo, tag)
 	}
+	defer imageSource.Close()
 
-	latestDigest, err := getLatestLayerDigest(ctx, imageSource)
+	var latestDigest string
+	err = fm.retryPolicy().retry(ctx, func() error {
+		return fm.withImageTimeout(ctx, func(ctx context.Context) (err error) {
+			latestDigest, err = getLatestLayerDigest(ctx, imageSource)
+			return err
+		})
+	})
 	if err != nil {
-		return "", err
+		return "", wrapImageError(err, "get manifest", harborRepo, tag)
 	}
 	return latestDigest, nil
 }
 
 func getLatestLayerDigest(ctx context.Context, srcImg types.ImageSource) (string, error) {
-	// Get the existing manifest
-	originalManifest, _, err := srcImg.GetManifest(ctx, nil)
+	layer, err := getLatestLayer(ctx, srcImg)
 	if err != nil {
 		return "", err
 	}
-	// 解析 JSON
-	var manifestData map[string]interface{}
-	if err = json.Unmarshal(originalManifest, &manifestData); err != nil {
-		return "", err
-	}
+	return layer.Digest.String(), nil
+}
 
-	// 提取 layers 数组
-	layers, ok := manifestData["layers"].([]interface{})
-	if !ok || len(layers) == 0 {
-		return "", fmt.Errorf("no layers field found or it is not an array")
-	}
-	layerData, ok := layers[0].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid layer data at index 0")
+// getLatestLayer 返回 manifest 中最新上传的文件 layer
+func getLatestLayer(ctx context.Context, srcImg types.ImageSource) (*types.BlobInfo, error) {
+	// Get the existing manifest
+	originalManifest, _, err := srcImg.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, err
 	}
-	digestStr, exists := layerData["digest"].(string)
-	if !exists {
-		return "", fmt.Errorf("no digest field found in layer at index 0")
+	manifest, err := parseManifest(originalManifest)
+	if err != nil {
+		return nil, err
 	}
-	return digestStr, nil
+	layers := fileLayers(manifest)
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("no layers found in manifest")
+	}
+	layer := layers[len(layers)-1]
+	return &types.BlobInfo{
+		Digest:      layer.Digest,
+		Size:        layer.Size,
+		MediaType:   layer.MediaType,
+		Annotations: layer.Annotations,
+	}, nil
 }
 
 func (fm *fileManager) GetLatestLayerDigest(ctx context.Context, harborRepo, tag string) (string, error) {
-	// 准备下载的源路径
-	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s:%s", harborRepo, tag))
+	layer, err := fm.GetLatestLayer(ctx, harborRepo, tag)
 	if err != nil {
 		return "", err
 	}
+	return layer.Digest.String(), nil
+}
+
+// GetLatestLayer 返回 harborRepo:tag 中文件的 digest、大小以及上传时记录的媒体类型
+func (fm *fileManager) GetLatestLayer(ctx context.Context, harborRepo, tag string) (*types.BlobInfo, error) {
+	// 准备下载的源路径
+	srcRef, err := fm.imageReference(harborRepo, tag)
+	if err != nil {
+		return nil, err
+	}
 	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: fm.hifConf.HarborUserName,
-			Password: fm.hifConf.HarborUserPassword,
-		},
-		BlobInfoCacheDir: fm.hifConf.RootCacheDir,
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, err
 	}
 
 	// 使用 image.NewImage 创建一个镜像对象
-	srcImg, err := srcRef.NewImageSource(ctx, sys)
+	srcImg, err := fm.newImageSource(ctx, srcRef, sys)
 	if err != nil {
-		return "", err
+		return nil, wrapImageError(err, "get manifest", harborRepo, tag)
 	}
-	digestStr, err := getLatestLayerDigest(ctx, srcImg)
+	defer srcImg.Close()
+	var layer *types.BlobInfo
+	err = fm.retryPolicy().retry(ctx, func() error {
+		return fm.withImageTimeout(ctx, func(ctx context.Context) (err error) {
+			layer, err = getLatestLayer(ctx, srcImg)
+			return err
+		})
+	})
 	if err != nil {
-		return "", err
+		return nil, wrapImageError(err, "get manifest", harborRepo, tag)
 	}
-	return digestStr, nil
+	return layer, nil
 }
 
-func (fm *fileManager) GetLatestArtifactDigest(ctx context.Context, harborRepo string) (string, error) {
-	harborHostname, projectName, repoName, err := parseHarborURL(harborRepo)
+// ListVersions 按从新到旧的顺序返回 harborRepo:tag 中保存的文件，tag 不存在时返回空列表
+func (fm *fileManager) ListVersions(ctx context.Context, harborRepo, tag string) ([]Version, error) {
+	srcRef, err := fm.imageReference(harborRepo, tag)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, err
 	}
-	latestDigest, err := GetLatestArtifactDigest(ctx, "https://"+harborHostname, projectName, repoName, fm.hifConf.HarborUserName, fm.hifConf.HarborUserPassword)
+	manifest, _, err := fm.readManifest(ctx, srcRef, sys)
+	if err != nil || manifest == nil {
+		return nil, wrapImageError(err, "get manifest", harborRepo, tag)
+	}
+	return versionsFromManifest(manifest), nil
+}
+
+func (fm *fileManager) GetLatestArtifactDigest(ctx context.Context, harborRepo string) (string, error) {
+	backend, err := fm.getBackend()
 	if err != nil {
 		return "", err
 	}
-	return latestDigest, nil
+	return backend.LatestArtifactDigest(ctx, harborRepo)
 }
 
 func (fm *fileManager) GetDownloadReader(ctx context.Context, harborRepo, tag string) (io.ReadCloser, int64, error) {
@@ -297,31 +441,40 @@ func (fm *fileManager) GetDownloadReader(ctx context.Context, harborRepo, tag st
 		return nil, 0, err
 	}
 	// 准备下载的源路径
-	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s:%s", harborRepo, tag))
+	srcRef, err := fm.imageReference(harborRepo, tag)
 	if err != nil {
 		return nil, 0, err
 	}
 	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: fm.hifConf.HarborUserName,
-			Password: fm.hifConf.HarborUserPassword,
-		},
-		BlobInfoCacheDir: fm.hifConf.RootCacheDir,
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// 使用 image.NewImage 创建一个镜像对象
-	srcImg, err := srcRef.NewImageSource(ctx, sys)
+	srcImg, err := fm.newImageSource(ctx, srcRef, sys)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapImageError(err, "get manifest", harborRepo, tag)
 	}
 
-	latestDigest, err := getLatestLayerDigest(ctx, srcImg)
+	var latestDigest string
+	err = fm.retryPolicy().retry(ctx, func() error {
+		return fm.withImageTimeout(ctx, func(ctx context.Context) (err error) {
+			latestDigest, err = getLatestLayerDigest(ctx, srcImg)
+			return err
+		})
+	})
 	if err != nil {
-		return nil, 0, err
+		_ = srcImg.Close()
+		return nil, 0, wrapImageError(err, "get manifest", harborRepo, tag)
+	}
+	// 优先从本地内容缓存读取
+	if reader, size, ok := fm.openCachedBlob(digest.Digest(latestDigest)); ok {
+		_ = srcImg.Close()
+		return fm.trackReader(ctx, harborRepo, tag, digest.Digest(latestDigest), PhaseCacheHit, reader, size), size, nil
 	}
 	// 获取文件内容，并检查并命中本地缓存
-	reader, size, err := srcImg.GetBlob(ctx, types.BlobInfo{
+	reader, size, err := fm.getImageBlob(ctx, srcImg, types.BlobInfo{
 		Digest:               digest.Digest(latestDigest),
 		Size:                 0,
 		URLs:                 nil,
@@ -330,45 +483,31 @@ func (fm *fileManager) GetDownloadReader(ctx context.Context, harborRepo, tag st
 		CompressionOperation: 0,
 		CompressionAlgorithm: nil,
 		CryptoOperation:      0,
-	}, blobinfocache.DefaultCache(sys))
+	}, sys)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapImageError(err, "get blob", harborRepo, tag)
 	}
-	return reader, size, nil
+	return fm.trackReader(ctx, harborRepo, tag, digest.Digest(latestDigest), PhaseDownloading, fm.cacheBlobReader(digest.Digest(latestDigest), reader), size), size, nil
 }
 
+// DownloadFile 下载 harborRepo:tag 中最新上传的文件，一组文件的 tag 只会得到其中最后一个，参见 FileManager
 func (fm *fileManager) DownloadFile(ctx context.Context, harborRepo, tag, targetFilePath string) error {
-	// 从Harbor下载文件
-	reader, _, err := fm.GetDownloadReader(ctx, harborRepo, tag)
-	if err != nil {
-		return err
-	}
-
-	defer func(reader io.ReadCloser) {
-		err = reader.Close()
-		if err != nil {
-
-		}
-	}(reader)
+	_, err := fm.DownloadFileWithInfo(ctx, harborRepo, tag, targetFilePath)
+	return err
+}
 
-	// 创建本地文件
-	localFile, err := os.Create(targetFilePath)
+// DownloadFileWithInfo 下载 harborRepo:tag 中的文件，返回其 digest、大小以及媒体类型
+func (fm *fileManager) DownloadFileWithInfo(ctx context.Context, harborRepo, tag, targetFilePath string) (*types.BlobInfo, error) {
+	// 获取最新的文件 layer
+	layer, err := fm.GetLatestLayer(ctx, harborRepo, tag)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func(localFile *os.File) {
-		err = localFile.Close()
-		if err != nil {
-
-		}
-	}(localFile)
-
-	// 将文件内容复制到本地文件
-	_, err = io.Copy(localFile, reader)
-	if err != nil {
-		return err
+	// 从Harbor下载文件，支持断点续传
+	if err = fm.downloadBlobToFile(ctx, harborRepo, layer.Digest, targetFilePath, fm.newProgressTracker(ctx, harborRepo, tag)); err != nil {
+		return nil, err
 	}
-	return nil
+	return layer, nil
 }
 
 func (fm *fileManager) GetDownloadReaderWithBlobDigest(ctx context.Context, harborRepo, tag, digestStr string) (io.ReadCloser, int64, error) {
@@ -376,28 +515,29 @@ func (fm *fileManager) GetDownloadReaderWithBlobDigest(ctx context.Context, harb
 	if err != nil {
 		return nil, 0, err
 	}
+	// 优先从本地内容缓存读取
+	if reader, size, ok := fm.openCachedBlob(digest.Digest(digestStr)); ok {
+		return fm.trackReader(ctx, harborRepo, tag, digest.Digest(digestStr), PhaseCacheHit, reader, size), size, nil
+	}
 	// 准备下载的源路径
-	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s:%s", harborRepo, tag))
+	srcRef, err := fm.imageReference(harborRepo, tag)
 	if err != nil {
 		return nil, 0, err
 	}
 	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: fm.hifConf.HarborUserName,
-			Password: fm.hifConf.HarborUserPassword,
-		},
-		BlobInfoCacheDir: fm.hifConf.RootCacheDir,
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// 使用 image.NewImage 创建一个镜像对象
-	srcImg, err := srcRef.NewImageSource(ctx, sys)
+	srcImg, err := fm.newImageSource(ctx, srcRef, sys)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapImageError(err, "get manifest", harborRepo, tag)
 	}
 
 	// 获取文件内容，并检查并命中本地缓存
-	reader, size, err := srcImg.GetBlob(ctx, types.BlobInfo{
+	reader, size, err := fm.getImageBlob(ctx, srcImg, types.BlobInfo{
 		Digest:               digest.Digest(digestStr),
 		Size:                 0,
 		URLs:                 nil,
@@ -406,45 +546,20 @@ func (fm *fileManager) GetDownloadReaderWithBlobDigest(ctx context.Context, harb
 		CompressionOperation: 0,
 		CompressionAlgorithm: nil,
 		CryptoOperation:      0,
-	}, blobinfocache.DefaultCache(sys))
+	}, sys)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapImageError(err, "get blob", harborRepo, tag)
 	}
-	return reader, size, nil
+	return fm.trackReader(ctx, harborRepo, tag, digest.Digest(digestStr), PhaseDownloading, fm.cacheBlobReader(digest.Digest(digestStr), reader), size), size, nil
 }
 
 func (fm *fileManager) DownloadFileWithBlobDigest(ctx context.Context, harborRepo, tag, digestStr, targetFilePath string) error {
-	// 从Harbor下载文件
-	reader, _, err := fm.GetDownloadReaderWithBlobDigest(ctx, harborRepo, tag, digestStr)
-	if err != nil {
-		return err
-	}
-
-	defer func(reader io.ReadCloser) {
-		err = reader.Close()
-		if err != nil {
-
-		}
-	}(reader)
-
-	// 创建本地文件
-	localFile, err := os.Create(targetFilePath)
-	if err != nil {
-		return err
-	}
-	defer func(localFile *os.File) {
-		err = localFile.Close()
-		if err != nil {
-
-		}
-	}(localFile)
-
-	// 将文件内容复制到本地文件
-	_, err = io.Copy(localFile, reader)
+	dgst, err := digest.Parse(digestStr)
 	if err != nil {
 		return err
 	}
-	return nil
+	// 从Harbor下载文件，支持断点续传
+	return fm.downloadBlobToFile(ctx, harborRepo, dgst, targetFilePath, fm.newProgressTracker(ctx, harborRepo, tag))
 }
 
 func (fm *fileManager) GetDownloadReaderWithBlob(ctx context.Context, harborRepo, tag string, blobInfo *types.BlobInfo) (io.ReadCloser, int64, error) {
@@ -452,104 +567,98 @@ func (fm *fileManager) GetDownloadReaderWithBlob(ctx context.Context, harborRepo
 	if err != nil {
 		return nil, 0, err
 	}
+	// 优先从本地内容缓存读取
+	if reader, size, ok := fm.openCachedBlob(blobInfo.Digest); ok {
+		return fm.trackReader(ctx, harborRepo, tag, blobInfo.Digest, PhaseCacheHit, reader, size), size, nil
+	}
 	// 准备下载的源路径
-	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s:%s", harborRepo, tag))
+	srcRef, err := fm.imageReference(harborRepo, tag)
 	if err != nil {
 		return nil, 0, err
 	}
 	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: fm.hifConf.HarborUserName,
-			Password: fm.hifConf.HarborUserPassword,
-		},
-		BlobInfoCacheDir: fm.hifConf.RootCacheDir,
+	sys, err := fm.systemContext(ctx, harborRepo)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// 使用 image.NewImage 创建一个镜像对象
-	srcImg, err := srcRef.NewImageSource(ctx, sys)
+	srcImg, err := fm.newImageSource(ctx, srcRef, sys)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapImageError(err, "get manifest", harborRepo, tag)
 	}
 
 	// 获取文件内容，并检查并命中本地缓存
-	reader, size, err := srcImg.GetBlob(ctx, *blobInfo, blobinfocache.DefaultCache(sys))
+	reader, size, err := fm.getImageBlob(ctx, srcImg, *blobInfo, sys)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapImageError(err, "get blob", harborRepo, tag)
 	}
-	return reader, size, nil
+	return fm.trackReader(ctx, harborRepo, tag, blobInfo.Digest, PhaseDownloading, fm.cacheBlobReader(blobInfo.Digest, reader), size), size, nil
 }
 
 func (fm *fileManager) DownloadFileWithBlob(ctx context.Context, harborRepo, tag, targetFilePath string, blobInfo *types.BlobInfo) error {
-	// 从Harbor下载文件
-	reader, _, err := fm.GetDownloadReaderWithBlob(ctx, harborRepo, tag, blobInfo)
-	if err != nil {
-		return err
+	if blobInfo == nil {
+		return fmt.Errorf("blobInfo is nil")
 	}
+	// 从Harbor下载文件，支持断点续传
+	return fm.downloadBlobToFile(ctx, harborRepo, blobInfo.Digest, targetFilePath, fm.newProgressTracker(ctx, harborRepo, tag))
+}
 
-	defer func(reader io.ReadCloser) {
-		err = reader.Close()
-		if err != nil {
-
-		}
-	}(reader)
+func (fm *fileManager) DeleteImage(ctx context.Context, harborRepo, tag string) error {
 
-	// 创建本地文件
-	localFile, err := os.Create(targetFilePath)
+	// 使用 containers/image 库上传文件到Harbor
+	destCtx, err := fm.imageReference(harborRepo, tag)
 	if err != nil {
 		return err
 	}
-	defer func(localFile *os.File) {
-		err = localFile.Close()
-		if err != nil {
 
-		}
-	}(localFile)
-
-	// 将文件内容复制到本地文件
-	_, err = io.Copy(localFile, reader)
+	// 创建 SystemContext，设置 Harbor 账号密码
+	sys, err := fm.systemContext(ctx, harborRepo)
 	if err != nil {
 		return err
 	}
+
+	err = fm.withImageTimeout(ctx, func(ctx context.Context) error {
+		return destCtx.DeleteImage(ctx, sys)
+	})
+	if err != nil {
+		return wrapImageError(err, "delete image", harborRepo, tag)
+	}
 	return nil
 }
 
-func (fm *fileManager) DeleteImage(ctx context.Context, harborRepo, tag string) error {
-
-	// 准备上传的目标路径
-	destRef := fmt.Sprintf("%s:%s", harborRepo, tag)
-
-	// 使用 containers/image 库上传文件到Harbor
-	destCtx, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", destRef))
+func (fm *fileManager) ListTags(ctx context.Context, harborRepo string) ([]string, error) {
+	backend, err := fm.getBackend()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return backend.ListTags(ctx, harborRepo)
+}
 
-	// 创建 SystemContext，设置 Harbor 账号密码
-	sys := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: fm.hifConf.HarborUserName,
-			Password: fm.hifConf.HarborUserPassword,
-		},
-		BlobInfoCacheDir: fm.hifConf.RootCacheDir,
+// ListRepositories 列出 project(例如 hub.xxxx.com/vmimages)中名称包含 filter 的仓库，
+// 返回 hub.xxxx.com/vmimages/ubuntu 形式的完整仓库名，filter 为空时列出全部仓库
+func (fm *fileManager) ListRepositories(ctx context.Context, project, filter string) ([]string, error) {
+	backend, err := fm.getBackend()
+	if err != nil {
+		return nil, err
 	}
+	return backend.ListRepositories(ctx, project, filter)
+}
 
-	err = destCtx.DeleteImage(ctx, sys)
+// GetArtifact 返回 harborRepo 中 reference(tag 或 digest)对应的制品及其全部 tag，
+// Harbor 后端还会返回标签和漏洞扫描概要，不存在时返回 ErrNotFound
+func (fm *fileManager) GetArtifact(ctx context.Context, harborRepo, reference string) (*Artifact, error) {
+	backend, err := fm.getBackend()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return backend.GetArtifact(ctx, harborRepo, reference)
 }
 
 func (fm *fileManager) DeleteRepo(ctx context.Context, harborRepo string) error {
-	// 构建项目 API URL
-	harborHostname, projectName, repoName, err := parseHarborURL(harborRepo)
-	if err != nil {
-		return err
-	}
-	err = DeleteHarborRepo(ctx, "https://"+harborHostname, projectName, repoName, fm.hifConf.HarborUserName, fm.hifConf.HarborUserPassword)
+	backend, err := fm.getBackend()
 	if err != nil {
 		return err
 	}
-	return nil
+	return backend.DeleteRepo(ctx, harborRepo)
 }
@@ -1,260 +1,1395 @@
 package manager
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
-)
+	"time"
 
-const (
-	defaultHarborUserName     = "xxx"
-	defaultHarborUserPassword = "xxxxx"
-	defaultHarborProject      = "hub.xxxx.com/vmimages"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func TestMainThread(t *testing.T) {
-	// 本地文件路径
-	//localFilePath := "/home/q1/deploy.yml"
-	localFileDir := "/tmp/harbor-file-uploader"
-	err := createDirectorIfNotExist(localFileDir)
+const defaultHarborProject = "vmimages"
+
+// newTestFileManager 创建连接到 fakeRegistry 的 fileManager，所有数据都写在 t.TempDir() 下
+func newTestFileManager(t *testing.T, registry *fakeRegistry, modify func(config *FmConfig)) *fileManager {
+	t.Helper()
+	config := &FmConfig{
+		HarborUserName:     fakeUserName,
+		HarborUserPassword: fakePassword,
+		RootCacheDir:       t.TempDir(),
+		Retry:              RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+	}
+	if registry != nil {
+		config.Transport.PlainHTTPRegistries = []string{registry.host()}
+	}
+	if modify != nil {
+		modify(config)
+	}
+	fm, err := newFileManager(config)
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
-	localFilePath := filepath.Join(localFileDir, "test-file.json")
+	// 设置 DownloadConcurrency 的测试总是并行下载
+	fm.minParallelSize = 1
+	return fm
+}
 
-	// 生成 manifest 文件
-	testFileContentJSON := []byte(`{
-        "schemaVersion": 2,
-		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-        "config": {
-            "mediaType": "application/vnd.oci.image.config.v1+json",
-            "digest": "sha256:nieyinliang",
-            "size": 12
-        },
-        "layers": [
-			"mediaType": "application/vnd.oci.image.config.v1+json",
-            "digest": "sha256:nieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliangnieyinliang",
-            "size": 12
-        ]
-    }`)
-
-	if err = createFile(localFilePath, testFileContentJSON); err != nil {
-		return
-	}
-
-	// Harbor仓库地址和目标文件路径
-	harborRepo := defaultHarborProject + "/nieyinliang-xx"
+func testRepo(registry *fakeRegistry, name string) string {
+	return registry.host() + "/" + defaultHarborProject + "/" + name
+}
+
+func writeTestFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	localFilePath := filepath.Join(t.TempDir(), "image.qcow2")
+	if err := createFile(localFilePath, content); err != nil {
+		t.Fatal(err)
+	}
+	return localFilePath, content
+}
+
+func uploadTestFile(t *testing.T, fm *fileManager, harborRepo, tag string, size int) (string, []byte, digest.Digest) {
+	t.Helper()
+	ctx := context.Background()
+	localFilePath, content := writeTestFile(t, size)
+	if err := fm.CreateRepositoryIfNotExist(ctx, harborRepo, tag); err != nil {
+		t.Fatalf("CreateRepositoryIfNotExist: %v", err)
+	}
+	blobInfo, err := fm.UploadFile(ctx, localFilePath, harborRepo, tag)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if blobInfo.Digest != digest.FromBytes(content) || blobInfo.Size != int64(size) {
+		t.Fatalf("unexpected blobInfo %+v", blobInfo)
+	}
+	return localFilePath, content, blobInfo.Digest
+}
+
+func readAndClose(t *testing.T, reader io.ReadCloser) []byte {
+	t.Helper()
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func assertFileContent(t *testing.T, filePath string, expected []byte) {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("%s: content mismatch, got %d bytes, want %d bytes", filePath, len(content), len(expected))
+	}
+	if _, err = os.Stat(filePath + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("%s.part should be removed, stat err: %v", filePath, err)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "ubuntu-22.04")
 	harborTag := "latest"
-	harborUsername := defaultHarborUserName
-	harborPassword := defaultHarborUserPassword
 
-	// 初始化容器引擎
+	_, content, dgst := uploadTestFile(t, fm, harborRepo, harborTag, 1<<20+17)
+
+	layerDigest, err := fm.GetLatestLayerDigest(ctx, harborRepo, harborTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layerDigest != dgst.String() {
+		t.Fatalf("GetLatestLayerDigest = %s, want %s", layerDigest, dgst)
+	}
+	blobDigest, err := fm.GetBlobDigest(ctx, harborRepo, harborTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobDigest != dgst.String() {
+		t.Fatalf("GetBlobDigest = %s, want %s", blobDigest, dgst)
+	}
+
+	targetDir := t.TempDir()
+	if err = fm.DownloadFile(ctx, harborRepo, harborTag, filepath.Join(targetDir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, filepath.Join(targetDir, "a"), content)
+	if err = fm.DownloadFileWithBlobDigest(ctx, harborRepo, harborTag, dgst.String(), filepath.Join(targetDir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, filepath.Join(targetDir, "b"), content)
+	blobInfo := &types.BlobInfo{Digest: dgst, Size: int64(len(content))}
+	if err = fm.DownloadFileWithBlob(ctx, harborRepo, harborTag, filepath.Join(targetDir, "c"), blobInfo); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, filepath.Join(targetDir, "c"), content)
+
+	reader, size, err := fm.GetDownloadReader(ctx, harborRepo, harborTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAndClose(t, reader); size != int64(len(content)) || !bytes.Equal(got, content) {
+		t.Fatalf("GetDownloadReader returned %d bytes (size %d)", len(got), size)
+	}
+	reader, _, err = fm.GetDownloadReaderWithBlobDigest(ctx, harborRepo, harborTag, dgst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAndClose(t, reader); !bytes.Equal(got, content) {
+		t.Fatal("GetDownloadReaderWithBlobDigest content mismatch")
+	}
+	reader, _, err = fm.GetDownloadReaderWithBlob(ctx, harborRepo, harborTag, blobInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAndClose(t, reader); !bytes.Equal(got, content) {
+		t.Fatal("GetDownloadReaderWithBlob content mismatch")
+	}
+}
+
+func TestUploadFileCreatesArtifactManifest(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "artifact")
+	name := defaultHarborProject + "/artifact"
+
+	// 不再推送引导镜像
+	if err := fm.CreateRepositoryIfNotExist(ctx, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if repo := registry.repos[name]; repo != nil && len(repo.manifests) > 0 {
+		t.Fatalf("CreateRepositoryIfNotExist pushed %d manifests", len(repo.manifests))
+	}
+
+	localFilePath, content := writeTestFile(t, 4<<10)
+	if _, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	m := registry.lookupManifest(name, "latest")
+	if m == nil {
+		t.Fatal("manifest was not pushed")
+	}
+	manifest, err := parseManifest(m.content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.MediaType != imgspecv1.MediaTypeImageManifest || manifest.ArtifactType != ArtifactTypeVMImage {
+		t.Fatalf("unexpected manifest %s", m.content)
+	}
+	// 与 oras push 相同：空 JSON config，layer 带有文件名
+	if manifest.Config.Digest != imgspecv1.DescriptorEmptyJSON.Digest || registry.blobs[manifest.Config.Digest] == nil {
+		t.Fatalf("empty config blob %s was not uploaded", manifest.Config.Digest)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != digest.FromBytes(content) ||
+		manifest.Layers[0].Annotations[imgspecv1.AnnotationTitle] != filepath.Base(localFilePath) {
+		t.Fatalf("unexpected layers %+v", manifest.Layers)
+	}
+}
+
+func TestUploadFileMediaType(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
 	ctx := context.Background()
+	harborRepo := testRepo(registry, "media-type")
+
+	localFilePath := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := createFile(localFilePath, header(64<<10, 0, "QFI\xfb\x00\x00\x00\x03")); err != nil {
+		t.Fatal(err)
+	}
+	blobInfo, err := fm.UploadFile(ctx, localFilePath, harborRepo, "qcow2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobInfo.MediaType != MediaTypeQCOW2 {
+		t.Fatalf("UploadFile detected %s", blobInfo.MediaType)
+	}
+	layer, err := fm.DownloadFileWithInfo(ctx, harborRepo, "qcow2", filepath.Join(t.TempDir(), "download.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.MediaType != MediaTypeQCOW2 || layer.Digest != blobInfo.Digest || layer.Size != blobInfo.Size {
+		t.Fatalf("unexpected layer %+v", layer)
+	}
+
+	// 显式指定的类型优先于自动识别
+	if _, err = fm.UploadFileWithOptions(ctx, localFilePath, harborRepo, "custom", &UploadOptions{MediaType: "application/x-custom"}); err != nil {
+		t.Fatal(err)
+	}
+	if layer, err = fm.GetLatestLayer(ctx, harborRepo, "custom"); err != nil || layer.MediaType != "application/x-custom" {
+		t.Fatalf("GetLatestLayer = %+v, %v", layer, err)
+	}
+}
+
+func TestBuildArtifactManifest(t *testing.T) {
+	config := imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeEmptyJSON, Digest: digest.FromString("{}"), Size: 2}
+	first := imgspecv1.Descriptor{MediaType: MediaTypeVMImageLayer, Digest: digest.FromString("first"), Size: 5}
+	second := imgspecv1.Descriptor{MediaType: MediaTypeVMImageLayer, Digest: digest.FromString("second"), Size: 6}
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	manifest := buildArtifactManifest(nil, config, []imgspecv1.Descriptor{first}, created, 0)
+	if manifest.SchemaVersion != 2 || manifest.ArtifactType != ArtifactTypeVMImage || len(manifest.Layers) != 1 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	if manifest.Annotations[imgspecv1.AnnotationCreated] != "2024-01-02T03:04:05Z" {
+		t.Fatalf("unexpected annotations %v", manifest.Annotations)
+	}
 
-	hfM := SimpleNewOnce(harborUsername, harborPassword, defaultRootHarborCacheDir)
-	err = hfM.CreateRepositoryIfNotExist(ctx, harborRepo, harborTag)
+	// 旧版本写入的 docker schema2 manifest 转换为 OCI 制品并保留 layer
+	legacy, err := parseManifest([]byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "` + digest.FromString("legacy").String() + `", "size": 6},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "` + first.Digest.String() + `", "size": 5}]
+	}`))
 	if err != nil {
-		fmt.Printf("Error hfM.CreateHarborRepositoryIfNotExist: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	manifest = buildArtifactManifest(legacy, config, []imgspecv1.Descriptor{second}, created, 0)
+	if manifest.MediaType != imgspecv1.MediaTypeImageManifest || manifest.Config.Digest != config.Digest {
+		t.Fatalf("legacy manifest was not converted: %+v", manifest)
+	}
+	if len(manifest.Layers) != 2 || manifest.Layers[0].Digest != first.Digest || manifest.Layers[1].Digest != second.Digest {
+		t.Fatalf("unexpected layers %+v", manifest.Layers)
+	}
+
+	if _, err = parseManifest([]byte(`{"schemaVersion": 1}`)); err == nil {
+		t.Fatal("expected error for schema1 manifest")
 	}
+}
 
-	// 上传文件到Harbor
+func TestFileLayers(t *testing.T) {
+	// oras push 生成的 manifest：没有文件时只有一个空 layer
+	empty, err := parseManifest([]byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"artifactType": "application/vnd.unknown.artifact.v1",
+		"config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "` + imgspecv1.DescriptorEmptyJSON.Digest.String() + `", "size": 2},
+		"layers": [{"mediaType": "application/vnd.oci.empty.v1+json", "digest": "` + imgspecv1.DescriptorEmptyJSON.Digest.String() + `", "size": 2}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layers := fileLayers(empty); len(layers) != 0 {
+		t.Fatalf("empty layer must be skipped: %+v", layers)
+	}
 
-	blobInfo, err := hfM.UploadFile(ctx, localFilePath, harborRepo, harborTag)
+	// 旧版本写入的 docker schema2 manifest，文件以 tar+gzip 类型原样保存
+	legacy, err := parseManifest([]byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "` + digest.FromString("legacy").String() + `", "size": 6},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "` + digest.FromString("file").String() + `", "size": 4}]
+	}`))
 	if err != nil {
-		fmt.Printf("error hfM.UploadFile uploading file: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if layers := fileLayers(legacy); len(layers) != 1 || layers[0].MediaType != MediaTypeVMImageLayer {
+		t.Fatalf("unexpected legacy layers %+v", layers)
 	}
+	if legacy.Layers[0].MediaType != imgspecv1.MediaTypeImageLayerGzip {
+		t.Fatal("fileLayers must not modify the manifest")
+	}
+	converted := buildArtifactManifest(legacy, imgspecv1.DescriptorEmptyJSON, nil, time.Now(), 0)
+	if converted.Layers[0].MediaType != MediaTypeVMImageLayer {
+		t.Fatalf("legacy layer was not converted: %+v", converted.Layers)
+	}
+}
+
+func TestORASLayout(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "oras")
+	name := defaultHarborProject + "/oras"
 
-	fmt.Println("file uploaded to Harbor successfully!")
-	fmt.Println("blobInfo:", blobInfo)
+	// oras push hub.xxxx.com/vmimages/oras:v1 disk.qcow2 SHA256SUMS
+	disk, sums := []byte("QFI\xfb disk"), []byte("checksums\n")
+	registry.putManifest(name, "v1", imgspecv1.MediaTypeImageManifest, []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"artifactType": "application/vnd.unknown.artifact.v1",
+		"config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "`+imgspecv1.DescriptorEmptyJSON.Digest.String()+`", "size": 2, "data": "e30="},
+		"layers": [
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": "`+digest.FromBytes(disk).String()+`", "size": `+strconv.Itoa(len(disk))+`,
+				"annotations": {"org.opencontainers.image.title": "disk.qcow2"}},
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": "`+digest.FromBytes(sums).String()+`", "size": `+strconv.Itoa(len(sums))+`,
+				"annotations": {"org.opencontainers.image.title": "SHA256SUMS"}}
+		],
+		"annotations": {"org.opencontainers.image.created": "2024-01-02T03:04:05Z"}
+	}`), imgspecv1.DescriptorEmptyJSON.Data, disk, sums)
 
-	// 从Harbor下载文件
-	//reader, _, err := hfM.GetDownloadReaderWithBlobDigest(ctx, harborRepo, harborTag, string(blobInfo.Digest))
-	reader, _, err := hfM.GetDownloadReader(ctx, harborRepo, harborTag)
+	targetFilePath := filepath.Join(t.TempDir(), "latest")
+	layer, err := fm.DownloadFileWithInfo(ctx, harborRepo, "v1", targetFilePath)
 	if err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, targetFilePath, sums)
+	if layer.Annotations[imgspecv1.AnnotationTitle] != "SHA256SUMS" {
+		t.Fatalf("unexpected layer %+v", layer)
+	}
+	if _, err = fm.DownloadFileByName(ctx, harborRepo, "v1", "disk.qcow2", targetFilePath); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, targetFilePath, disk)
 
-		fmt.Printf("Error downloading file: %v\n", err)
-		return
+	// 旧版本通过引导镜像写入的 docker schema2 manifest
+	legacyFile := []byte("legacy file")
+	legacyConfig := []byte(`{"user": "1000:1000"}`)
+	registry.putManifest(name, "legacy", mediaTypeDockerManifest, []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "`+digest.FromBytes(legacyConfig).String()+`", "size": `+strconv.Itoa(len(legacyConfig))+`},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "`+digest.FromBytes(legacyFile).String()+`", "size": `+strconv.Itoa(len(legacyFile))+`}]
+	}`), legacyConfig, legacyFile)
+	if layer, err = fm.DownloadFileWithInfo(ctx, harborRepo, "legacy", targetFilePath); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, targetFilePath, legacyFile)
+	if layer.MediaType != MediaTypeVMImageLayer {
+		t.Fatalf("legacy layer reported as %s", layer.MediaType)
 	}
 
-	defer func(reader io.ReadCloser) {
-		err := reader.Close()
+	// 在 oras 制品上继续上传，转换为本项目的制品并保留已有的文件
+	localFilePath, content := writeTestFile(t, 4<<10)
+	if _, err = fm.UploadFile(ctx, localFilePath, harborRepo, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := fm.ListVersions(ctx, harborRepo, "v1")
+	if err != nil || len(versions) != 3 || versions[0].Digest != digest.FromBytes(content) {
+		t.Fatalf("ListVersions = %+v, %v", versions, err)
+	}
+}
+
+func TestVersioningPolicy(t *testing.T) {
+	config := imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeEmptyJSON, Digest: digest.FromString("{}"), Size: 2}
+	var manifest *imgspecv1.Manifest
+	push := func(policy VersioningPolicy, content string, created time.Time) {
+		t.Helper()
+		keep, err := policy.keep()
 		if err != nil {
+			t.Fatal(err)
+		}
+		layer := imgspecv1.Descriptor{MediaType: MediaTypeVMImageLayer, Digest: digest.FromString(content), Size: int64(len(content))}
+		manifest = buildArtifactManifest(manifest, config, []imgspecv1.Descriptor{layer}, created, keep)
+	}
+	assertVersions := func(expected ...string) {
+		t.Helper()
+		versions := versionsFromManifest(manifest)
+		if len(versions) != len(expected) {
+			t.Fatalf("got %d versions, want %d", len(versions), len(expected))
+		}
+		for i, content := range expected {
+			if versions[i].Digest != digest.FromString(content) {
+				t.Fatalf("version %d is %s, want %q", i, versions[i].Digest, content)
+			}
+		}
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	push(VersioningAppend, "v1", base)
+	push("", "v2", base.Add(time.Hour))
+	push(VersioningAppend, "v3", base.Add(2*time.Hour))
+	assertVersions("v3", "v2", "v1")
+	if created := versionsFromManifest(manifest)[1].Created; !created.Equal(base.Add(time.Hour)) {
+		t.Fatalf("v2 created at %v", created)
+	}
+
+	// 重新上传历史中的文件时将其移到最新
+	push(VersioningAppend, "v1", base.Add(3*time.Hour))
+	assertVersions("v1", "v3", "v2")
 
+	push(KeepLast(2), "v4", base.Add(4*time.Hour))
+	assertVersions("v4", "v1")
+
+	push(VersioningReplace, "v5", base.Add(5*time.Hour))
+	assertVersions("v5")
+
+	for _, policy := range []VersioningPolicy{"keep-last-0", "keep-last-x", "newest"} {
+		if _, err := policy.keep(); err == nil {
+			t.Errorf("expected error for policy %q", policy)
 		}
-	}(reader)
+	}
+	if _, err := newFileManager(&FmConfig{Versioning: "newest"}); err == nil {
+		t.Fatal("expected New to reject an invalid versioning policy")
+	}
+}
 
-	// 创建目录
-	if err = os.MkdirAll("/tmp/images", os.ModePerm); err != nil {
-		return
+func TestUploadFileVersioning(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "versions")
+
+	_, _, first := uploadTestFile(t, fm, harborRepo, "latest", 1024)
+	_, content, second := uploadTestFile(t, fm, harborRepo, "latest", 2048)
+	// 追加模式下总是下载最新的文件
+	targetFilePath := filepath.Join(t.TempDir(), "latest.img")
+	if err := fm.DownloadFile(ctx, harborRepo, "latest", targetFilePath); err != nil {
+		t.Fatal(err)
 	}
+	assertFileContent(t, targetFilePath, content)
 
-	// 创建本地文件
-	localFile, err := os.Create("/tmp/images/image")
+	versions, err := fm.ListVersions(ctx, harborRepo, "latest")
 	if err != nil {
-		fmt.Printf("os.Create: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Digest != second || versions[1].Digest != first || versions[0].Size != 2048 || versions[0].Created.IsZero() {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+
+	localFilePath, _ := writeTestFile(t, 4096)
+	if _, err = fm.UploadFileWithOptions(ctx, localFilePath, harborRepo, "latest", &UploadOptions{Versioning: VersioningReplace}); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err = fm.ListVersions(ctx, harborRepo, "latest"); err != nil || len(versions) != 1 || versions[0].Size != 4096 {
+		t.Fatalf("replace kept %+v, %v", versions, err)
+	}
+	if versions, err = fm.ListVersions(ctx, harborRepo, "missing"); err != nil || len(versions) != 0 {
+		t.Fatalf("ListVersions of a missing tag = %+v, %v", versions, err)
+	}
+}
+
+func TestConcurrentUploadsToSameTag(t *testing.T) {
+	registry := newFakeRegistry(t)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "concurrent")
+
+	// 每个写入方使用独立的客户端，模拟多个 CI 任务同时上传
+	const writers = 8
+	expected := map[digest.Digest]bool{}
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		fm := newTestFileManager(t, registry, func(config *FmConfig) {
+			config.ManifestRetries = 20
+		})
+		localFilePath, content := writeTestFile(t, 1024+i)
+		expected[digest.FromBytes(content)] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest")
+			errs <- err
+		}()
 	}
-	defer func(localFile *os.File) {
-		err = localFile.Close()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
 		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := newTestFileManager(t, registry, nil).ListVersions(ctx, harborRepo, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range versions {
+		delete(expected, version.Digest)
+	}
+	if len(expected) > 0 {
+		t.Fatalf("lost %d of %d concurrent uploads", len(expected), writers)
+	}
+}
+
+func TestConcurrentUploadsToOCILayout(t *testing.T) {
+	layoutDir := t.TempDir()
+	ctx := context.Background()
+	harborRepo := "hub.example.com/" + defaultHarborProject + "/concurrent"
 
+	// oci-layout 在锁文件保护下条件写入，不会丢失并发写入
+	const writers = 8
+	expected := map[digest.Digest]bool{}
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		fm := newTestFileManager(t, nil, func(config *FmConfig) {
+			config.BackendType = BackendOCILayout
+			config.OCILayoutDir = layoutDir
+			config.ManifestRetries = 20
+		})
+		localFilePath, content := writeTestFile(t, 1024+i)
+		expected[digest.FromBytes(content)] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
 		}
-	}(localFile)
+	}
 
-	// 将文件内容复制到本地文件
-	_, err = io.Copy(localFile, reader)
+	fm := newTestFileManager(t, nil, func(config *FmConfig) {
+		config.BackendType = BackendOCILayout
+		config.OCILayoutDir = layoutDir
+	})
+	versions, err := fm.ListVersions(ctx, harborRepo, "latest")
 	if err != nil {
-		fmt.Printf("io.Copy: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	for _, version := range versions {
+		delete(expected, version.Digest)
+	}
+	if len(expected) > 0 {
+		t.Fatalf("lost %d of %d concurrent uploads", len(expected), writers)
+	}
+	if _, err = os.Stat(filepath.Join(layoutDir, "hub.example.com", defaultHarborProject, "concurrent", "index.json.lock")); !os.IsNotExist(err) {
+		t.Fatalf("lock file should be removed, stat err: %v", err)
 	}
+}
+
+func TestManifestLineage(t *testing.T) {
+	previous := &imgspecv1.Manifest{}
+	var digests []string
+	for i := 0; i < maxLineage+3; i++ {
+		dgst := digest.FromString(strconv.Itoa(i))
+		digests = append([]string{dgst.String()}, digests...)
+		previous.Annotations = map[string]string{annotationLineage: strings.Join(lineage(previous, dgst), ",")}
+	}
+	got := strings.Split(previous.Annotations[annotationLineage], ",")
+	if len(got) != maxLineage || got[0] != digests[0] || got[maxLineage-1] != digests[maxLineage-1] {
+		t.Fatalf("unexpected lineage %v", got)
+	}
+}
 
-	fmt.Println("file downloaded from Harbor and cached locally successfully!")
+func TestManifestConflictError(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.ManifestRetries = 2
+	})
+	registry.clobberTags = true
+	localFilePath, _ := writeTestFile(t, 1024)
+	_, err := fm.UploadFile(context.Background(), localFilePath, testRepo(registry, "conflict"), "latest")
+	var conflict *ManifestConflictError
+	if !errors.Is(err, ErrManifestConflict) || !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) {
+		t.Fatalf("expected ManifestConflictError, got %v", err)
+	}
+	if conflict.Attempts != 3 || conflict.Tag != "latest" || conflict.Actual == "" {
+		t.Fatalf("unexpected conflict %+v", conflict)
+	}
 }
 
-// /Users/nieyinliang/work/vm-images/ubuntu:22.04-nvidia-535-cuda-11.img
-func TestUploadVmImages(t *testing.T) {
-	t.Parallel() // 允许并行执行
-	// 本地文件路径
-	localFilePath := "/Users/nieyinliang/work/vm-images/ubuntu:22.04-nvidia-535-cuda-11.img"
+func TestUploadFileResumesAfterFailure(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.UploadChunkSize = 64 << 10
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "resume-upload")
+	localFilePath, content := writeTestFile(t, 300<<10)
+	if err := fm.CreateRepositoryIfNotExist(ctx, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
 
-	// Harbor仓库地址和目标文件路径
-	harborRepo := defaultHarborProject + "/ubuntu-22.04-nvidia-535-cuda-11.img"
-	harborTag := "latest"
-	harborUsername := defaultHarborUserName
-	harborPassword := defaultHarborUserPassword
+	// 前两个分片成功后注入失败
+	failAfter := 2
+	backend, err := fm.getBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.backend = &failingBackend{Backend: backend, failAfter: failAfter}
+	if _, err = fm.UploadFile(ctx, localFilePath, harborRepo, "latest"); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	// 查询会话偏移量时的暂时错误不丢弃会话
+	unavailable := &RegistryError{Op: "registry upload offset", Status: http.StatusServiceUnavailable}
+	fm.backend = &offsetErrorBackend{Backend: backend, err: unavailable}
+	if _, err = fm.UploadFile(ctx, localFilePath, harborRepo, "latest"); !errors.Is(err, unavailable) {
+		t.Fatalf("expected the offset error, got %v", err)
+	}
+	fm.backend = backend
+
+	registry.mu.Lock()
+	registry.patchOffsets = nil
+	registry.mu.Unlock()
+	blobInfo, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobInfo.Digest != digest.FromBytes(content) {
+		t.Fatalf("unexpected digest %s", blobInfo.Digest)
+	}
+	registry.mu.Lock()
+	offsets := registry.patchOffsets
+	registry.mu.Unlock()
+	if len(offsets) == 0 || offsets[0] != int64(failAfter)*(64<<10) {
+		t.Fatalf("upload did not resume from offset %d, PATCH offsets: %v", failAfter*(64<<10), offsets)
+	}
+	entries, _ := os.ReadDir(filepath.Join(fm.rootCacheDir(), "uploads"))
+	if len(entries) != 0 {
+		t.Fatalf("upload journal should be removed, found %d entries", len(entries))
+	}
+}
 
-	// 初始化容器引擎
+func TestUploadReader(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.UploadChunkSize = 64 << 10
+	})
 	ctx := context.Background()
+	harborRepo := testRepo(registry, "stream")
+	content := header(200<<10+5, 0, "QFI\xfb")
 
-	hfM := SimpleNewOnce(harborUsername, harborPassword, defaultRootHarborCacheDir)
-	err := hfM.CreateRepositoryIfNotExist(ctx, harborRepo, harborTag)
+	// 长度未知的流，例如 qemu-img convert 的 stdout
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write(content)
+		_ = pw.Close()
+	}()
+	blobInfo, err := fm.UploadReader(ctx, pr, -1, harborRepo, "latest", nil)
 	if err != nil {
-		fmt.Printf("Error hfM.CreateHarborRepositoryIfNotExist: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if blobInfo.Digest != digest.FromBytes(content) || blobInfo.Size != int64(len(content)) || blobInfo.MediaType != MediaTypeQCOW2 {
+		t.Fatalf("unexpected blobInfo %+v", blobInfo)
 	}
+	targetFilePath := filepath.Join(t.TempDir(), "stream.qcow2")
+	if err = fm.DownloadFile(ctx, harborRepo, "latest", targetFilePath); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, targetFilePath, content)
+}
 
-	// 上传文件到Harbor
+func TestPutBlobStream(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.UploadChunkSize = 64 << 10
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "stream")
+	_, content := writeTestFile(t, 200<<10+5)
 
-	blobInfo, err := hfM.UploadFile(ctx, localFilePath, harborRepo, harborTag)
+	blobInfo, err := fm.putBlobStream(ctx, bytes.NewReader(content), -1, harborRepo, &progressTracker{})
 	if err != nil {
-		fmt.Printf("error hfM.UploadFile uploading file: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if blobInfo.Digest != digest.FromBytes(content) || !bytes.Equal(registry.blobs[blobInfo.Digest], content) {
+		t.Fatalf("unexpected blob %+v", blobInfo)
+	}
+	if offsets := registry.patchOffsets; len(offsets) != 4 || offsets[3] != 192<<10 {
+		t.Fatalf("unexpected chunk offsets %v", offsets)
 	}
 
-	fmt.Println("file uploaded to Harbor successfully!")
-	fmt.Println("blobInfo:", blobInfo)
+	if blobInfo, err = fm.putBlobStream(ctx, bytes.NewReader(nil), 0, harborRepo, &progressTracker{}); err != nil || blobInfo.Digest != digest.FromBytes(nil) {
+		t.Fatalf("empty stream: %+v, %v", blobInfo, err)
+	}
+	if _, err = fm.putBlobStream(ctx, bytes.NewReader(content), int64(len(content))+1, harborRepo, &progressTracker{}); err == nil {
+		t.Fatal("expected error for a stream shorter than size")
+	}
+	if _, err = fm.putBlobStream(ctx, bytes.NewReader(content), int64(len(content))-1, harborRepo, &progressTracker{}); err == nil {
+		t.Fatal("expected error for a stream longer than size")
+	}
+}
 
-	// 从Harbor下载文件
-	reader, _, err := hfM.GetDownloadReaderWithBlobDigest(ctx, harborRepo, harborTag, string(blobInfo.Digest))
+func TestUploadFileAfterServerError(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.UploadChunkSize = 64 << 10
+		// 关闭重试，验证下一次上传从记录的进度继续
+		config.Retry.MaxAttempts = 1
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "patch-failure")
+	localFilePath, content := writeTestFile(t, 200<<10)
+	if err := fm.CreateRepositoryIfNotExist(ctx, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	registry.mu.Lock()
+	registry.failPatches = 1
+	registry.mu.Unlock()
+	if _, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest"); err == nil {
+		t.Fatal("expected injected PATCH failure")
+	}
+	blobInfo, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest")
 	if err != nil {
-		fmt.Printf("Error downloading file: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if blobInfo.Digest != digest.FromBytes(content) {
+		t.Fatalf("unexpected digest %s", blobInfo.Digest)
 	}
+}
 
-	defer func(reader io.ReadCloser) {
-		err := reader.Close()
-		if err != nil {
+// failingBackend 在成功上传 failAfter 个分片后返回错误
+type failingBackend struct {
+	Backend
+	failAfter int
+	chunks    int
+}
 
-		}
-	}(reader)
+func (b *failingBackend) UploadChunk(ctx context.Context, repo, session string, src io.ReaderAt, offset, size int64) (string, error) {
+	if b.chunks >= b.failAfter {
+		return "", errors.New("injected chunk failure")
+	}
+	b.chunks++
+	return b.Backend.UploadChunk(ctx, repo, session, src, offset, size)
+}
+
+// offsetErrorBackend 查询上传会话的偏移量时总是返回 err
+type offsetErrorBackend struct {
+	Backend
+	err error
+}
 
-	// 创建目录
-	if err = os.MkdirAll("/tmp/images", os.ModePerm); err != nil {
-		return
+func (b *offsetErrorBackend) UploadOffset(context.Context, string, string) (string, int64, error) {
+	return "", 0, b.err
+}
+
+func TestDownloadFileResumesFromPartFile(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "resume-download")
+	_, content, dgst := uploadTestFile(t, fm, harborRepo, "latest", 256<<10)
+
+	targetFilePath := filepath.Join(t.TempDir(), "image")
+	if err := createFile(targetFilePath+".part", content[:100<<10]); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	registry.blobRanges = nil
+	registry.mu.Unlock()
+	if err := fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), targetFilePath); err != nil {
+		t.Fatal(err)
 	}
+	assertFileContent(t, targetFilePath, content)
+	registry.mu.Lock()
+	ranges := registry.blobRanges
+	registry.mu.Unlock()
+	if len(ranges) != 1 || ranges[0] != "bytes=102400-" {
+		t.Fatalf("expected a single ranged GET from 102400, got %v", ranges)
+	}
+}
+
+// blobErrorBackend 读取 blob 时总是返回 err，并统计读取的次数
+type blobErrorBackend struct {
+	Backend
+	err   error
+	calls int
+}
+
+func (b *blobErrorBackend) GetBlob(context.Context, string, digest.Digest, int64) (io.ReadCloser, int64, error) {
+	b.calls++
+	return nil, 0, b.err
+}
 
-	// 创建本地文件
-	localFile, err := os.Create("/tmp/images/ubuntu:22.04-nvidia-535-cuda-11.img")
+func TestDownloadFileRetriesTransientErrors(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.Retry.MaxAttempts = 3
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "flaky-download")
+	_, _, dgst := uploadTestFile(t, fm, harborRepo, "latest", 16<<10)
+	backend, err := fm.getBackend()
 	if err != nil {
-		fmt.Printf("os.Create: %v\n", err)
-		return
+		t.Fatal(err)
 	}
-	defer func(localFile *os.File) {
-		err = localFile.Close()
-		if err != nil {
 
+	for _, c := range []struct {
+		err   error
+		calls int
+	}{
+		{err: &RegistryError{Op: "get blob", Status: http.StatusServiceUnavailable}, calls: 3},
+		{err: &RegistryError{Op: "get blob", Status: http.StatusForbidden, Kind: ErrForbidden}, calls: 1},
+	} {
+		failing := &blobErrorBackend{Backend: backend, err: c.err}
+		fm.backend = failing
+		err = fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), filepath.Join(t.TempDir(), "image"))
+		if !errors.Is(err, c.err) || failing.calls != c.calls {
+			t.Fatalf("%v: expected %d attempts, got %d, %v", c.err, c.calls, failing.calls, err)
+		}
+	}
+	fm.backend = backend
+
+	// 只在一层重试，请求总数不超过 MaxAttempts
+	for _, concurrency := range []int{1, 2} {
+		fm.hifConf.DownloadConcurrency = concurrency
+		registry.mu.Lock()
+		registry.failBlobGets, registry.blobRequests = 100, 0
+		registry.mu.Unlock()
+		err = fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), filepath.Join(t.TempDir(), "image"))
+		registry.mu.Lock()
+		requests := registry.blobRequests
+		registry.failBlobGets = 0
+		registry.mu.Unlock()
+		if err == nil {
+			t.Fatal("expected the download to fail")
+		}
+		if requests > 3*concurrency {
+			t.Fatalf("concurrency %d: expected at most %d blob requests, got %d", concurrency, 3*concurrency, requests)
+		}
+	}
+}
+
+func TestDownloadFileDigestMismatch(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "corrupted")
+	_, content, dgst := uploadTestFile(t, fm, harborRepo, "latest", 64<<10)
+
+	// .part 中的前缀与远端内容不同，续传后整体校验失败
+	targetFilePath := filepath.Join(t.TempDir(), "image")
+	corrupted := bytes.Repeat([]byte{0xff}, 1024)
+	if err := createFile(targetFilePath+".part", corrupted); err != nil {
+		t.Fatal(err)
+	}
+	err := fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), targetFilePath)
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Expected != dgst {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if _, err = os.Stat(targetFilePath); !os.IsNotExist(err) {
+		t.Fatalf("target must not be created on mismatch, stat err: %v", err)
+	}
+	if _, err = os.Stat(targetFilePath + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("corrupted .part must be removed, stat err: %v", err)
+	}
+
+	// 再次下载从头开始并成功
+	if err = fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), targetFilePath); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, targetFilePath, content)
+}
+
+func TestDownloadFileParallel(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.DownloadConcurrency = 4
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "parallel")
+	_, content, dgst := uploadTestFile(t, fm, harborRepo, "latest", 1<<20+3)
+
+	registry.mu.Lock()
+	registry.blobRanges = nil
+	registry.mu.Unlock()
+	targetFilePath := filepath.Join(t.TempDir(), "image")
+	if err := fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), targetFilePath); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, targetFilePath, content)
+	registry.mu.Lock()
+	ranges := registry.blobRanges
+	registry.mu.Unlock()
+	if len(ranges) != 4 {
+		t.Fatalf("expected 4 ranged GETs, got %v", ranges)
+	}
+	for _, r := range ranges {
+		if !strings.HasPrefix(r, "bytes=") {
+			t.Fatalf("expected ranged GET, got %q", r)
 		}
-	}(localFile)
+	}
 
-	// 将文件内容复制到本地文件
-	_, err = io.Copy(localFile, reader)
+	// 并行下载失败时删除预分配的文件，不影响顺序下载留下的 .part
+	targetFilePath = filepath.Join(t.TempDir(), "image")
+	if err := createFile(targetFilePath+".part", content[:100<<10]); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := fm.getBackend()
 	if err != nil {
-		fmt.Printf("io.Copy: %v\n", err)
-		return
+		t.Fatal(err)
 	}
+	fm.backend = &rangeErrorBackend{Backend: backend, err: &RegistryError{Op: "get blob", Status: http.StatusForbidden, Kind: ErrForbidden}}
+	if err = fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), targetFilePath); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden, got %v", err)
+	}
+	fm.backend = backend
+	if _, err = os.Stat(targetFilePath + ".parallel"); !os.IsNotExist(err) {
+		t.Fatalf("parallel download file must be removed, stat err: %v", err)
+	}
+	assertFileContent(t, targetFilePath+".part", content[:100<<10])
 
-	fmt.Println("file downloaded from Harbor and cached locally successfully!")
+	// 后端不支持 Range 时退回顺序下载，从 .part 继续
+	fm.backend = &rangeErrorBackend{Backend: backend, err: fmt.Errorf("get blob range: %w", ErrRangeNotSupported)}
+	if err = fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), targetFilePath); err != nil {
+		t.Fatal(err)
+	}
+	fm.backend = backend
+	assertFileContent(t, targetFilePath, content)
 }
 
-func TestDeleteRepo(t *testing.T) {
+// rangeErrorBackend 按区间读取 blob 时总是返回 err
+type rangeErrorBackend struct {
+	Backend
+	err error
+}
 
-	harborUsername := defaultHarborUserName
-	harborPassword := defaultHarborUserPassword
+func (b *rangeErrorBackend) GetBlobRange(context.Context, string, digest.Digest, int64, int64) (io.ReadCloser, error) {
+	return nil, b.err
+}
 
-	harborRepo := defaultHarborProject + "/ubuntu-22.04-nvidia-535-cuda-11.img"
-	// 初始化容器引擎
+func TestDownloadCache(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.CacheMaxSize = 1 << 30
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "cached")
+	_, content, dgst := uploadTestFile(t, fm, harborRepo, "latest", 128<<10)
 
-	hfM := SimpleNewOnce(harborUsername, harborPassword, defaultRootHarborCacheDir)
-	err := hfM.DeleteRepo(context.Background(), harborRepo)
+	targetDir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), filepath.Join(targetDir, name)); err != nil {
+			t.Fatal(err)
+		}
+		assertFileContent(t, filepath.Join(targetDir, name), content)
+	}
+	reader, _, err := fm.GetDownloadReaderWithBlobDigest(ctx, harborRepo, "latest", dgst.String())
 	if err != nil {
-		fmt.Printf("error hfM.CreateHarborRepositoryIfNotExist: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if got := readAndClose(t, reader); !bytes.Equal(got, content) {
+		t.Fatal("cached reader content mismatch")
+	}
+	registry.mu.Lock()
+	blobGets := registry.blobGets
+	registry.mu.Unlock()
+	if blobGets != 1 {
+		t.Fatalf("expected 1 blob GET, got %d", blobGets)
 	}
 
-	fmt.Println("delete repo from Harbor successfully!")
-}
+	stats, err := fm.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 1 || stats.Size != int64(len(content)) || stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+	if err = fm.PinBlob(dgst.String()); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ = fm.CacheStats(); stats.Pinned != 1 {
+		t.Fatalf("expected 1 pinned blob, got %+v", stats)
+	}
+	if err = fm.UnpinBlob(dgst.String()); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ = fm.CacheStats(); stats.Pinned != 0 {
+		t.Fatalf("expected no pinned blob, got %+v", stats)
+	}
 
-// /Users/nieyinliang/work/vm-images/ubuntu:22.04-nvidia-535-cuda-11.img
-func TestGetLayerDigest(t *testing.T) {
-	// Harbor仓库地址和目标文件路径
-	harborRepo := defaultHarborProject + "/ubuntu-22.04-nvidia-535-cuda-11.img"
-	harborTag := "latest"
+	// 命中缓存时不覆盖之前中断的下载留下的 .part
+	target := filepath.Join(targetDir, "c")
+	if err = createFile(target+".part", content[:1024]); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), target); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(target); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected content of %s, %v", target, err)
+	}
+	if part, err := os.ReadFile(target + ".part"); err != nil || !bytes.Equal(part, content[:1024]) {
+		t.Fatalf(".part of an interrupted download must be kept, %v", err)
+	}
 
-	harborUsername := defaultHarborUserName
-	harborPassword := defaultHarborUserPassword
+	// 与缓存共享内容的下载结果被修改后，缓存不再使用
+	if err = os.WriteFile(filepath.Join(targetDir, "a"), []byte("modified"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if reader, _, err = fm.GetDownloadReaderWithBlobDigest(ctx, harborRepo, "latest", dgst.String()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAndClose(t, reader); !bytes.Equal(got, content) {
+		t.Fatal("modified cache entry must not be returned")
+	}
 
-	// 初始化容器引擎
+	// 大于 CacheMaxSize 的 blob 不缓存，也不淘汰已有的缓存
+	small := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.CacheMaxSize = 64 << 10
+	})
+	_, smallContent, smallDigest := uploadTestFile(t, small, testRepo(registry, "cached-small"), "latest", 16<<10)
+	if err = small.DownloadFileWithBlobDigest(ctx, testRepo(registry, "cached-small"), "latest", smallDigest.String(), filepath.Join(targetDir, "small")); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, filepath.Join(targetDir, "small"), smallContent)
+	if err = small.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", dgst.String(), filepath.Join(targetDir, "large")); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ = small.CacheStats(); stats.Entries != 1 || stats.Size != int64(len(smallContent)) || stats.Evictions != 0 {
+		t.Fatalf("unexpected cache stats after an oversized download %+v", stats)
+	}
+}
+
+func TestDeleteImageAndRepo(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
 	ctx := context.Background()
+	harborRepo := testRepo(registry, "to-delete")
+	uploadTestFile(t, fm, harborRepo, "v1", 1024)
 
-	hfM := SimpleNewOnce(harborUsername, harborPassword, defaultRootHarborCacheDir)
+	latestDigest, err := fm.GetLatestArtifactDigest(ctx, harborRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	tagged := registry.repos[defaultHarborProject+"/to-delete"].tags["v1"]
+	registry.mu.Unlock()
+	if latestDigest != tagged.String() {
+		t.Fatalf("GetLatestArtifactDigest = %s, want %s", latestDigest, tagged)
+	}
+	latestDigest, err = fm.GetLatestArtifactDigest(ctx, "http://"+harborRepo)
+	if err != nil || latestDigest != tagged.String() {
+		t.Fatalf("GetLatestArtifactDigest with scheme = %s, %v", latestDigest, err)
+	}
+
+	if err = fm.DeleteImage(ctx, harborRepo, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fm.GetLatestLayerDigest(ctx, harborRepo, "v1"); err == nil {
+		t.Fatal("expected deleted image to be missing")
+	}
 
-	// 从Harbor下载文件
-	digestStr, err := hfM.GetLatestLayerDigest(ctx, harborRepo, harborTag)
+	uploadTestFile(t, fm, harborRepo, "v2", 1024)
+	if err = fm.DeleteRepo(ctx, harborRepo); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	_, exists := registry.repos[defaultHarborProject+"/to-delete"]
+	registry.mu.Unlock()
+	if exists {
+		t.Fatal("repository should be deleted")
+	}
+	if err = fm.DeleteRepo(ctx, harborRepo); err == nil {
+		t.Fatal("expected error deleting a missing repository")
+	}
+}
+
+func TestListRepositories(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	// 仓库在第一次推送时创建
+	for _, name := range []string{"a", "b"} {
+		registry.putManifest(defaultHarborProject+"/"+name, "latest", imgspecv1.MediaTypeImageManifest, []byte(`{"schemaVersion": 2, "layers": []}`))
+	}
+	backend, err := fm.getBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, err := backend.ListRepositories(ctx, registry.host()+"/"+defaultHarborProject, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{testRepo(registry, "a"), testRepo(registry, "b")}
+	if strings.Join(repos, ",") != strings.Join(want, ",") {
+		t.Fatalf("ListRepositories = %v, want %v", repos, want)
+	}
+	repos, err = backend.(*harborBackend).registryBackend.ListRepositories(ctx, registry.host(), "")
 	if err != nil {
-		fmt.Printf("Error downloading file: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if strings.Join(repos, ",") != strings.Join(want, ",") {
+		t.Fatalf("_catalog ListRepositories = %v, want %v", repos, want)
+	}
+}
+
+func TestListArtifacts(t *testing.T) {
+	registry := newFakeRegistry(t)
+	ctx := context.Background()
+	name := defaultHarborProject + "/listing"
+	var digests []digest.Digest
+	for i := 1; i <= 5; i++ {
+		content := []byte(fmt.Sprintf(`{"schemaVersion": 2, "layers": [], "annotations": {"version": "%d"}}`, i))
+		registry.putManifest(name, fmt.Sprintf("v%d", i), imgspecv1.MediaTypeImageManifest, content)
+		digests = append(digests, digest.FromBytes(content))
 	}
+	registry.putManifest(name, "index", imgspecv1.MediaTypeImageIndex, []byte(`{"schemaVersion": 2, "manifests": []}`))
+	// v2 最后推送，但 ID 不是最大的
+	registry.mu.Lock()
+	registry.repos[name].manifests[digests[1]].pushTime = time.Now().Add(time.Hour)
+	registry.mu.Unlock()
 
-	fmt.Println(digestStr)
-	fmt.Println("file downloaded from Harbor and cached locally successfully!")
+	client := NewHarborClient(registry.server.URL, fakeUserName, fakePassword, nil)
+	list := func(opts *ListArtifactsOptions) ([]string, int) {
+		t.Helper()
+		artifacts := client.ListArtifacts(ctx, defaultHarborProject, "listing", opts)
+		var tags []string
+		for artifacts.Next() {
+			for _, tag := range artifacts.Artifact().Tags {
+				tags = append(tags, tag.Name)
+			}
+		}
+		if err := artifacts.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return tags, artifacts.Total()
+	}
+	for _, omitLinks := range []bool{false, true} {
+		registry.mu.Lock()
+		registry.omitLinks = omitLinks
+		registry.mu.Unlock()
+		tags, total := list(&ListArtifactsOptions{PageSize: 2, Filter: ArtifactFilter{MediaType: imgspecv1.MediaTypeImageManifest}, Sort: "-push_time"})
+		if strings.Join(tags, ",") != "v2,v5,v4,v3,v1" || total != 5 {
+			t.Fatalf("omitLinks=%v: ListArtifacts = %v, total %d", omitLinks, tags, total)
+		}
+	}
+	if tags, _ := list(&ListArtifactsOptions{Filter: ArtifactFilter{Tag: "v3"}}); strings.Join(tags, ",") != "v3" {
+		t.Fatalf("tag filter returned %v", tags)
+	}
+	if tags, _ := list(&ListArtifactsOptions{PageSize: 2, Page: 3}); strings.Join(tags, ",") != "v2,v1" {
+		t.Fatalf("page 3 returned %v", tags)
+	}
+
+	latestDigest, err := client.GetLatestArtifactDigest(ctx, defaultHarborProject, "listing")
+	if err != nil || latestDigest != digests[1].String() {
+		t.Fatalf("GetLatestArtifactDigest = %s, %v", latestDigest, err)
+	}
+	artifacts := client.ListArtifacts(ctx, defaultHarborProject, "missing", nil)
+	if artifacts.Next() || !errors.Is(artifacts.Err(), ErrNotFound) {
+		t.Fatalf("expected not found, got %v", artifacts.Err())
+	}
+
+	filter := ArtifactFilter{
+		Tag:          "~22.04",
+		LabelIDs:     []int{1, 2},
+		PushedAfter:  time.Date(2024, 1, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600)),
+		PushedBefore: time.Time{},
+	}
+	if query := filter.Query(); query != "tags=~22.04,labels=(1 2),push_time=[2024-01-01 00:00:00~]" {
+		t.Fatalf("unexpected query %q", query)
+	}
 }
 
-// /Users/nieyinliang/work/vm-images/ubuntu:22.04-nvidia-535-cuda-11.img
-func TestGetLatestArtifactDigest(t *testing.T) {
-	// Harbor仓库地址和目标文件路径
-	//harborRepo := defaultHarborProject + "/ubuntu-22.04-nvidia-535-cuda-11.img"
-	harborRepo := "https://" + defaultHarborProject + "/ubuntu-22.04-nvidia-535-cuda-11.img"
+func TestRepositoryAndTagDiscovery(t *testing.T) {
+	registry := newFakeRegistry(t)
+	ctx := context.Background()
+	ubuntu := []byte(`{"schemaVersion": 2, "layers": [], "annotations": {"os": "ubuntu"}}`)
+	registry.putManifest(defaultHarborProject+"/ubuntu", "22.04", imgspecv1.MediaTypeImageManifest, ubuntu)
+	registry.putManifest(defaultHarborProject+"/ubuntu", "latest", imgspecv1.MediaTypeImageManifest, ubuntu)
+	registry.putManifest(defaultHarborProject+"/ubuntu", "20.04", imgspecv1.MediaTypeImageManifest, []byte(`{"schemaVersion": 2, "layers": []}`))
+	registry.putManifest(defaultHarborProject+"/ubuntu-arm", "22.04", imgspecv1.MediaTypeImageManifest, ubuntu)
+	registry.putManifest(defaultHarborProject+"/fedora", "39", imgspecv1.MediaTypeImageManifest, ubuntu)
+	project := registry.host() + "/" + defaultHarborProject
+	harborRepo := testRepo(registry, "ubuntu")
 
-	harborUsername := defaultHarborUserName
-	harborPassword := defaultHarborUserPassword
+	for _, backendType := range []string{BackendHarbor, BackendRegistry} {
+		fm := newTestFileManager(t, registry, func(config *FmConfig) {
+			config.BackendType = backendType
+		})
+		repos, err := fm.ListRepositories(ctx, project, "ubuntu")
+		if err != nil || strings.Join(repos, ",") != harborRepo+","+testRepo(registry, "ubuntu-arm") {
+			t.Fatalf("%s: ListRepositories = %v, %v", backendType, repos, err)
+		}
+		tags, err := fm.ListTags(ctx, harborRepo)
+		if err != nil || strings.Join(tags, ",") != "20.04,22.04,latest" {
+			t.Fatalf("%s: ListTags = %v, %v", backendType, tags, err)
+		}
+		if tags, err = fm.ListTags(ctx, testRepo(registry, "missing")); err != nil || len(tags) != 0 {
+			t.Fatalf("%s: ListTags of a missing repository = %v, %v", backendType, tags, err)
+		}
 
-	// 初始化容器引擎
+		for _, reference := range []string{"latest", digest.FromBytes(ubuntu).String()} {
+			artifact, err := fm.GetArtifact(ctx, harborRepo, reference)
+			if err != nil {
+				t.Fatalf("%s: %v", backendType, err)
+			}
+			if artifact.Digest != digest.FromBytes(ubuntu).String() || artifact.MediaType != imgspecv1.MediaTypeImageManifest || artifact.Size != len(ubuntu) ||
+				len(artifact.Tags) != 2 || artifact.Tags[0].Name != "22.04" || artifact.Tags[1].Name != "latest" {
+				t.Fatalf("%s: unexpected artifact %+v", backendType, artifact)
+			}
+			if backendType == BackendHarbor && (len(artifact.Labels) != 1 || artifact.Labels[0].Name != "golden") {
+				t.Fatalf("unexpected labels %+v", artifact.Labels)
+			}
+		}
+		if _, err = fm.GetArtifact(ctx, harborRepo, "18.04"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: expected not found, got %v", backendType, err)
+		}
+	}
+
+	// 没有 Harbor API 时退回 registry，Harbor API 拒绝访问时直接返回错误
+	harborFM := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.BackendType = BackendHarbor
+	})
+	registry.harborAPIStatus = http.StatusNotFound
+	if repos, err := harborFM.ListRepositories(ctx, project, "ubuntu"); err != nil || strings.Join(repos, ",") != harborRepo+","+testRepo(registry, "ubuntu-arm") {
+		t.Fatalf("ListRepositories without Harbor API = %v, %v", repos, err)
+	}
+	if tags, err := harborFM.ListTags(ctx, harborRepo); err != nil || strings.Join(tags, ",") != "20.04,22.04,latest" {
+		t.Fatalf("ListTags without Harbor API = %v, %v", tags, err)
+	}
+	if artifact, err := harborFM.GetArtifact(ctx, harborRepo, "latest"); err != nil || artifact.Digest != digest.FromBytes(ubuntu).String() {
+		t.Fatalf("GetArtifact without Harbor API = %+v, %v", artifact, err)
+	}
+	registry.harborAPIStatus = http.StatusForbidden
+	if _, err := harborFM.ListRepositories(ctx, project, "ubuntu"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected forbidden from ListRepositories, got %v", err)
+	}
+	if _, err := harborFM.ListTags(ctx, harborRepo); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected forbidden from ListTags, got %v", err)
+	}
+	if _, err := harborFM.GetArtifact(ctx, harborRepo, "latest"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected forbidden from GetArtifact, got %v", err)
+	}
+	registry.harborAPIStatus = 0
+
+	client := NewHarborClient(registry.server.URL, fakeUserName, fakePassword, nil)
+	if tags, err := client.ListArtifactTags(ctx, defaultHarborProject, "ubuntu", "22.04"); err != nil || len(tags) != 2 || tags[0].Name != "22.04" || tags[1].Name != "latest" {
+		t.Fatalf("ListArtifactTags = %+v, %v", tags, err)
+	}
+
+	layoutDir := t.TempDir()
+	fm := newTestFileManager(t, nil, func(config *FmConfig) {
+		config.BackendType = BackendOCILayout
+		config.OCILayoutDir = layoutDir
+	})
+	repoDir := filepath.Join(layoutDir, "hub.example.com", defaultHarborProject, "ubuntu")
+	if err := os.MkdirAll(repoDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	index := fmt.Sprintf(`{"schemaVersion": 2, "manifests": [
+		{"mediaType": %q, "digest": %q, "size": %d, "annotations": {%q: "22.04"}},
+		{"mediaType": %q, "digest": %q, "size": %d, "annotations": {%q: "latest"}}]}`,
+		imgspecv1.MediaTypeImageManifest, digest.FromBytes(ubuntu), len(ubuntu), imgspecv1.AnnotationRefName,
+		imgspecv1.MediaTypeImageManifest, digest.FromBytes(ubuntu), len(ubuntu), imgspecv1.AnnotationRefName)
+	if err := os.WriteFile(filepath.Join(repoDir, "index.json"), []byte(index), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if repos, err := fm.ListRepositories(ctx, "hub.example.com/"+defaultHarborProject, "ubu"); err != nil || len(repos) != 1 {
+		t.Fatalf("oci-layout ListRepositories = %v, %v", repos, err)
+	}
+	artifact, err := fm.GetArtifact(ctx, "hub.example.com/"+defaultHarborProject+"/ubuntu", "latest")
+	if err != nil || artifact.Size != len(ubuntu) || len(artifact.Tags) != 2 {
+		t.Fatalf("oci-layout GetArtifact = %+v, %v", artifact, err)
+	}
+}
+
+func TestProjectLifecycle(t *testing.T) {
+	registry := newFakeRegistry(t)
 	ctx := context.Background()
+	client := NewHarborClient(registry.server.URL, fakeUserName, fakePassword, nil)
+	// 全数字的项目名需要 X-Is-Resource-Name 才不会被当作项目 ID
+	const name = "10086"
+	if _, err := client.GetProject(ctx, name); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
 
-	hfM := SimpleNewOnce(harborUsername, harborPassword, defaultRootHarborCacheDir)
+	public, autoScan, contentTrust, limit := true, true, true, int64(10<<30)
+	project, err := client.EnsureProject(ctx, name, &ProjectOptions{Public: &public, AutoScan: &autoScan, StorageLimit: &limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if project.Name != name || project.Metadata.Public != "true" || project.Metadata.AutoScan != "true" ||
+		project.Metadata.EnableContentTrust != "" || project.StorageLimit != limit {
+		t.Fatalf("unexpected project %+v", project)
+	}
 
-	// 从Harbor下载文件
-	digestStr, err := hfM.GetLatestArtifactDigest(ctx, harborRepo)
+	// 已存在时只更新给出的配置
+	project, err = client.EnsureProject(ctx, name, &ProjectOptions{ContentTrust: &contentTrust})
 	if err != nil {
-		fmt.Printf("Error downloading file: %v\n", err)
-		return
+		t.Fatal(err)
+	}
+	if project.Metadata.Public != "true" || project.Metadata.EnableContentTrust != "true" || project.StorageLimit != limit {
+		t.Fatalf("unexpected project %+v", project)
+	}
+	public, limit = false, -1
+	if err = client.UpdateProject(ctx, name, &ProjectOptions{Public: &public, StorageLimit: &limit}); err != nil {
+		t.Fatal(err)
+	}
+	registry.putManifest(name+"/ubuntu", "22.04", imgspecv1.MediaTypeImageManifest, []byte(`{"schemaVersion": 2, "layers": []}`))
+	if project, err = client.GetProject(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if project.Metadata.Public != "false" || project.Metadata.AutoScan != "true" || project.StorageLimit != -1 ||
+		project.RepoCount != 1 || project.StorageUsed == 0 {
+		t.Fatalf("unexpected project %+v", project)
 	}
 
-	fmt.Println(digestStr)
-	fmt.Println("file downloaded from Harbor and cached locally successfully!")
+	// 项目中还有仓库时不能删除
+	if err = client.DeleteProject(ctx, name); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if err = client.DeleteRepo(ctx, name, "ubuntu"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.DeleteProject(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.GetProject(ctx, name); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// 只有按名称引用项目的接口带 X-Is-Resource-Name，仓库与配额接口不带
+	registry.mu.Lock()
+	paths := registry.resourceNamePaths
+	registry.mu.Unlock()
+	if len(paths) == 0 {
+		t.Fatal("project requests must set X-Is-Resource-Name")
+	}
+	for _, path := range paths {
+		if path != "/api/v2.0/projects/"+name && path != "/api/v2.0/projects/"+name+"/summary" {
+			t.Fatalf("unexpected X-Is-Resource-Name on %s", path)
+		}
+	}
+}
+
+func TestOCILayoutBackend(t *testing.T) {
+	layoutDir := t.TempDir()
+	fm := newTestFileManager(t, nil, func(config *FmConfig) {
+		config.BackendType = BackendOCILayout
+		config.OCILayoutDir = layoutDir
+	})
+	ctx := context.Background()
+	harborRepo := "hub.example.com/" + defaultHarborProject + "/oci"
+
+	_, content, dgst := uploadTestFile(t, fm, harborRepo, "latest", 100<<10)
+	targetFilePath := filepath.Join(t.TempDir(), "image")
+	if err := fm.DownloadFile(ctx, harborRepo, "latest", targetFilePath); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, targetFilePath, content)
+	if _, err := os.Stat(filepath.Join(layoutDir, "hub.example.com", defaultHarborProject, "oci", "blobs", "sha256", dgst.Encoded())); err != nil {
+		t.Fatal(err)
+	}
+	latestDigest, err := fm.GetLatestArtifactDigest(ctx, harborRepo)
+	if err != nil || latestDigest == "" {
+		t.Fatalf("GetLatestArtifactDigest = %q, %v", latestDigest, err)
+	}
+	if err = fm.DeleteRepo(ctx, harborRepo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(layoutDir, "hub.example.com", defaultHarborProject, "oci")); !os.IsNotExist(err) {
+		t.Fatalf("repository directory should be removed, stat err: %v", err)
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://hub.example.com/service/token",service="harbor-registry",scope="repository:vmimages/a:pull"`)
+	if scheme != "Bearer" {
+		t.Fatalf("scheme = %q", scheme)
+	}
+	if params["realm"] != "https://hub.example.com/service/token" || params["service"] != "harbor-registry" || params["scope"] != "repository:vmimages/a:pull" {
+		t.Fatalf("unexpected params %v", params)
+	}
 }
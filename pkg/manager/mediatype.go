@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// 文件 layer 的媒体类型，UploadFile 根据文件头自动识别
+const (
+	MediaTypeQCOW2 = "application/vnd.wanjie.vmimage.disk.qcow2"
+	MediaTypeRaw   = "application/vnd.wanjie.vmimage.disk.raw"
+	MediaTypeVMDK  = "application/vnd.wanjie.vmimage.disk.vmdk"
+	MediaTypeVHDX  = "application/vnd.wanjie.vmimage.disk.vhdx"
+	MediaTypeISO   = "application/x-iso9660-image"
+	MediaTypeTar   = "application/x-tar"
+	MediaTypeGzip  = "application/gzip"
+	MediaTypeXz    = "application/x-xz"
+	MediaTypeZstd  = "application/zstd"
+)
+
+// sniffHeaderSize 覆盖 ISO9660 的主卷描述符(偏移 32769)
+const sniffHeaderSize = 36 << 10
+
+type magic struct {
+	offset    int
+	signature []byte
+	mediaType string
+}
+
+// magics 按优先级排列：ISO 可能同时带有 MBR(hybrid ISO)，需要先于 MBR/GPT 判断
+var magics = []magic{
+	{0, []byte("QFI\xfb"), MediaTypeQCOW2},
+	{0, []byte("vhdxfile"), MediaTypeVHDX},
+	{0, []byte("KDMV"), MediaTypeVMDK},
+	{0, []byte("# Disk DescriptorFile"), MediaTypeVMDK},
+	{0, []byte{0x1f, 0x8b}, MediaTypeGzip},
+	{0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, MediaTypeXz},
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}, MediaTypeZstd},
+	{32769, []byte("CD001"), MediaTypeISO},
+	{257, []byte("ustar"), MediaTypeTar},
+	// GPT 头位于 LBA 1，分别对应 512 与 4096 字节扇区
+	{512, []byte("EFI PART"), MediaTypeRaw},
+	{4096, []byte("EFI PART"), MediaTypeRaw},
+	{510, []byte{0x55, 0xaa}, MediaTypeRaw},
+}
+
+// DetectMediaType 根据文件头的 magic bytes 识别 qcow2、raw(MBR/GPT)、ISO9660、VMDK、VHDX、
+// tar、gzip、xz、zstd，无法识别时返回 MediaTypeVMImageLayer
+func DetectMediaType(r io.ReaderAt) (string, error) {
+	header := make([]byte, sniffHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return detectMediaType(header[:n]), nil
+}
+
+func detectMediaType(header []byte) string {
+	for _, m := range magics {
+		end := m.offset + len(m.signature)
+		if end <= len(header) && bytes.Equal(header[m.offset:end], m.signature) {
+			return m.mediaType
+		}
+	}
+	return MediaTypeVMImageLayer
+}
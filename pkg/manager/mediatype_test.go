@@ -0,0 +1,48 @@
+package manager
+
+import (
+	"bytes"
+	"testing"
+)
+
+// header 返回在 offset 处写入 signature 的 size 字节文件头
+func header(size, offset int, signature string) []byte {
+	content := make([]byte, size)
+	copy(content[offset:], signature)
+	return content
+}
+
+func TestDetectMediaType(t *testing.T) {
+	mbr := header(1024, 510, "\x55\xaa")
+	hybridISO := header(40<<10, 32769, "CD001")
+	copy(hybridISO[510:], "\x55\xaa")
+
+	for name, tc := range map[string]struct {
+		content   []byte
+		mediaType string
+	}{
+		"qcow2":      {header(512, 0, "QFI\xfb\x00\x00\x00\x03"), MediaTypeQCOW2},
+		"vhdx":       {header(512, 0, "vhdxfile"), MediaTypeVHDX},
+		"vmdk":       {header(512, 0, "KDMV"), MediaTypeVMDK},
+		"vmdk text":  {[]byte("# Disk DescriptorFile\nversion=1\n"), MediaTypeVMDK},
+		"gzip":       {[]byte{0x1f, 0x8b, 0x08, 0x00}, MediaTypeGzip},
+		"xz":         {[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, MediaTypeXz},
+		"zstd":       {[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, MediaTypeZstd},
+		"iso":        {header(40<<10, 32769, "CD001"), MediaTypeISO},
+		"hybrid iso": {hybridISO, MediaTypeISO},
+		"tar":        {header(1024, 257, "ustar\x0000"), MediaTypeTar},
+		"gpt":        {header(1024, 512, "EFI PART"), MediaTypeRaw},
+		"gpt 4k":     {header(8192, 4096, "EFI PART"), MediaTypeRaw},
+		"mbr":        {mbr, MediaTypeRaw},
+		"unknown":    {[]byte("hello"), MediaTypeVMImageLayer},
+		"empty":      {nil, MediaTypeVMImageLayer},
+	} {
+		mediaType, err := DetectMediaType(bytes.NewReader(tc.content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if mediaType != tc.mediaType {
+			t.Errorf("%s: got %s, want %s", name, mediaType, tc.mediaType)
+		}
+	}
+}
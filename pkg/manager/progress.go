@@ -0,0 +1,253 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// TransferPhase 是一次上传或下载所处的阶段
+type TransferPhase string
+
+const (
+	// PhaseHashing 上传前计算本地文件的 digest
+	PhaseHashing TransferPhase = "hashing"
+	// PhaseBlobExists 仓库中已有相同的 blob，跳过上传
+	PhaseBlobExists TransferPhase = "blob-exists"
+	PhaseUploading  TransferPhase = "uploading"
+	// PhaseCommittingManifest 写入制品 manifest
+	PhaseCommittingManifest TransferPhase = "committing-manifest"
+	// PhaseCacheHit 从本地内容缓存读取，不访问 registry
+	PhaseCacheHit    TransferPhase = "cache-hit"
+	PhaseDownloading TransferPhase = "downloading"
+	// PhaseVerifying 校验下载内容的 digest
+	PhaseVerifying TransferPhase = "verifying"
+	// PhaseDone 传输完成
+	PhaseDone TransferPhase = "done"
+)
+
+// ProgressEvent 描述一次传输的进度。每个阶段开始和结束时各上报一次，
+// 传输数据期间最多每 progressInterval 上报一次
+type ProgressEvent struct {
+	Phase  TransferPhase
+	Repo   string
+	Tag    string
+	Digest digest.Digest
+	// Transferred 本阶段已处理的字节数，包含断点续传之前已完成的部分
+	Transferred int64
+	// Total 总字节数，未知时为 -1
+	Total int64
+	// BytesPerSecond 本阶段的平均速度，不包含断点续传之前已完成的部分
+	BytesPerSecond float64
+	// ETA 预计剩余时间，未知时为 0
+	ETA time.Duration
+}
+
+// ProgressSink 接收传输进度，实现方需要尽快返回，不能阻塞传输
+type ProgressSink interface {
+	OnProgress(event ProgressEvent)
+}
+
+// ProgressFunc 把函数适配为 ProgressSink
+type ProgressFunc func(event ProgressEvent)
+
+func (f ProgressFunc) OnProgress(event ProgressEvent) {
+	f(event)
+}
+
+var progressInterval = 200 * time.Millisecond
+
+type progressKey struct{}
+
+// WithProgress 返回携带 sink 的 context，使用该 context 调用 FileManager 的上传、下载方法时上报进度，
+// 优先于 FmConfig.Progress
+func WithProgress(ctx context.Context, sink ProgressSink) context.Context {
+	return context.WithValue(ctx, progressKey{}, sink)
+}
+
+// progressSink 返回 ctx 或 FmConfig 中的 ProgressSink，都没有时返回 nil
+func (fm *fileManager) progressSink(ctx context.Context) ProgressSink {
+	if sink, ok := ctx.Value(progressKey{}).(ProgressSink); ok && sink != nil {
+		return sink
+	}
+	return fm.hifConf.Progress
+}
+
+// progressTracker 记录一次传输的进度并节流上报，sink 为 nil 时所有方法都是空操作
+type progressTracker struct {
+	sink ProgressSink
+
+	mu        sync.Mutex
+	event     ProgressEvent
+	size      int64
+	created   time.Time
+	started   time.Time
+	startedAt int64
+	reported  time.Time
+}
+
+func (fm *fileManager) newProgressTracker(ctx context.Context, repo, tag string) *progressTracker {
+	return &progressTracker{sink: fm.progressSink(ctx), event: ProgressEvent{Repo: repo, Tag: tag, Total: -1}, size: -1, created: time.Now()}
+}
+
+// setBlob 记录正在传输的 blob 及其大小，大小未知时为 -1
+func (p *progressTracker) setBlob(dgst digest.Digest, size int64) {
+	if p.sink == nil {
+		return
+	}
+	p.mu.Lock()
+	p.event.Digest = dgst
+	p.size = size
+	p.mu.Unlock()
+}
+
+// phase 进入新的阶段，transferred 是已经完成的字节数(例如续传的偏移量)，total 未知时为 -1
+func (p *progressTracker) phase(phase TransferPhase, transferred, total int64) {
+	if p.sink == nil {
+		return
+	}
+	p.mu.Lock()
+	p.event.Phase = phase
+	p.event.Transferred = transferred
+	p.event.Total = total
+	p.started = time.Now()
+	p.startedAt = transferred
+	event := p.snapshot(p.started)
+	p.mu.Unlock()
+	p.sink.OnProgress(event)
+}
+
+// set 更新本阶段已处理的字节数，只会增加，重复读取同一段数据不会重复计数
+func (p *progressTracker) set(transferred int64) {
+	if p.sink == nil {
+		return
+	}
+	p.mu.Lock()
+	if transferred <= p.event.Transferred {
+		p.mu.Unlock()
+		return
+	}
+	p.event.Transferred = transferred
+	p.report()
+}
+
+// add 增加本阶段已处理的字节数，用于并发传输
+func (p *progressTracker) add(n int64) {
+	if p.sink == nil || n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.event.Transferred += n
+	p.report()
+}
+
+// rewind 在服务端忽略 Range 从头返回数据时，把本阶段的进度清零
+func (p *progressTracker) rewind() {
+	if p.sink == nil {
+		return
+	}
+	p.mu.Lock()
+	p.event.Transferred = 0
+	p.started = time.Now()
+	p.startedAt = 0
+	p.mu.Unlock()
+}
+
+// report 在距离上次上报超过 progressInterval 时上报，调用前需要持有 p.mu，返回时释放
+func (p *progressTracker) report() {
+	now := time.Now()
+	if now.Sub(p.reported) < progressInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.reported = now
+	event := p.snapshot(now)
+	p.mu.Unlock()
+	p.sink.OnProgress(event)
+}
+
+// done 上报 PhaseDone，Transferred 与 Total 都是 blob 的大小，BytesPerSecond 是包含所有阶段的平均速度
+func (p *progressTracker) done() {
+	if p.sink == nil {
+		return
+	}
+	p.mu.Lock()
+	event := p.event
+	event.Phase = PhaseDone
+	if p.size >= 0 {
+		event.Transferred = p.size
+	}
+	event.Total = event.Transferred
+	event.BytesPerSecond = 0
+	if elapsed := time.Since(p.created).Seconds(); elapsed > 0 {
+		event.BytesPerSecond = float64(event.Transferred) / elapsed
+	}
+	event.ETA = 0
+	p.mu.Unlock()
+	p.sink.OnProgress(event)
+}
+
+func (p *progressTracker) snapshot(now time.Time) ProgressEvent {
+	event := p.event
+	if elapsed := now.Sub(p.started).Seconds(); elapsed > 0 {
+		event.BytesPerSecond = float64(event.Transferred-p.startedAt) / elapsed
+	}
+	if event.Total >= 0 && event.BytesPerSecond > 0 && event.Transferred < event.Total {
+		event.ETA = time.Duration(float64(event.Total-event.Transferred) / event.BytesPerSecond * float64(time.Second))
+	}
+	return event
+}
+
+// progressReaderAt 在读取 [0, off+n) 时把进度更新为 off+n，用于分片上传
+type progressReaderAt struct {
+	io.ReaderAt
+	tracker *progressTracker
+}
+
+func (r *progressReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.tracker.set(off + int64(n))
+	return n, err
+}
+
+// progressReader 统计经过的字节数
+type progressReader struct {
+	io.Reader
+	tracker *progressTracker
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.tracker.add(int64(n))
+	return n, err
+}
+
+// trackReader 在设置了 ProgressSink 时包装 GetDownloadReader* 返回的 reader，按调用方读取的字节数上报进度
+func (fm *fileManager) trackReader(ctx context.Context, harborRepo, tag string, dgst digest.Digest, phase TransferPhase, reader io.ReadCloser, size int64) io.ReadCloser {
+	progress := fm.newProgressTracker(ctx, harborRepo, tag)
+	if progress.sink == nil {
+		return reader
+	}
+	progress.setBlob(dgst, size)
+	progress.phase(phase, 0, size)
+	return &progressReadCloser{ReadCloser: reader, tracker: progress}
+}
+
+// progressReadCloser 用于 GetDownloadReader* 返回的 reader，读到 EOF 时上报 PhaseDone
+type progressReadCloser struct {
+	io.ReadCloser
+	tracker *progressTracker
+	once    sync.Once
+}
+
+func (r *progressReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.tracker.add(int64(n))
+	if err == io.EOF {
+		r.once.Do(r.tracker.done)
+	}
+	return n, err
+}
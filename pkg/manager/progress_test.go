@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// progressRecorder 记录收到的所有进度事件
+type progressRecorder struct {
+	mu     sync.Mutex
+	events []ProgressEvent
+}
+
+func (r *progressRecorder) OnProgress(event ProgressEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// phases 返回去掉连续重复后的阶段序列
+func (r *progressRecorder) phases() []TransferPhase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var phases []TransferPhase
+	for _, event := range r.events {
+		if len(phases) == 0 || phases[len(phases)-1] != event.Phase {
+			phases = append(phases, event.Phase)
+		}
+	}
+	return phases
+}
+
+func (r *progressRecorder) last() ProgressEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[len(r.events)-1]
+}
+
+func assertPhases(t *testing.T, recorder *progressRecorder, want ...TransferPhase) {
+	t.Helper()
+	got := recorder.phases()
+	if len(got) != len(want) {
+		t.Fatalf("got phases %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got phases %v, want %v", got, want)
+		}
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	oldInterval := progressInterval
+	progressInterval = 0
+	defer func() { progressInterval = oldInterval }()
+
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.UploadChunkSize = 64 << 10
+	})
+	harborRepo := testRepo(registry, "progress")
+	_, content := writeTestFile(t, 200<<10)
+	size := int64(len(content))
+
+	uploaded := &progressRecorder{}
+	ctx := WithProgress(context.Background(), uploaded)
+	blobInfo, err := fm.putBlobStream(ctx, bytes.NewReader(content), size, harborRepo, fm.newProgressTracker(ctx, harborRepo, "latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPhases(t, uploaded, PhaseUploading)
+	var previous int64
+	for _, event := range uploaded.events {
+		if event.Repo != harborRepo || event.Tag != "latest" || event.Total != size || event.Transferred < previous {
+			t.Fatalf("unexpected event %+v after %d bytes", event, previous)
+		}
+		previous = event.Transferred
+	}
+	if previous != size {
+		t.Fatalf("upload progress stopped at %d of %d", previous, size)
+	}
+
+	download := func(name string, want ...TransferPhase) {
+		t.Helper()
+		downloaded := &progressRecorder{}
+		targetFilePath := filepath.Join(t.TempDir(), "image")
+		if err := fm.DownloadFileWithBlobDigest(WithProgress(context.Background(), downloaded), harborRepo, "latest", blobInfo.Digest.String(), targetFilePath); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		assertFileContent(t, targetFilePath, content)
+		assertPhases(t, downloaded, want...)
+		if last := downloaded.last(); last.Digest != blobInfo.Digest || last.Transferred != size || last.Total != size {
+			t.Fatalf("%s: unexpected final event %+v", name, last)
+		}
+	}
+	download("sequential", PhaseDownloading, PhaseVerifying, PhaseDone)
+
+	fm.hifConf.DownloadConcurrency = 4
+	download("parallel", PhaseDownloading, PhaseVerifying, PhaseDone)
+
+	fm.hifConf.CacheMaxSize = 1 << 30
+	download("cache miss", PhaseDownloading, PhaseVerifying, PhaseDone)
+	download("cache hit", PhaseCacheHit, PhaseDone)
+
+	// FmConfig.Progress 对所有调用生效，reader 读到 EOF 时上报完成
+	fromConfig := &progressRecorder{}
+	fm.hifConf.Progress = fromConfig
+	reader, _, err := fm.GetDownloadReaderWithBlobDigest(context.Background(), harborRepo, "latest", blobInfo.Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	_ = reader.Close()
+	assertPhases(t, fromConfig, PhaseCacheHit, PhaseDone)
+	if last := fromConfig.last(); last.Transferred != size {
+		t.Fatalf("unexpected final reader event %+v", last)
+	}
+}
+
+func TestProgressTrackerWithoutSink(t *testing.T) {
+	fm := &fileManager{hifConf: &FmConfig{}}
+	progress := fm.newProgressTracker(context.Background(), "repo", "tag")
+	// 没有 sink 时所有方法都是空操作
+	progress.phase(PhaseUploading, 0, 10)
+	progress.set(5)
+	progress.add(5)
+	progress.done()
+	reader := fm.trackReader(context.Background(), "repo", "tag", "", PhaseDownloading, io.NopCloser(bytes.NewReader(nil)), 0)
+	if _, ok := reader.(*progressReadCloser); ok {
+		t.Fatal("reader must not be wrapped without a sink")
+	}
+}
@@ -0,0 +1,210 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Project 是 Harbor 中的一个项目
+type Project struct {
+	ProjectID    int             `json:"project_id"`
+	Name         string          `json:"name"`
+	OwnerName    string          `json:"owner_name"`
+	RepoCount    int             `json:"repo_count"`
+	CreationTime string          `json:"creation_time"`
+	UpdateTime   string          `json:"update_time"`
+	Metadata     ProjectMetadata `json:"metadata"`
+	// StorageLimit、StorageUsed 来自项目的存储配额，单位字节，StorageLimit 为 -1 表示不限制
+	StorageLimit int64 `json:"storage_limit"`
+	StorageUsed  int64 `json:"storage_used"`
+}
+
+// ProjectMetadata 是项目的配置，Harbor 以字符串 "true"/"false" 保存布尔值
+type ProjectMetadata struct {
+	Public                   string `json:"public,omitempty"`
+	AutoScan                 string `json:"auto_scan,omitempty"`
+	EnableContentTrust       string `json:"enable_content_trust,omitempty"`
+	EnableContentTrustCosign string `json:"enable_content_trust_cosign,omitempty"`
+	PreventVul               string `json:"prevent_vul,omitempty"`
+	Severity                 string `json:"severity,omitempty"`
+}
+
+// ProjectOptions 是创建或更新项目时的配置，为 nil 的字段创建时使用 Harbor 的默认值，更新时保持不变
+type ProjectOptions struct {
+	// Public 为 true 时匿名用户也可以 pull，Harbor 默认为私有
+	Public *bool
+	// StorageLimit 存储配额，单位字节，-1 表示不限制
+	StorageLimit *int64
+	// AutoScan 为 true 时推送后自动扫描漏洞
+	AutoScan *bool
+	// ContentTrust 为 true 时只允许 pull 经过 Notary 签名的制品
+	ContentTrust *bool
+	// ContentTrustCosign 为 true 时只允许 pull 经过 cosign 签名的制品
+	ContentTrustCosign *bool
+}
+
+func (o *ProjectOptions) metadata() map[string]string {
+	metadata := map[string]string{}
+	if o == nil {
+		return metadata
+	}
+	for key, value := range map[string]*bool{
+		"public":                      o.Public,
+		"auto_scan":                   o.AutoScan,
+		"enable_content_trust":        o.ContentTrust,
+		"enable_content_trust_cosign": o.ContentTrustCosign,
+	} {
+		if value != nil {
+			metadata[key] = strconv.FormatBool(*value)
+		}
+	}
+	return metadata
+}
+
+type projectQuota struct {
+	ID   int              `json:"id,omitempty"`
+	Hard map[string]int64 `json:"hard"`
+	Used map[string]int64 `json:"used,omitempty"`
+}
+
+// projectHeader 项目接口的路径中总是按名称给出项目，全数字的项目名也不能被当作项目 ID
+var projectHeader = http.Header{"X-Is-Resource-Name": {"true"}}
+
+// GetProject 返回项目的配置和存储配额，项目不存在时返回的错误满足 errors.Is(err, ErrNotFound)
+func (c *HarborClient) GetProject(ctx context.Context, projectName string) (*Project, error) {
+	project := &Project{}
+	if err := c.getJSON(ctx, "/api/v2.0/projects/"+projectName, projectHeader, "get project", projectName, project); err != nil {
+		return nil, err
+	}
+	var summary struct {
+		Quota *projectQuota `json:"quota"`
+	}
+	if err := c.getJSON(ctx, "/api/v2.0/projects/"+projectName+"/summary", projectHeader, "get project", projectName, &summary); err != nil {
+		return nil, err
+	}
+	// Harbor 关闭配额功能时不返回 quota
+	project.StorageLimit = -1
+	if summary.Quota != nil {
+		project.StorageLimit, project.StorageUsed = summary.Quota.Hard["storage"], summary.Quota.Used["storage"]
+	}
+	return project, nil
+}
+
+// EnsureProject 确保项目存在并且配置与 opts 一致：项目不存在时按 opts 创建，已存在时更新 opts 中给出的配置
+func (c *HarborClient) EnsureProject(ctx context.Context, projectName string, opts *ProjectOptions) (*Project, error) {
+	_, err := c.GetProject(ctx, projectName)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		err = c.createProject(ctx, projectName, opts)
+		if errors.Is(err, ErrConflict) {
+			// 其它客户端同时创建了该项目
+			err = c.UpdateProject(ctx, projectName, opts)
+		}
+	case err == nil:
+		err = c.UpdateProject(ctx, projectName, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.GetProject(ctx, projectName)
+}
+
+func (c *HarborClient) createProject(ctx context.Context, projectName string, opts *ProjectOptions) error {
+	body := map[string]interface{}{
+		"project_name": projectName,
+		"metadata":     opts.metadata(),
+	}
+	if opts != nil && opts.StorageLimit != nil {
+		body["storage_limit"] = *opts.StorageLimit
+	}
+	resp, err := c.doJSON(ctx, http.MethodPost, "/api/v2.0/projects", body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return newHTTPError(resp, "create project", projectName, "")
+	}
+	return nil
+}
+
+// UpdateProject 更新 opts 中给出的项目配置和存储配额，其它配置保持不变
+func (c *HarborClient) UpdateProject(ctx context.Context, projectName string, opts *ProjectOptions) error {
+	if metadata := opts.metadata(); len(metadata) > 0 {
+		resp, err := c.doJSON(ctx, http.MethodPut, "/api/v2.0/projects/"+projectName, map[string]interface{}{"metadata": metadata}, projectHeader)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = newHTTPError(resp, "update project", projectName, "")
+		}
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if opts == nil || opts.StorageLimit == nil {
+		return nil
+	}
+	return c.updateStorageLimit(ctx, projectName, *opts.StorageLimit)
+}
+
+// updateStorageLimit 通过 /quotas 接口修改项目的存储配额
+func (c *HarborClient) updateStorageLimit(ctx context.Context, projectName string, storageLimit int64) error {
+	project := &Project{}
+	if err := c.getJSON(ctx, "/api/v2.0/projects/"+projectName, projectHeader, "update project quota", projectName, project); err != nil {
+		return err
+	}
+	var quotas []projectQuota
+	if err := c.getJSON(ctx, fmt.Sprintf("/api/v2.0/quotas?reference=project&reference_id=%d", project.ProjectID), nil,
+		"update project quota", projectName, &quotas); err != nil {
+		return err
+	}
+	if len(quotas) == 0 {
+		return fmt.Errorf("update project quota %s: quota not found, the quota feature may be disabled", projectName)
+	}
+	resp, err := c.doJSON(ctx, http.MethodPut, fmt.Sprintf("/api/v2.0/quotas/%d", quotas[0].ID),
+		projectQuota{Hard: map[string]int64{"storage": storageLimit}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError(resp, "update project quota", projectName, "")
+	}
+	return nil
+}
+
+// DeleteProject 删除项目，项目中还有仓库时 Harbor 拒绝删除，返回的错误满足 errors.Is(err, ErrConflict)
+func (c *HarborClient) DeleteProject(ctx context.Context, projectName string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/v2.0/projects/"+projectName, projectHeader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError(resp, "delete project", projectName, "")
+	}
+	return nil
+}
+
+// getJSON 发送 GET 请求并把响应解码到 v，失败时返回 *RegistryError
+func (c *HarborClient) getJSON(ctx context.Context, apiPath string, header http.Header, op, repo string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, apiPath, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError(resp, op, repo, "")
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,670 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// registryClient 是一个精简的 Docker Registry HTTP API V2 客户端，
+// 用于补充 containers/image 没有暴露的能力，例如分片上传会话。
+type registryClient struct {
+	scheme      string
+	host        string
+	credentials CredentialProvider
+	client      *http.Client
+	retry       RetryPolicy
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func newRegistryClient(host string, credentials CredentialProvider) *registryClient {
+	return &registryClient{
+		scheme:      "https",
+		host:        host,
+		credentials: credentials,
+		client:      &http.Client{},
+		tokens:      map[string]string{},
+	}
+}
+
+// splitRepository 将 hub.xxxx.com/vmimages/foo 拆分为 registry 主机名和仓库路径
+func splitRepository(harborRepo string) (string, string, error) {
+	harborRepo = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(harborRepo), "https://"), "http://")
+	named, err := reference.ParseNormalizedNamed(strings.Trim(harborRepo, "/"))
+	if err != nil {
+		return "", "", err
+	}
+	return reference.Domain(named), reference.Path(named), nil
+}
+
+func repositoryScope(repo string, push bool) string {
+	if push {
+		return "repository:" + repo + ":pull,push"
+	}
+	return "repository:" + repo + ":pull"
+}
+
+// scopeRepository 返回 repository scope 中的仓库路径，其它 scope 返回空字符串
+func scopeRepository(scope string) string {
+	rest, ok := strings.CutPrefix(scope, "repository:")
+	if !ok {
+		return ""
+	}
+	repo, _, _ := strings.Cut(rest, ":")
+	return repo
+}
+
+func (c *registryClient) endpoint(path string) string {
+	return c.scheme + "://" + c.host + path
+}
+
+// resolveLocation 处理 registry 返回的相对 Location
+func (c *registryClient) resolveLocation(location string) (string, error) {
+	base, err := url.Parse(c.endpoint("/"))
+	if err != nil {
+		return "", err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(loc).String(), nil
+}
+
+func (c *registryClient) getCredentials(ctx context.Context) (Credentials, error) {
+	if c.credentials == nil {
+		return Credentials{}, nil
+	}
+	return c.credentials.Credentials(ctx, c.host)
+}
+
+// invalidateCredentials registry 拒绝了凭据，丢弃 provider 缓存的凭据，下次请求重新获取
+func (c *registryClient) invalidateCredentials() {
+	if c.credentials != nil {
+		invalidateCredentials(c.credentials, c.host)
+	}
+}
+
+func (c *registryClient) setAuthorization(req *http.Request, scope string) error {
+	c.mu.Lock()
+	token := c.tokens[scope]
+	c.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	creds, err := c.getCredentials(req.Context())
+	if err != nil {
+		return err
+	}
+	if creds.UserName != "" {
+		req.SetBasicAuth(creds.UserName, creds.Password)
+	}
+	return nil
+}
+
+// do 发送请求，GET/HEAD 请求遇到 5xx、429 或连接错误时按 retry 策略重试，其它请求只发送一次
+func (c *registryClient) do(req *http.Request, scope string) (*http.Response, error) {
+	if !idempotentMethod(req.Method) {
+		return c.doOnce(req, scope)
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doOnce(req.Clone(req.Context()), scope)
+		last := attempt >= c.retry.attempts()
+		if err != nil && (last || !isRetryable(err)) {
+			return nil, err
+		}
+		var wait time.Duration
+		if err == nil {
+			if last || !retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			wait = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		} else {
+			wait = retryAfter(err)
+		}
+		if err = c.retry.wait(req.Context(), attempt, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// doOnce 发送请求，遇到 Bearer 质询时获取 token 后重放一次请求
+func (c *registryClient) doOnce(req *http.Request, scope string) (*http.Response, error) {
+	if err := c.setAuthorization(req, scope); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	scheme, params := parseAuthChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") {
+		c.invalidateCredentials()
+		return nil, &RegistryError{Op: "registry " + c.host + " " + req.Method, Repo: scopeRepository(scope), Status: http.StatusUnauthorized, Kind: ErrUnauthorized}
+	}
+	token, err := c.fetchToken(req.Context(), params, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("registry %s: unauthorized and request body can not be replayed", c.host)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	resp, err = c.client.Do(retry)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		c.invalidateCredentials()
+	}
+	return resp, err
+}
+
+func (c *registryClient) fetchToken(ctx context.Context, params map[string]string, scope string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("registry %s: bearer challenge without realm", c.host)
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	if scope == "" {
+		scope = params["scope"]
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	creds, err := c.getCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var req *http.Request
+	if creds.IdentityToken != "" {
+		// 使用 refresh token 换取 access token
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", creds.IdentityToken)
+		form.Set("client_id", "wmimage")
+		form.Set("service", query.Get("service"))
+		form.Set("scope", query.Get("scope"))
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, tokenURL.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		tokenURL.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if creds.UserName != "" {
+			req.SetBasicAuth(creds.UserName, creds.Password)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.invalidateCredentials()
+		}
+		return "", newHTTPError(resp, "registry "+c.host+" fetch token", "", "")
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("registry %s: empty token in response", c.host)
+	}
+
+	c.mu.Lock()
+	c.tokens[scope] = token
+	c.mu.Unlock()
+	return token, nil
+}
+
+// parseAuthChallenge 解析 WWW-Authenticate 头，例如
+// Bearer realm="https://hub.xxxx.com/service/token",service="harbor-registry"
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	scheme, rest, _ := strings.Cut(header, " ")
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = strings.TrimPrefix(strings.TrimSpace(value[end+2:]), ",")
+			continue
+		}
+		value, rest, _ = strings.Cut(value, ",")
+		params[key] = strings.TrimSpace(value)
+	}
+	return scheme, params
+}
+
+func unexpectedStatus(resp *http.Response, op, repo string) error {
+	return newHTTPError(resp, "registry "+op, repo, "")
+}
+
+// statBlob 通过 HEAD 请求检查 blob 是否已存在于仓库中
+func (c *registryClient) statBlob(ctx context.Context, repo string, dgst digest.Digest) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.endpoint("/v2/"+repo+"/blobs/"+dgst.String()), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := c.do(req, repositoryScope(repo, false))
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, unexpectedStatus(resp, "stat blob", repo)
+	}
+}
+
+// startUpload 创建一个上传会话，返回会话地址
+func (c *registryClient) startUpload(ctx context.Context, repo string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint("/v2/"+repo+"/blobs/uploads/"), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req, repositoryScope(repo, true))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", unexpectedStatus(resp, "start upload", repo)
+	}
+	return c.resolveLocation(resp.Header.Get("Location"))
+}
+
+// uploadOffset 查询上传会话已经提交的字节数，返回响应中新的会话地址。
+// docker/distribution 的会话地址带有记录偏移量的 _state，偏移量与会话不一致时返回 BLOB_UPLOAD_INVALID 并取消会话
+func (c *registryClient) uploadOffset(ctx context.Context, repo, location string) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := c.do(req, repositoryScope(repo, true))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return "", 0, unexpectedStatus(resp, "get upload status", repo)
+	}
+	offset, err := parseUploadRange(resp.Header.Get("Range"))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.Header.Get("Location") != "" {
+		if location, err = c.resolveLocation(resp.Header.Get("Location")); err != nil {
+			return "", 0, err
+		}
+	}
+	return location, offset, nil
+}
+
+// parseUploadRange 解析 "0-1023" 形式的 Range 头，返回下一个待写入的偏移量
+func parseUploadRange(value string) (int64, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "bytes=")
+	if value == "" {
+		return 0, nil
+	}
+	_, end, found := strings.Cut(value, "-")
+	if !found {
+		return 0, fmt.Errorf("invalid upload range %q", value)
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid upload range %q: %w", value, err)
+	}
+	// registry 对空会话同样返回 0-0
+	if last == 0 {
+		return 0, nil
+	}
+	return last + 1, nil
+}
+
+// uploadChunk 通过 PATCH 上传 [offset, offset+size) 这一段数据，返回新的会话地址
+func (c *registryClient) uploadChunk(ctx context.Context, repo, location string, src io.ReaderAt, offset, size int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location, io.NewSectionReader(src, offset, size))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(src, offset, size)), nil
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+size-1))
+
+	resp, err := c.do(req, repositoryScope(repo, true))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", unexpectedStatus(resp, "upload chunk", repo)
+	}
+	return c.resolveLocation(resp.Header.Get("Location"))
+}
+
+// commitUpload 以 PUT ?digest= 结束上传会话
+func (c *registryClient) commitUpload(ctx context.Context, repo, location string, dgst digest.Digest) error {
+	commitURL, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := commitURL.Query()
+	query.Set("digest", dgst.String())
+	commitURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, commitURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, repositoryScope(repo, true))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return unexpectedStatus(resp, "commit upload", repo)
+	}
+	return nil
+}
+
+// getBlob 从 offset 处开始读取 blob，返回实际的起始偏移量。
+// 服务端不支持 Range 时返回完整内容，起始偏移量为 0。只发送一次请求，由调用方从已下载的位置续传重试
+func (c *registryClient) getBlob(ctx context.Context, repo string, dgst digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/v2/"+repo+"/blobs/"+dgst.String()), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.doOnce(req, repositoryScope(repo, false))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, 0, nil
+	case http.StatusPartialContent:
+		start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, 0, err
+		}
+		return resp.Body, start, nil
+	default:
+		defer resp.Body.Close()
+		return nil, 0, unexpectedStatus(resp, "get blob", repo)
+	}
+}
+
+// getBlobRange 读取 blob 的 [start, end) 区间，与 getBlob 一样只发送一次请求
+func (c *registryClient) getBlobRange(ctx context.Context, repo string, dgst digest.Digest, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/v2/"+repo+"/blobs/"+dgst.String()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := c.doOnce(req, repositoryScope(repo, false))
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		rangeStart, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err == nil && rangeStart != start {
+			err = ErrRangeNotSupported
+		}
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	case http.StatusOK:
+		_ = resp.Body.Close()
+		return nil, ErrRangeNotSupported
+	default:
+		defer resp.Body.Close()
+		return nil, unexpectedStatus(resp, "get blob range", repo)
+	}
+}
+
+// parseContentRange 解析 "bytes 100-199/1000" 形式的 Content-Range 头
+func parseContentRange(value string) (int64, int64, error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid content range %q", value)
+	}
+	rangeSpec, _, _ := strings.Cut(spec, "/")
+	startStr, endStr, found := strings.Cut(rangeSpec, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid content range %q", value)
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid content range %q: %w", value, err)
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid content range %q: %w", value, err)
+	}
+	return start, end, nil
+}
+
+// manifestAcceptTypes 查询 manifest 时接受的类型
+var manifestAcceptTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// manifestDigest 通过 HEAD 请求获取 tag 当前指向的 manifest digest
+func (c *registryClient) manifestDigest(ctx context.Context, repo, ref string) (digest.Digest, bool, error) {
+	desc, exists, err := c.manifestDescriptor(ctx, repo, ref)
+	return desc.Digest, exists, err
+}
+
+// manifestDescriptor 通过 HEAD 请求获取 ref 指向的 manifest 的 digest、媒体类型和大小
+func (c *registryClient) manifestDescriptor(ctx context.Context, repo, ref string) (imgspecv1.Descriptor, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.endpoint("/v2/"+repo+"/manifests/"+ref), nil)
+	if err != nil {
+		return imgspecv1.Descriptor{}, false, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAcceptTypes, ", "))
+	resp, err := c.do(req, repositoryScope(repo, false))
+	if err != nil {
+		return imgspecv1.Descriptor{}, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if err != nil {
+			return imgspecv1.Descriptor{}, false, fmt.Errorf("registry get manifest digest of %s:%s: %w", repo, ref, err)
+		}
+		return imgspecv1.Descriptor{MediaType: resp.Header.Get("Content-Type"), Digest: dgst, Size: resp.ContentLength}, true, nil
+	case http.StatusNotFound:
+		return imgspecv1.Descriptor{}, false, nil
+	default:
+		return imgspecv1.Descriptor{}, false, unexpectedStatus(resp, "get manifest digest", repo)
+	}
+}
+
+// deleteManifest 按 digest 删除 manifest
+func (c *registryClient) deleteManifest(ctx context.Context, repo string, dgst digest.Digest) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.endpoint("/v2/"+repo+"/manifests/"+dgst.String()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, "repository:"+repo+":delete")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		return unexpectedStatus(resp, "delete manifest", repo)
+	}
+}
+
+// listTags 通过 tags/list 获取仓库的全部 tag，仓库不存在时返回空列表
+func (c *registryClient) listTags(ctx context.Context, repo string) ([]string, error) {
+	var tags []string
+	next := "/v2/" + repo + "/tags/list?n=100"
+	for next != "" {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		link, found, err := c.getJSON(ctx, next, repositoryScope(repo, false), &page)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, nil
+		}
+		tags = append(tags, page.Tags...)
+		next = link
+	}
+	return tags, nil
+}
+
+// catalog 通过 _catalog 获取 registry 中的全部仓库
+func (c *registryClient) catalog(ctx context.Context) ([]string, error) {
+	var repos []string
+	next := "/v2/_catalog?n=100"
+	for next != "" {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		link, _, err := c.getJSON(ctx, next, "registry:catalog:*", &page)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, page.Repositories...)
+		next = link
+	}
+	return repos, nil
+}
+
+// getJSON 请求分页接口，返回 Link 头中的下一页地址
+func (c *registryClient) getJSON(ctx context.Context, path, scope string, v interface{}) (string, bool, error) {
+	target, err := c.resolveLocation(path)
+	if err != nil {
+		return "", false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := c.do(req, scope)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, unexpectedStatus(resp, "get "+path, "")
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", false, err
+	}
+	return parseNextLink(resp.Header.Get("Link")), true, nil
+}
+
+// parseNextLink 解析 `</v2/_catalog?last=b&n=100>; rel="next"` 形式的 Link 头
+func parseNextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, found := strings.Cut(link, ";")
+		if !found || !strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(target), "<>")
+	}
+	return ""
+}
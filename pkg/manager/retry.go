@@ -0,0 +1,345 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/containers/image/v5/pkg/blobinfocache"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	defaultRetryAttempts       = 4
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff     = 30 * time.Second
+)
+
+// RetryPolicy 请求遇到 5xx、429 或连接错误时的重试策略，零值使用默认值。
+// 只有可以安全重放的请求才会直接重试：GET/HEAD 以及读取 manifest、blob。
+// 上传分片失败后先查询会话已提交的偏移量再补传，写入 manifest 失败后先检查 tag 当前指向的 manifest，
+// 删除等其它请求不重试
+type RetryPolicy struct {
+	// MaxAttempts 包括第一次在内的最大尝试次数，默认 4，设为 1 关闭重试
+	MaxAttempts int
+	// InitialBackoff 第一次重试前的等待时间，默认 500ms，之后每次翻倍并加入随机抖动
+	InitialBackoff time.Duration
+	// MaxBackoff 单次等待的上限，默认 30s，服务端返回的 Retry-After 也不会超过该值
+	MaxBackoff time.Duration
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultRetryAttempts
+	}
+	return p.MaxAttempts
+}
+
+// backoff 返回第 attempt 次失败后的等待时间：服务端给出 Retry-After 时按其等待，
+// 否则为指数退避时间的一半加上随机的另一半
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	initial, limit := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if limit <= 0 {
+		limit = defaultRetryMaxBackoff
+	}
+	if retryAfter > 0 {
+		return min(retryAfter, limit)
+	}
+	delay := limit
+	if shift := attempt - 1; shift < 32 && initial<<shift < limit {
+		delay = initial << shift
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// wait 在第 attempt 次失败后等待，ctx 结束时返回其错误
+func (p RetryPolicy) wait(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	timer := time.NewTimer(p.backoff(attempt, retryAfter))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retry 执行 op，op 返回可重试的错误时等待后重新执行，op 必须可以安全重放
+func (p RetryPolicy) retry(ctx context.Context, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.attempts() || !isRetryable(err) {
+			return err
+		}
+		if waitErr := p.wait(ctx, attempt, retryAfter(err)); waitErr != nil {
+			return waitErr
+		}
+	}
+}
+
+func (fm *fileManager) retryPolicy() RetryPolicy {
+	return fm.hifConf.Retry
+}
+
+// retryableStatus 判断 HTTP 状态码是否表示暂时的失败
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// idempotentMethod 判断请求是否可以在失败后直接重放
+func idempotentMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// isRetryable 判断错误是否是暂时的：5xx、429、连接被重置或拒绝、超时
+func isRetryable(err error) bool {
+	var timeoutErr *imageTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var registryErr *RegistryError
+	if errors.As(wrapImageError(err, "", "", ""), &registryErr) {
+		return registryErr.Kind == ErrRateLimited || retryableStatus(registryErr.Status)
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// 服务端在返回响应前关闭连接
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && errors.Is(urlErr.Err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryAfter 返回错误中服务端要求的等待时间
+func retryAfter(err error) time.Duration {
+	var registryErr *RegistryError
+	if errors.As(err, &registryErr) {
+		return registryErr.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter 解析秒数或 HTTP 日期形式的 Retry-After 头
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
+
+// imageStatusPattern 匹配 containers/image 对没有 JSON 错误体的响应生成的错误，
+// 例如 StatusCode: 502, "<html>..." 以及 5xx 响应的 received unexpected HTTP status: 502 Bad Gateway
+var imageStatusPattern = regexp.MustCompile(`(?:StatusCode: |unexpected HTTP status: )(\d{3})\b`)
+
+// imageErrorStatus 返回 containers/image 错误中的 HTTP 状态码，无法得知时为 0
+func imageErrorStatus(err error) int {
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) && coder.ErrorCode() != errcode.ErrorCodeUnknown {
+		return coder.ErrorCode().Descriptor().HTTPStatusCode
+	}
+	if match := imageStatusPattern.FindStringSubmatch(err.Error()); match != nil {
+		status, _ := strconv.Atoi(match[1])
+		return status
+	}
+	return 0
+}
+
+// imageTimeoutError 表示一次 containers/image 调用超过了 Transport 中的超时时间，
+// 与 http.Client 的超时错误一样满足 net.Error 并且可以重试
+type imageTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *imageTimeoutError) Error() string {
+	return fmt.Sprintf("request timed out after %s: %v", e.timeout, e.err)
+}
+
+func (e *imageTimeoutError) Unwrap() error   { return e.err }
+func (e *imageTimeoutError) Timeout() bool   { return true }
+func (e *imageTimeoutError) Temporary() bool { return true }
+
+// withImageTimeout 执行一次 containers/image 调用，containers/image 不支持 Transport 中的超时设置，
+// 由 ctx 的截止时间代替。只是 op 超时而 ctx 本身没有结束时返回 *imageTimeoutError
+func (fm *fileManager) withImageTimeout(ctx context.Context, op func(ctx context.Context) error) error {
+	timeout := fm.hifConf.Transport.imageCallTimeout()
+	if timeout <= 0 {
+		return op(ctx)
+	}
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := op(opCtx)
+	if err != nil && ctx.Err() == nil && opCtx.Err() != nil {
+		return &imageTimeoutError{timeout: timeout, err: err}
+	}
+	return err
+}
+
+// newImageSource 创建 imageRef 的 ImageSource，连接失败时按重试策略重试
+func (fm *fileManager) newImageSource(ctx context.Context, imageRef types.ImageReference, sys *types.SystemContext) (types.ImageSource, error) {
+	var imageSource types.ImageSource
+	err := fm.retryPolicy().retry(ctx, func() error {
+		return fm.withImageTimeout(ctx, func(ctx context.Context) (err error) {
+			imageSource, err = imageRef.NewImageSource(ctx, sys)
+			return err
+		})
+	})
+	return imageSource, err
+}
+
+// getImageBlob 读取 blob，建立连接失败时按重试策略重试，读取过程中的错误由调用方处理。
+// Transport 中的超时只限制取得响应之前的时间，之后读取 blob 不受限制，reader 关闭时释放 ctx
+func (fm *fileManager) getImageBlob(ctx context.Context, imageSource types.ImageSource, blobInfo types.BlobInfo, sys *types.SystemContext) (io.ReadCloser, int64, error) {
+	var reader io.ReadCloser
+	var size int64
+	err := fm.retryPolicy().retry(ctx, func() error {
+		timeout := fm.hifConf.Transport.imageCallTimeout()
+		if timeout <= 0 {
+			var err error
+			reader, size, err = imageSource.GetBlob(ctx, blobInfo, blobinfocache.DefaultCache(sys))
+			return err
+		}
+		blobCtx, cancel := context.WithCancel(ctx)
+		timer := time.AfterFunc(timeout, cancel)
+		blobReader, blobSize, err := imageSource.GetBlob(blobCtx, blobInfo, blobinfocache.DefaultCache(sys))
+		expired := !timer.Stop()
+		if err != nil {
+			cancel()
+			if expired && ctx.Err() == nil {
+				return &imageTimeoutError{timeout: timeout, err: err}
+			}
+			return err
+		}
+		reader, size = &cancelReadCloser{ReadCloser: blobReader, cancel: cancel}, blobSize
+		return nil
+	})
+	return reader, size, err
+}
+
+// cancelReadCloser 关闭时同时释放读取使用的 ctx
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReadCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// startUpload 创建上传会话，失败时直接重试，多创建的空会话不影响仓库内容
+func startUpload(ctx context.Context, policy RetryPolicy, backend Backend, repo string) (string, error) {
+	var session string
+	err := policy.retry(ctx, func() (err error) {
+		session, err = backend.StartUpload(ctx, repo)
+		return err
+	})
+	return session, err
+}
+
+// uploadChunk 上传 src 中 [offset, offset+size) 的数据，返回后续使用的会话。PATCH 请求不能直接重放，
+// 失败后用最近一次的会话查询已经提交的偏移量，只补传缺少的部分。
+// 失败的 PATCH 实际已经生效时 registry 会拒绝并取消该会话，restartable 为 true 时创建新的会话，
+// 从 0 开始按 size 分片重新上传，此时 src 必须能读取 [0, offset+size) 的全部数据
+func uploadChunk(ctx context.Context, policy RetryPolicy, backend Backend, repo, session string, src io.ReaderAt, offset, size int64, restartable bool) (string, error) {
+	end := offset + size
+	failures := 0
+	for {
+		piece := min(end-offset, size)
+		next, err := backend.UploadChunk(ctx, repo, session, src, offset, piece)
+		if err == nil {
+			if offset += piece; offset == end {
+				return next, nil
+			}
+			session = next
+			continue
+		}
+		if failures++; failures >= policy.attempts() || !isRetryable(err) {
+			return "", err
+		}
+		if err = policy.wait(ctx, failures, retryAfter(err)); err != nil {
+			return "", err
+		}
+		next, committed, err := backend.UploadOffset(ctx, repo, session)
+		if err != nil {
+			if !restartable || !isUploadSessionLost(err) {
+				return "", err
+			}
+			if session, err = startUpload(ctx, policy, backend, repo); err != nil {
+				return "", err
+			}
+			offset = 0
+			continue
+		}
+		if committed < offset || committed > end {
+			return "", fmt.Errorf("upload session is at offset %d, expected a value between %d and %d", committed, offset, end)
+		}
+		session = next
+		if committed == end {
+			return session, nil
+		}
+		offset = committed
+	}
+}
+
+// isUploadSessionLost 判断上传会话是否已经失效：会话不存在，或者 registry 因为 _state 过期拒绝并取消了会话
+func isUploadSessionLost(err error) bool {
+	var registryErr *RegistryError
+	if errors.As(err, &registryErr) && registryErr.Code == "BLOB_UPLOAD_INVALID" {
+		return true
+	}
+	return errors.Is(err, ErrNotFound) || errors.Is(err, os.ErrNotExist)
+}
+
+// commitUpload 提交上传会话，失败后先检查 blob 是否已经写入仓库，未写入时再重新提交
+func commitUpload(ctx context.Context, policy RetryPolicy, backend Backend, repo, session string, dgst digest.Digest) error {
+	for attempt := 1; ; attempt++ {
+		err := backend.CommitUpload(ctx, repo, session, dgst)
+		if err == nil || attempt >= policy.attempts() || !isRetryable(err) {
+			return err
+		}
+		if err = policy.wait(ctx, attempt, retryAfter(err)); err != nil {
+			return err
+		}
+		_, exists, err := backend.StatBlob(ctx, repo, dgst)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, limit := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		limit *= time.Millisecond
+		if delay := policy.backoff(attempt+1, 0); delay < limit/2 || delay > limit {
+			t.Fatalf("attempt %d: backoff %s is outside [%s, %s]", attempt+1, delay, limit/2, limit)
+		}
+	}
+	if delay := policy.backoff(1, 3*time.Second); delay != time.Second {
+		t.Fatalf("Retry-After should be capped by MaxBackoff, got %s", delay)
+	}
+	if (RetryPolicy{}).attempts() != defaultRetryAttempts || (RetryPolicy{MaxAttempts: 1}).attempts() != 1 {
+		t.Fatal("unexpected attempts")
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"Mon, 01 Jan 2024 00:00:05 GMT": 5 * time.Second,
+		"soon":                          0,
+	} {
+		if actual := parseRetryAfter(value, now); actual != expected {
+			t.Fatalf("parseRetryAfter(%q) = %s, want %s", value, actual, expected)
+		}
+	}
+
+	for err, expected := range map[error]bool{
+		&RegistryError{Status: http.StatusServiceUnavailable}:                                      true,
+		&RegistryError{Status: http.StatusTooManyRequests, Kind: ErrRateLimited}:                   true,
+		&RegistryError{Status: http.StatusNotFound, Kind: ErrNotFound}:                             false,
+		fmt.Errorf("read: %w", syscall.ECONNRESET):                                                 true,
+		&url.Error{Op: "Get", URL: "http://registry", Err: io.EOF}:                                 true,
+		errors.New("received unexpected HTTP status: 502 Bad Gateway StatusCode: 502, \"<html>\""): true,
+		errors.New("uploading manifest latest: received unexpected HTTP status: 502 Bad Gateway"):  true,
+		fmt.Errorf("wrapped: %w", context.DeadlineExceeded):                                        false,
+		errors.New("digest mismatch"):                                                              false,
+	} {
+		if isRetryable(err) != expected {
+			t.Fatalf("isRetryable(%v) = %v, want %v", err, !expected, expected)
+		}
+	}
+
+	calls := 0
+	err := policy.retry(context.Background(), func() error {
+		calls++
+		return &RegistryError{Status: http.StatusBadGateway}
+	})
+	if err == nil || calls != defaultRetryAttempts {
+		t.Fatalf("expected %d calls, got %d, %v", defaultRetryAttempts, calls, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = policy.retry(ctx, func() error { return &RegistryError{Status: http.StatusBadGateway} }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRetryRegistryRequests(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "retry")
+	backend, err := fm.getBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GET/HEAD 遇到 503 时重试
+	registry.mu.Lock()
+	registry.unavailable = 2
+	registry.mu.Unlock()
+	if _, _, err = backend.StatBlob(ctx, harborRepo, digest.FromString("missing")); err != nil {
+		t.Fatal(err)
+	}
+	harborClient := NewHarborClient(registry.server.URL, fakeUserName, fakePassword, nil)
+	harborClient.Retry = fm.retryPolicy()
+	registry.mu.Lock()
+	registry.unavailable = 2
+	registry.mu.Unlock()
+	if _, err = harborClient.ListRepositories(ctx, defaultHarborProject); err != nil {
+		t.Fatal(err)
+	}
+	// 删除不重试
+	registry.mu.Lock()
+	registry.unavailable = 1
+	registry.mu.Unlock()
+	var registryErr *RegistryError
+	if err = harborClient.DeleteRepo(ctx, defaultHarborProject, "retry"); !errors.As(err, &registryErr) || registryErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", err)
+	}
+
+	// PATCH 没有生效时从会话已提交的偏移量补传，不重复发送已提交的数据；
+	// PATCH 已经生效但响应丢失时旧的 _state 被拒绝，创建新的会话从 0 按分片大小重新上传
+	content := bytes.Repeat([]byte("chunk"), 1000)
+	policy := fm.retryPolicy()
+	for _, c := range []struct {
+		name        string
+		failPatches int
+		lostPatches int
+		restartable bool
+		offsets     []int64
+	}{
+		{name: "failed", failPatches: 1, restartable: true, offsets: []int64{2000}},
+		{name: "lost", lostPatches: 1, restartable: true, offsets: []int64{2000, 0, 3000}},
+		{name: "lost stream", lostPatches: 1},
+	} {
+		session, err := startUpload(ctx, policy, backend, harborRepo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session, err = uploadChunk(ctx, policy, backend, harborRepo, session, bytes.NewReader(content), 0, 2000, c.restartable); err != nil {
+			t.Fatal(err)
+		}
+		registry.mu.Lock()
+		registry.failPatches, registry.lostPatches = c.failPatches, c.lostPatches
+		registry.patchOffsets = nil
+		registry.mu.Unlock()
+		session, err = uploadChunk(ctx, policy, backend, harborRepo, session, bytes.NewReader(content), 2000, int64(len(content))-2000, c.restartable)
+		if !c.restartable {
+			if !isUploadSessionLost(err) {
+				t.Fatalf("%s: expected the session to be rejected, got %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if err = commitUpload(ctx, policy, backend, harborRepo, session, digest.FromBytes(content)); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		registry.mu.Lock()
+		offsets := registry.patchOffsets
+		registry.mu.Unlock()
+		if fmt.Sprint(offsets) != fmt.Sprint(c.offsets) {
+			t.Fatalf("%s: unexpected PATCH offsets %v, want %v", c.name, offsets, c.offsets)
+		}
+		if !bytes.Equal(registry.blobs[digest.FromBytes(content)], content) {
+			t.Fatalf("%s: unexpected blob content", c.name)
+		}
+		delete(registry.blobs, digest.FromBytes(content))
+	}
+}
+
+func TestRetryManifestPut(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, nil)
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "lost-put")
+	localFilePath, content := writeTestFile(t, 4<<10)
+
+	// manifest 已经写入但响应丢失，重新读取 tag 后不再写入
+	registry.mu.Lock()
+	registry.lostManifestPuts = 1
+	registry.mu.Unlock()
+	if _, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	puts := registry.manifestPuts
+	registry.mu.Unlock()
+	if puts != 1 {
+		t.Fatalf("manifest was written %d times", puts)
+	}
+	versions, err := fm.ListVersions(ctx, harborRepo, "latest")
+	if err != nil || len(versions) != 1 || versions[0].Digest != digest.FromBytes(content) {
+		t.Fatalf("unexpected versions %+v, %v", versions, err)
+	}
+
+	// 读取 manifest 时遇到 503
+	registry.mu.Lock()
+	registry.unavailable = 2
+	registry.mu.Unlock()
+	if _, err = fm.GetLatestLayer(ctx, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	disk := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err = createFile(disk, header(8<<10, 0, "QFI\xfb\x00\x00\x00\x03")); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	registry.lostManifestPuts = 1
+	registry.manifestPuts = 0
+	registry.mu.Unlock()
+	layer, err := fm.PublishContainerDisk(ctx, disk, harborRepo, "disk", nil)
+	if err != nil || layer.MediaType != imgspecv1.MediaTypeImageLayer {
+		t.Fatalf("unexpected layer %+v, %v", layer, err)
+	}
+	registry.mu.Lock()
+	puts = registry.manifestPuts
+	registry.mu.Unlock()
+	if puts != 1 {
+		t.Fatalf("containerDisk manifest was written %d times", puts)
+	}
+}
+
+func TestImageRequestTimeout(t *testing.T) {
+	registry := newFakeRegistry(t)
+	fm := newTestFileManager(t, registry, func(config *FmConfig) {
+		config.Transport.DialTimeout = 100 * time.Millisecond
+		config.Transport.ResponseHeaderTimeout = 100 * time.Millisecond
+	})
+	ctx := context.Background()
+	harborRepo := testRepo(registry, "stalled")
+	localFilePath, _ := writeTestFile(t, 4<<10)
+	if _, err := fm.UploadFile(ctx, localFilePath, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// containers/image 的请求超过 DialTimeout + ResponseHeaderTimeout 后重试
+	registry.mu.Lock()
+	registry.stalledManifests = 1
+	registry.mu.Unlock()
+	start := time.Now()
+	if _, err := fm.GetLatestLayer(ctx, harborRepo, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stalled manifest request was not timed out, took %s", elapsed)
+	}
+
+	registry.mu.Lock()
+	registry.stalledManifests = defaultRetryAttempts
+	registry.mu.Unlock()
+	_, err := fm.GetLatestLayer(ctx, harborRepo, "latest")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+)
+
+// registryRouter 按 harborRepo 中的 registry 主机名选择配置，每个主机使用独立的 fileManager，
+// 未在 Registries 中配置的主机使用外层配置。RootCacheDir 相同的客户端共享同一个内容缓存
+type registryRouter struct {
+	config     *FmConfig
+	registries map[string]*FmConfig
+
+	mu       sync.Mutex
+	fallback *fileManager
+	clients  map[string]*fileManager
+	caches   map[string]*blobCache
+}
+
+func newRegistryRouter(config *FmConfig) (*registryRouter, error) {
+	r := &registryRouter{
+		config:     config,
+		registries: map[string]*FmConfig{},
+		clients:    map[string]*fileManager{},
+		caches:     map[string]*blobCache{},
+	}
+	for host, registryConfig := range config.Registries {
+		r.registries[registryHost(host)] = mergeConfig(config, registryConfig)
+	}
+	// 提前创建所有客户端，配置错误在构造时返回
+	if _, err := r.defaultClient(); err != nil {
+		return nil, err
+	}
+	for host := range r.registries {
+		if _, err := r.clientForHost(host); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// registryHost 返回 harborRepo 中的 registry 主机名（包含端口），例如
+// https://hub.xxxx.com/vmimages/ubuntu 返回 hub.xxxx.com
+func registryHost(harborRepo string) string {
+	harborRepo = strings.TrimSpace(harborRepo)
+	harborRepo = strings.TrimPrefix(strings.TrimPrefix(harborRepo, "https://"), "http://")
+	host, _, _ := strings.Cut(harborRepo, "/")
+	return strings.ToLower(host)
+}
+
+// mergeConfig 用 override 中的非零值字段覆盖 base，Transport、Retry 等嵌套结构体逐个字段合并。
+// 账号密码与 Credentials、客户端证书与私钥作为整体覆盖，避免把外层的密码、私钥用于另一个 registry
+func mergeConfig(base, override *FmConfig) *FmConfig {
+	merged := *base
+	merged.Registries = nil
+	if override == nil {
+		return &merged
+	}
+	mergeFields(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(override).Elem())
+	if override.HarborUserName != "" || override.HarborUserPassword != "" || override.Credentials != nil {
+		merged.HarborUserName = override.HarborUserName
+		merged.HarborUserPassword = override.HarborUserPassword
+		merged.Credentials = override.Credentials
+	}
+	if override.Transport.CertFile != "" || override.Transport.KeyFile != "" {
+		merged.Transport.CertFile = override.Transport.CertFile
+		merged.Transport.KeyFile = override.Transport.KeyFile
+	}
+	return &merged
+}
+
+// mergeFields 把 src 中非零值的导出字段复制到 dst，结构体字段递归合并
+func mergeFields(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		if field := src.Type().Field(i); field.Name == "Registries" || !field.IsExported() {
+			continue
+		}
+		field := src.Field(i)
+		switch {
+		case field.IsZero():
+		case field.Kind() == reflect.Struct:
+			mergeFields(dst.Field(i), field)
+		default:
+			dst.Field(i).Set(field)
+		}
+	}
+}
+
+func (r *registryRouter) newClient(config *FmConfig) (*fileManager, error) {
+	fm, err := newFileManager(config)
+	if err != nil {
+		return nil, err
+	}
+	if fm.hifConf.CacheMaxSize > 0 {
+		root := fm.rootCacheDir()
+		cache, ok := r.caches[root]
+		if !ok {
+			cache = newBlobCache(root, fm.hifConf.CacheMaxSize)
+			r.caches[root] = cache
+		}
+		fm.cache = cache
+	}
+	return fm, nil
+}
+
+func (r *registryRouter) defaultClient() (*fileManager, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fallback == nil {
+		fm, err := r.newClient(mergeConfig(r.config, nil))
+		if err != nil {
+			return nil, err
+		}
+		r.fallback = fm
+	}
+	return r.fallback, nil
+}
+
+func (r *registryRouter) clientForHost(host string) (*fileManager, error) {
+	config, ok := r.registries[host]
+	if !ok {
+		return r.defaultClient()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fm, ok := r.clients[host]
+	if !ok {
+		var err error
+		if fm, err = r.newClient(config); err != nil {
+			return nil, err
+		}
+		r.clients[host] = fm
+	}
+	return fm, nil
+}
+
+// client 返回 harborRepo 所在 registry 对应的客户端
+func (r *registryRouter) client(harborRepo string) (*fileManager, error) {
+	return r.clientForHost(registryHost(harborRepo))
+}
+
+func (r *registryRouter) CreateRepositoryIfNotExist(ctx context.Context, harborRepo, tag string) error {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return err
+	}
+	return fm.CreateRepositoryIfNotExist(ctx, harborRepo, tag)
+}
+
+func (r *registryRouter) UploadFile(ctx context.Context, localFilePath, harborRepo, tag string) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.UploadFile(ctx, localFilePath, harborRepo, tag)
+}
+
+func (r *registryRouter) UploadFileWithOptions(ctx context.Context, localFilePath, harborRepo, tag string, opts *UploadOptions) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.UploadFileWithOptions(ctx, localFilePath, harborRepo, tag, opts)
+}
+
+func (r *registryRouter) UploadReader(ctx context.Context, reader io.Reader, size int64, harborRepo, tag string, opts *UploadOptions) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.UploadReader(ctx, reader, size, harborRepo, tag, opts)
+}
+
+func (r *registryRouter) UploadFiles(ctx context.Context, localFilePaths []string, harborRepo, tag string, opts *UploadOptions) ([]types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.UploadFiles(ctx, localFilePaths, harborRepo, tag, opts)
+}
+
+func (r *registryRouter) UploadDirectory(ctx context.Context, localDir, harborRepo, tag string, opts *UploadOptions) ([]types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.UploadDirectory(ctx, localDir, harborRepo, tag, opts)
+}
+
+func (r *registryRouter) DownloadFile(ctx context.Context, harborRepo, tag, targetFilePath string) error {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return err
+	}
+	return fm.DownloadFile(ctx, harborRepo, tag, targetFilePath)
+}
+
+func (r *registryRouter) DownloadFileWithInfo(ctx context.Context, harborRepo, tag, targetFilePath string) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.DownloadFileWithInfo(ctx, harborRepo, tag, targetFilePath)
+}
+
+func (r *registryRouter) DownloadFileByName(ctx context.Context, harborRepo, tag, name, targetFilePath string) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.DownloadFileByName(ctx, harborRepo, tag, name, targetFilePath)
+}
+
+func (r *registryRouter) DownloadDirectory(ctx context.Context, harborRepo, tag, targetDir string) ([]types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.DownloadDirectory(ctx, harborRepo, tag, targetDir)
+}
+
+func (r *registryRouter) PublishContainerDisk(ctx context.Context, localDiskPath, harborRepo, tag string, opts *ContainerDiskOptions) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.PublishContainerDisk(ctx, localDiskPath, harborRepo, tag, opts)
+}
+
+func (r *registryRouter) ImportContainerDisk(ctx context.Context, harborRepo, tag, targetFilePath string, opts *ContainerDiskOptions) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.ImportContainerDisk(ctx, harborRepo, tag, targetFilePath, opts)
+}
+
+func (r *registryRouter) GetDownloadReader(ctx context.Context, harborRepo, tag string) (io.ReadCloser, int64, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fm.GetDownloadReader(ctx, harborRepo, tag)
+}
+
+func (r *registryRouter) DownloadFileWithBlobDigest(ctx context.Context, harborRepo, tag, digestStr, targetFilePath string) error {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return err
+	}
+	return fm.DownloadFileWithBlobDigest(ctx, harborRepo, tag, digestStr, targetFilePath)
+}
+
+func (r *registryRouter) GetDownloadReaderWithBlobDigest(ctx context.Context, harborRepo, tag, digestStr string) (io.ReadCloser, int64, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fm.GetDownloadReaderWithBlobDigest(ctx, harborRepo, tag, digestStr)
+}
+
+func (r *registryRouter) DownloadFileWithBlob(ctx context.Context, harborRepo, tag, targetFilePath string, blobInfo *types.BlobInfo) error {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return err
+	}
+	return fm.DownloadFileWithBlob(ctx, harborRepo, tag, targetFilePath, blobInfo)
+}
+
+func (r *registryRouter) GetDownloadReaderWithBlob(ctx context.Context, harborRepo, tag string, blobInfo *types.BlobInfo) (io.ReadCloser, int64, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fm.GetDownloadReaderWithBlob(ctx, harborRepo, tag, blobInfo)
+}
+
+func (r *registryRouter) DeleteImage(ctx context.Context, harborRepo, tag string) error {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return err
+	}
+	return fm.DeleteImage(ctx, harborRepo, tag)
+}
+
+func (r *registryRouter) DeleteRepo(ctx context.Context, harborRepo string) error {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return err
+	}
+	return fm.DeleteRepo(ctx, harborRepo)
+}
+
+func (r *registryRouter) GetLatestLayerDigest(ctx context.Context, harborRepo, tag string) (string, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return "", err
+	}
+	return fm.GetLatestLayerDigest(ctx, harborRepo, tag)
+}
+
+func (r *registryRouter) GetLatestLayer(ctx context.Context, harborRepo, tag string) (*types.BlobInfo, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.GetLatestLayer(ctx, harborRepo, tag)
+}
+
+func (r *registryRouter) ListVersions(ctx context.Context, harborRepo, tag string) ([]Version, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.ListVersions(ctx, harborRepo, tag)
+}
+
+func (r *registryRouter) GetLatestArtifactDigest(ctx context.Context, harborRepo string) (string, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return "", err
+	}
+	return fm.GetLatestArtifactDigest(ctx, harborRepo)
+}
+
+func (r *registryRouter) GetBlobDigest(ctx context.Context, harborRepo, tag string) (string, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return "", err
+	}
+	return fm.GetBlobDigest(ctx, harborRepo, tag)
+}
+
+func (r *registryRouter) ListTags(ctx context.Context, harborRepo string) ([]string, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.ListTags(ctx, harborRepo)
+}
+
+func (r *registryRouter) ListRepositories(ctx context.Context, project, filter string) ([]string, error) {
+	fm, err := r.client(project)
+	if err != nil {
+		return nil, err
+	}
+	return fm.ListRepositories(ctx, project, filter)
+}
+
+func (r *registryRouter) GetArtifact(ctx context.Context, harborRepo, reference string) (*Artifact, error) {
+	fm, err := r.client(harborRepo)
+	if err != nil {
+		return nil, err
+	}
+	return fm.GetArtifact(ctx, harborRepo, reference)
+}
+
+// CacheStats、PinBlob、UnpinBlob 作用于外层 RootCacheDir 的内容缓存
+func (r *registryRouter) CacheStats() (CacheStats, error) {
+	fm, err := r.defaultClient()
+	if err != nil {
+		return CacheStats{}, err
+	}
+	return fm.CacheStats()
+}
+
+func (r *registryRouter) PinBlob(digestStr string) error {
+	fm, err := r.defaultClient()
+	if err != nil {
+		return err
+	}
+	return fm.PinBlob(digestStr)
+}
+
+func (r *registryRouter) UnpinBlob(digestStr string) error {
+	fm, err := r.defaultClient()
+	if err != nil {
+		return err
+	}
+	return fm.UnpinBlob(digestStr)
+}
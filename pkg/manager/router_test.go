@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewReturnsIndependentClients(t *testing.T) {
+	first, err := New(&FmConfig{HarborUserName: "a", RootCacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := New(&FmConfig{HarborUserName: "b", RootCacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("New must return a new client on every call")
+	}
+	if first.(*fileManager).hifConf.HarborUserName != "a" || second.(*fileManager).hifConf.HarborUserName != "b" {
+		t.Fatal("clients must keep their own config")
+	}
+	if _, err = New(&FmConfig{BackendType: "unknown"}); err == nil {
+		t.Fatal("expected error for unknown backend type")
+	}
+	if _, err = New(nil); err == nil {
+		t.Fatal("expected error for nil config")
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	base := &FmConfig{
+		HarborUserName:     "prod",
+		HarborUserPassword: "prod-secret",
+		RootCacheDir:       "/var/cache/vmimage",
+		UploadChunkSize:    1 << 20,
+	}
+	merged := mergeConfig(base, &FmConfig{HarborUserName: "staging", DownloadConcurrency: 4})
+	if merged.HarborUserName != "staging" || merged.HarborUserPassword != "" {
+		t.Fatalf("credentials must be overridden as a pair, got %q/%q", merged.HarborUserName, merged.HarborUserPassword)
+	}
+	if merged.RootCacheDir != base.RootCacheDir || merged.UploadChunkSize != base.UploadChunkSize || merged.DownloadConcurrency != 4 {
+		t.Fatalf("unexpected merged config %+v", merged)
+	}
+
+	// 只覆盖 Transport、Retry 中的部分字段时其余字段沿用外层配置
+	base.Transport = TransportConfig{CAFile: "/etc/vmimage/ca.pem", CertFile: "prod.crt", KeyFile: "prod.key", InsecureRegistries: []string{"lab.example.com"}}
+	base.Retry = RetryPolicy{MaxAttempts: 6, InitialBackoff: time.Second}
+	merged = mergeConfig(base, &FmConfig{Transport: TransportConfig{Proxy: "http://proxy.example.com:3128"}, Retry: RetryPolicy{MaxAttempts: 2}})
+	if merged.Transport.Proxy != "http://proxy.example.com:3128" || merged.Transport.CAFile != base.Transport.CAFile ||
+		merged.Transport.CertFile != "prod.crt" || strings.Join(merged.Transport.InsecureRegistries, ",") != "lab.example.com" {
+		t.Fatalf("unexpected merged transport %+v", merged.Transport)
+	}
+	if merged.Retry.MaxAttempts != 2 || merged.Retry.InitialBackoff != time.Second {
+		t.Fatalf("unexpected merged retry %+v", merged.Retry)
+	}
+	merged = mergeConfig(base, &FmConfig{Transport: TransportConfig{CertFile: "staging.crt"}})
+	if merged.Transport.CertFile != "staging.crt" || merged.Transport.KeyFile != "" || merged.Transport.CAFile != base.Transport.CAFile {
+		t.Fatalf("client certificate and key must be overridden as a pair, got %+v", merged.Transport)
+	}
+
+	if registryHost("https://Hub.Example.com:8443/vmimages/a") != "hub.example.com:8443" {
+		t.Fatal("registryHost must keep the port and lower-case the host")
+	}
+}
+
+func TestRegistryRouter(t *testing.T) {
+	prod := newFakeRegistry(t)
+	staging := newFakeRegistry(t)
+	staging.username, staging.password = "staging", "staging-secret"
+
+	router, err := newRegistryRouter(&FmConfig{
+		HarborUserName:     prod.username,
+		HarborUserPassword: prod.password,
+		RootCacheDir:       t.TempDir(),
+		Transport:          TransportConfig{PlainHTTPRegistries: []string{prod.host(), staging.host()}},
+		Registries: map[string]*FmConfig{
+			"http://" + staging.host(): {
+				HarborUserName:     staging.username,
+				HarborUserPassword: staging.password,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, registry := range []*fakeRegistry{prod, staging} {
+		harborRepo := testRepo(registry, "routed")
+		localFilePath, content := writeTestFile(t, 4096)
+		if err = router.CreateRepositoryIfNotExist(ctx, harborRepo, "latest"); err != nil {
+			t.Fatalf("%s: %v", registry.host(), err)
+		}
+		blobInfo, err := router.UploadFile(ctx, localFilePath, harborRepo, "latest")
+		if err != nil {
+			t.Fatalf("%s: %v", registry.host(), err)
+		}
+		targetFilePath := filepath.Join(t.TempDir(), "image")
+		if err = router.DownloadFileWithBlobDigest(ctx, harborRepo, "latest", blobInfo.Digest.String(), targetFilePath); err != nil {
+			t.Fatalf("%s: %v", registry.host(), err)
+		}
+		assertFileContent(t, targetFilePath, content)
+	}
+	if _, ok := prod.repos[defaultHarborProject+"/routed"]; !ok {
+		t.Fatal("prod registry did not receive the upload")
+	}
+	if _, ok := staging.repos[defaultHarborProject+"/routed"]; !ok {
+		t.Fatal("staging registry did not receive the upload")
+	}
+}
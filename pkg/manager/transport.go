@@ -0,0 +1,237 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultDialTimeout = 30 * time.Second
+
+// TransportConfig 描述访问 registry 和 Harbor REST API 的网络配置，
+// containers/image 与 REST 请求使用同一份配置，containers/image 不支持的部分在字段上说明
+type TransportConfig struct {
+	// CAFile PEM 格式的 CA 证书，追加到系统根证书之后
+	CAFile string
+	// CertFile、KeyFile 客户端证书和私钥，用于 mTLS
+	CertFile string
+	KeyFile  string
+	// CertDir docker certs.d 格式的证书目录：*.crt 为 CA，*.cert/*.key 为客户端证书
+	CertDir string
+	// InsecureRegistries 跳过证书校验的 registry，元素为 host 或 host:port
+	InsecureRegistries []string
+	// PlainHTTPRegistries 使用 http 访问的 registry，元素为 host 或 host:port。
+	// REST 请求直接使用 http；containers/image 只有在跳过证书校验时才会在 https 失败后退回到 http，
+	// 因此读写镜像时这些 registry 同时跳过证书校验，就像也列在 InsecureRegistries 中一样
+	PlainHTTPRegistries []string
+	// Proxy 代理地址，例如 http://proxy.xxxx.com:3128，为空时使用 HTTP_PROXY/HTTPS_PROXY 环境变量。
+	// 只对 REST 请求生效，containers/image 始终使用 HTTP_PROXY/HTTPS_PROXY 环境变量
+	Proxy string
+	// DialTimeout 建立 TCP 连接的超时时间，默认 30s
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout 等待响应头的超时时间，0 表示不限制。
+	// containers/image 没有对应的设置，读写镜像时每次调用的 ctx 截止时间为 DialTimeout + ResponseHeaderTimeout，
+	// 读取 blob 时只限制取得响应之前的时间
+	ResponseHeaderTimeout time.Duration
+}
+
+// matchRegistry 判断 host 是否在列表中，列表元素不带端口时匹配该主机的所有端口
+func matchRegistry(registries []string, host string) bool {
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, registry := range registries {
+		registry = registryHost(registry)
+		if registry == host || registry == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TransportConfig) isInsecure(host string) bool {
+	return matchRegistry(t.InsecureRegistries, host)
+}
+
+func (t *TransportConfig) isPlainHTTP(host string) bool {
+	return matchRegistry(t.PlainHTTPRegistries, host)
+}
+
+// scheme 返回访问 host 使用的协议
+func (t *TransportConfig) scheme(host string) string {
+	if t.isPlainHTTP(host) {
+		return "http"
+	}
+	return "https"
+}
+
+func (t *TransportConfig) dialTimeout() time.Duration {
+	if t.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return t.DialTimeout
+}
+
+// imageCallTimeout 返回一次 containers/image 调用的超时时间，0 表示不限制
+func (t *TransportConfig) imageCallTimeout() time.Duration {
+	if t.ResponseHeaderTimeout <= 0 {
+		return 0
+	}
+	return t.dialTimeout() + t.ResponseHeaderTimeout
+}
+
+func (t *TransportConfig) proxyURL() (*url.URL, error) {
+	if t.Proxy == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(t.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", t.Proxy, err)
+	}
+	return proxyURL, nil
+}
+
+// tlsConfig 创建访问 host 使用的 TLS 配置
+func (t *TransportConfig) tlsConfig(host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.isInsecure(host),
+	}
+	var caFiles []string
+	var keyPairs [][2]string
+	if t.CAFile != "" {
+		caFiles = append(caFiles, t.CAFile)
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("both CertFile and KeyFile are required for client certificate")
+		}
+		keyPairs = append(keyPairs, [2]string{t.CertFile, t.KeyFile})
+	}
+	if t.CertDir != "" {
+		entries, err := os.ReadDir(t.CertDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			switch {
+			case strings.HasSuffix(name, ".crt"):
+				caFiles = append(caFiles, filepath.Join(t.CertDir, name))
+			case strings.HasSuffix(name, ".cert"):
+				keyPairs = append(keyPairs, [2]string{
+					filepath.Join(t.CertDir, name),
+					filepath.Join(t.CertDir, strings.TrimSuffix(name, ".cert")+".key"),
+				})
+			}
+		}
+	}
+
+	if len(caFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range caFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	for _, pair := range keyPairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	return tlsConfig, nil
+}
+
+// httpClient 创建访问 host 使用的 http.Client
+func (t *TransportConfig) httpClient(host string) (*http.Client, error) {
+	tlsConfig, err := t.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	proxyURL, err := t.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = (&net.Dialer{Timeout: t.dialTimeout(), KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSClientConfig = tlsConfig
+	transport.ResponseHeaderTimeout = t.ResponseHeaderTimeout
+	return &http.Client{Transport: transport}, nil
+}
+
+// dockerCertPath 返回 containers/image 使用的证书目录。containers/image 只接受目录，
+// 配置了 CAFile/CertFile/KeyFile 时在 rootCacheDir/certs 下创建指向这些文件的符号链接
+func (t *TransportConfig) dockerCertPath(rootCacheDir string) (string, error) {
+	if t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" {
+		return t.CertDir, nil
+	}
+	links := map[string]string{}
+	if t.CAFile != "" {
+		links["ca.crt"] = t.CAFile
+	}
+	if t.CertFile != "" {
+		links["client.cert"] = t.CertFile
+	}
+	if t.KeyFile != "" {
+		links["client.key"] = t.KeyFile
+	}
+	if t.CertDir != "" {
+		entries, err := os.ReadDir(t.CertDir)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range entries {
+			if _, exists := links[entry.Name()]; !exists {
+				links[entry.Name()] = filepath.Join(t.CertDir, entry.Name())
+			}
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{t.CAFile, t.CertFile, t.KeyFile, t.CertDir}, "\n")))
+	certDir := filepath.Join(rootCacheDir, "certs", hex.EncodeToString(sum[:8]))
+	if err := createDirectorIfNotExist(certDir); err != nil {
+		return "", err
+	}
+	for name, target := range links {
+		target, err := filepath.Abs(target)
+		if err != nil {
+			return "", err
+		}
+		linkPath := filepath.Join(certDir, name)
+		if current, err := os.Readlink(linkPath); err == nil && current == target {
+			continue
+		}
+		_ = os.Remove(linkPath)
+		if err = os.Symlink(target, linkPath); err != nil {
+			return "", err
+		}
+	}
+	return certDir, nil
+}
@@ -0,0 +1,237 @@
+package manager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+)
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serverHost(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func get(client *http.Client, rawURL string) error {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestMatchRegistry(t *testing.T) {
+	registries := []string{"hub.example.com", "dev.example.com:5000", "https://Lab.Example.com"}
+	for host, expected := range map[string]bool{
+		"hub.example.com":      true,
+		"hub.example.com:8443": true,
+		"dev.example.com:5000": true,
+		"dev.example.com":      false,
+		"dev.example.com:5001": false,
+		"lab.example.com":      true,
+		"other.example.com":    false,
+	} {
+		if got := matchRegistry(registries, host); got != expected {
+			t.Errorf("matchRegistry(%q) = %v, want %v", host, got, expected)
+		}
+	}
+	transport := &TransportConfig{PlainHTTPRegistries: []string{"dev.example.com:5000"}}
+	if transport.scheme("dev.example.com:5000") != "http" || transport.scheme("hub.example.com") != "https" {
+		t.Fatal("unexpected scheme")
+	}
+}
+
+func TestTransportCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer server.Close()
+	host := serverHost(t, server)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+
+	client, err := (&TransportConfig{}).httpClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = get(client, server.URL); err == nil {
+		t.Fatal("expected certificate verification to fail without CAFile")
+	}
+	client, err = (&TransportConfig{CAFile: caFile}).httpClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = get(client, server.URL); err != nil {
+		t.Fatalf("request with CAFile: %v", err)
+	}
+	client, err = (&TransportConfig{InsecureRegistries: []string{host}}).httpClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = get(client, server.URL); err != nil {
+		t.Fatalf("request to insecure registry: %v", err)
+	}
+}
+
+func TestTransportClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vmimage-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.cert"), filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", certDER)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	clientCA, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+	host := serverHost(t, server)
+
+	client, err := (&TransportConfig{InsecureRegistries: []string{host}}).httpClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = get(client, server.URL); err == nil {
+		t.Fatal("expected handshake to fail without client certificate")
+	}
+	for _, transport := range []*TransportConfig{
+		{InsecureRegistries: []string{host}, CertFile: certFile, KeyFile: keyFile},
+		{InsecureRegistries: []string{host}, CertDir: dir},
+	} {
+		client, err = transport.httpClient(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = get(client, server.URL); err != nil {
+			t.Fatalf("request with client certificate: %v", err)
+		}
+	}
+	if _, err = (&TransportConfig{CertFile: certFile}).httpClient(host); err == nil {
+		t.Fatal("expected error when KeyFile is missing")
+	}
+}
+
+func TestTransportProxyAndTimeout(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied <- req.URL.String()
+	}))
+	defer proxy.Close()
+
+	client, err := (&TransportConfig{Proxy: proxy.URL}).httpClient("hub.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = get(client, "http://hub.example.com/v2/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-proxied; got != "http://hub.example.com/v2/" {
+		t.Fatalf("proxy received %q", got)
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	client, err = (&TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond}).httpClient(serverHost(t, slow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = get(client, slow.URL); err == nil {
+		t.Fatal("expected response header timeout")
+	}
+}
+
+func TestDockerCertPath(t *testing.T) {
+	root := t.TempDir()
+	transport := &TransportConfig{CertDir: "/etc/docker/certs.d/hub.example.com"}
+	certPath, err := transport.dockerCertPath(root)
+	if err != nil || certPath != transport.CertDir {
+		t.Fatalf("dockerCertPath = %q, %v", certPath, err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "lab-ca.pem")
+	if err = createFile(caFile, []byte("ca")); err != nil {
+		t.Fatal(err)
+	}
+	transport = &TransportConfig{CAFile: caFile}
+	certPath, err = transport.dockerCertPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 再次调用复用已有的符号链接
+	if again, err := transport.dockerCertPath(root); err != nil || again != certPath {
+		t.Fatalf("dockerCertPath is not stable: %q, %v", again, err)
+	}
+	target, err := os.Readlink(filepath.Join(certPath, "ca.crt"))
+	if err != nil || target != caFile {
+		t.Fatalf("ca.crt links to %q, %v", target, err)
+	}
+
+	fm := newTestFileManager(t, nil, func(config *FmConfig) {
+		config.Transport = TransportConfig{
+			CAFile:              caFile,
+			PlainHTTPRegistries: []string{"dev.example.com:5000"},
+			Proxy:               "http://proxy.example.com:3128",
+		}
+	})
+	sys, err := fm.systemContext(context.Background(), "dev.example.com:5000/vmimages/ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sys.DockerInsecureSkipTLSVerify != types.OptionalBoolTrue || sys.DockerCertPath == "" {
+		t.Fatalf("unexpected SystemContext %+v", sys)
+	}
+	if sys, err = fm.systemContext(context.Background(), "hub.example.com/vmimages/ubuntu"); err != nil || sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue {
+		t.Fatalf("hub.example.com must verify certificates, got %+v, %v", sys, err)
+	}
+}
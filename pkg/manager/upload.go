@@ -0,0 +1,301 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const defaultUploadChunkSize = 32 << 20
+
+// uploadJournal 记录一次分片上传的进度，用于失败后断点续传
+type uploadJournal struct {
+	FilePath  string        `json:"filePath"`
+	Size      int64         `json:"size"`
+	ModTime   time.Time     `json:"modTime"`
+	Digest    digest.Digest `json:"digest"`
+	Reference string        `json:"reference"`
+	Location  string        `json:"location"`
+	Offset    int64         `json:"offset"`
+}
+
+func (fm *fileManager) rootCacheDir() string {
+	if fm.hifConf.RootCacheDir == "" {
+		return defaultRootHarborCacheDir
+	}
+	return fm.hifConf.RootCacheDir
+}
+
+func (fm *fileManager) uploadChunkSize() int64 {
+	if fm.hifConf.UploadChunkSize <= 0 {
+		return defaultUploadChunkSize
+	}
+	return fm.hifConf.UploadChunkSize
+}
+
+func uploadJournalPath(rootCacheDir, filePath, destRef string) string {
+	sum := sha256.Sum256([]byte(filePath + "\n" + destRef))
+	return filepath.Join(rootCacheDir, "uploads", hex.EncodeToString(sum[:])+".json")
+}
+
+func loadUploadJournal(journalPath string) (*uploadJournal, error) {
+	content, err := os.ReadFile(journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	journal := &uploadJournal{}
+	if err = json.Unmarshal(content, journal); err != nil {
+		// 日志损坏时当作不存在，重新上传
+		return nil, nil
+	}
+	return journal, nil
+}
+
+func saveUploadJournal(journalPath string, journal *uploadJournal) error {
+	if err := createDirectorIfNotExist(filepath.Dir(journalPath)); err != nil {
+		return err
+	}
+	content, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	tmpPath := journalPath + ".tmp"
+	if err = os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, journalPath)
+}
+
+// putBlobResumable 以分片方式上传本地文件，进度记录在 RootCacheDir/uploads 下，
+// 同一文件对同一 repo:tag 的重试会从上次提交的偏移量继续
+func (fm *fileManager) putBlobResumable(ctx context.Context, localFile *os.File, fileInfo os.FileInfo, harborRepo, tag string, progress *progressTracker) (types.BlobInfo, error) {
+	backend, err := fm.getBackend()
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+
+	filePath, err := filepath.Abs(localFile.Name())
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	destRef := harborRepo + ":" + tag
+	journalPath := uploadJournalPath(fm.rootCacheDir(), filePath, destRef)
+
+	journal, err := loadUploadJournal(journalPath)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	// 文件发生变化后，之前的进度作废
+	if journal != nil && (journal.Size != fileInfo.Size() || !journal.ModTime.Equal(fileInfo.ModTime()) || journal.Reference != destRef) {
+		journal = nil
+	}
+	if journal == nil {
+		progress.phase(PhaseHashing, 0, fileInfo.Size())
+		fileDigest, err := digest.FromReader(&progressReader{Reader: io.NewSectionReader(localFile, 0, fileInfo.Size()), tracker: progress})
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		journal = &uploadJournal{
+			FilePath:  filePath,
+			Size:      fileInfo.Size(),
+			ModTime:   fileInfo.ModTime(),
+			Digest:    fileDigest,
+			Reference: destRef,
+		}
+	}
+	blobInfo := types.BlobInfo{Digest: journal.Digest, Size: journal.Size}
+	progress.setBlob(journal.Digest, journal.Size)
+
+	// 仓库中已有该 blob，直接复用
+	_, exists, err := backend.StatBlob(ctx, harborRepo, journal.Digest)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	if exists {
+		progress.phase(PhaseBlobExists, journal.Size, journal.Size)
+		_ = os.Remove(journalPath)
+		return blobInfo, nil
+	}
+
+	if journal.Location != "" {
+		location, offset, err := backend.UploadOffset(ctx, harborRepo, journal.Location)
+		switch {
+		case isUploadSessionLost(err):
+			// 会话已过期，重新开始
+			journal.Location = ""
+			journal.Offset = 0
+		case err != nil:
+			// 暂时的错误保留会话，下次继续续传
+			return types.BlobInfo{}, err
+		default:
+			journal.Location = location
+			journal.Offset = offset
+		}
+	}
+	if journal.Location == "" {
+		location, err := startUpload(ctx, fm.retryPolicy(), backend, harborRepo)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		journal.Location = location
+		journal.Offset = 0
+	}
+	if err = saveUploadJournal(journalPath, journal); err != nil {
+		return types.BlobInfo{}, err
+	}
+
+	progress.phase(PhaseUploading, journal.Offset, journal.Size)
+	src := &progressReaderAt{ReaderAt: localFile, tracker: progress}
+	chunkSize := fm.uploadChunkSize()
+	for journal.Offset < journal.Size {
+		if err = ctx.Err(); err != nil {
+			return types.BlobInfo{}, err
+		}
+		size := chunkSize
+		if remaining := journal.Size - journal.Offset; remaining < size {
+			size = remaining
+		}
+		location, err := uploadChunk(ctx, fm.retryPolicy(), backend, harborRepo, journal.Location, src, journal.Offset, size, true)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		journal.Location = location
+		journal.Offset += size
+		if err = saveUploadJournal(journalPath, journal); err != nil {
+			return types.BlobInfo{}, err
+		}
+	}
+
+	if err = commitUpload(ctx, fm.retryPolicy(), backend, harborRepo, journal.Location, journal.Digest); err != nil {
+		return types.BlobInfo{}, err
+	}
+	if err = os.Remove(journalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return types.BlobInfo{}, err
+	}
+	return blobInfo, nil
+}
+
+// UploadReader 把 r 中的内容以流的方式上传到 harborRepo:tag，不需要先落盘，
+// 例如 qemu-img convert 的 stdout、HTTP 响应或解压缩流。size 为 -1 表示长度未知，
+// 否则读取的长度必须与 size 一致。上传过程中同步计算 digest，按 UploadChunkSize 分片提交。
+// 流只能读取一次，中断后需要从头重新上传
+func (fm *fileManager) UploadReader(ctx context.Context, r io.Reader, size int64, harborRepo, tag string, opts *UploadOptions) (*types.BlobInfo, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	if size < -1 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	reader := bufio.NewReaderSize(r, sniffHeaderSize)
+	mediaType := opts.MediaType
+	if mediaType == "" {
+		// 未读满文件头时 Peek 返回 io.EOF 等错误，交给后面的读取处理
+		header, _ := reader.Peek(sniffHeaderSize)
+		mediaType = detectMediaType(header)
+	}
+
+	progress := fm.newProgressTracker(ctx, harborRepo, tag)
+	blobInfo, err := fm.putBlobStream(ctx, reader, size, harborRepo, progress)
+	if err != nil {
+		return nil, err
+	}
+	blobInfo.MediaType = mediaType
+	if opts.Title != "" {
+		blobInfo.Annotations = map[string]string{imgspecv1.AnnotationTitle: opts.Title}
+	}
+	if err = fm.tagLayer(ctx, harborRepo, tag, blobInfo, opts, progress); err != nil {
+		return nil, err
+	}
+	progress.done()
+	return &blobInfo, nil
+}
+
+// putBlobStream 逐个读取 UploadChunkSize 大小的分片并上传，读取时计算 digest，最后用 digest 提交上传会话
+func (fm *fileManager) putBlobStream(ctx context.Context, r io.Reader, size int64, harborRepo string, progress *progressTracker) (types.BlobInfo, error) {
+	backend, err := fm.getBackend()
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	policy := fm.retryPolicy()
+	session, err := startUpload(ctx, policy, backend, harborRepo)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+
+	digester := digest.Canonical.Digester()
+	chunkSize := fm.uploadChunkSize()
+	if size >= 0 && size < chunkSize {
+		// 小文件不必分配整个分片大小的缓冲区
+		chunkSize = max(size, 1)
+	}
+	buf := make([]byte, chunkSize)
+	var offset int64
+	progress.phase(PhaseUploading, 0, size)
+	for {
+		if err = ctx.Err(); err != nil {
+			return types.BlobInfo{}, err
+		}
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return types.BlobInfo{}, readErr
+		}
+		if n > 0 {
+			if size >= 0 && offset+int64(n) > size {
+				return types.BlobInfo{}, fmt.Errorf("stream is longer than the declared size %d", size)
+			}
+			digester.Hash().Write(buf[:n])
+			// 流中之前的数据已经丢弃，会话失效后无法重新上传
+			chunk := &progressReaderAt{ReaderAt: &chunkReaderAt{data: buf[:n], offset: offset}, tracker: progress}
+			if session, err = uploadChunk(ctx, policy, backend, harborRepo, session, chunk, offset, int64(n), false); err != nil {
+				return types.BlobInfo{}, err
+			}
+			offset += int64(n)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if size >= 0 && offset != size {
+		return types.BlobInfo{}, fmt.Errorf("stream ended after %d bytes, expected %d", offset, size)
+	}
+
+	blobInfo := types.BlobInfo{Digest: digester.Digest(), Size: offset}
+	progress.setBlob(blobInfo.Digest, blobInfo.Size)
+	if err = commitUpload(ctx, policy, backend, harborRepo, session, blobInfo.Digest); err != nil {
+		return types.BlobInfo{}, err
+	}
+	return blobInfo, nil
+}
+
+// chunkReaderAt 把内存中的一个分片适配为 UploadChunk 使用的 io.ReaderAt，offset 是分片在整个 blob 中的位置
+type chunkReaderAt struct {
+	data   []byte
+	offset int64
+}
+
+func (c *chunkReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	off -= c.offset
+	if off < 0 || off >= int64(len(c.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
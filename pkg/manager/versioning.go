@@ -0,0 +1,70 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// VersioningPolicy 决定 UploadFile 如何处理 tag 中已有的文件
+type VersioningPolicy string
+
+const (
+	// VersioningReplace tag 中只保留最新上传的文件
+	VersioningReplace VersioningPolicy = "replace"
+	// VersioningAppend 保留全部历史，下载时总是返回最新的文件，默认策略
+	VersioningAppend VersioningPolicy = "append"
+
+	keepLastPrefix = "keep-last-"
+)
+
+// KeepLast 返回保留最近 n 个文件的策略，即 "keep-last-<n>"
+func KeepLast(n int) VersioningPolicy {
+	return VersioningPolicy(keepLastPrefix + strconv.Itoa(n))
+}
+
+// keep 返回 tag 中最多保留的文件个数，0 表示不限制
+func (p VersioningPolicy) keep() (int, error) {
+	switch {
+	case p == "" || p == VersioningAppend:
+		return 0, nil
+	case p == VersioningReplace:
+		return 1, nil
+	case strings.HasPrefix(string(p), keepLastPrefix):
+		n, err := strconv.Atoi(strings.TrimPrefix(string(p), keepLastPrefix))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid versioning policy %q", p)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unknown versioning policy %q", p)
+	}
+}
+
+// Version 是 tag 中保存的一个历史文件
+type Version struct {
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	MediaType string        `json:"mediaType"`
+	// Created 上传时间，旧版本写入的 layer 没有记录时为零值
+	Created time.Time `json:"created"`
+}
+
+// versionsFromManifest 按从新到旧的顺序返回 manifest 中的文件
+func versionsFromManifest(manifest *imgspecv1.Manifest) []Version {
+	layers := fileLayers(manifest)
+	versions := make([]Version, 0, len(layers))
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+		version := Version{Digest: layer.Digest, Size: layer.Size, MediaType: layer.MediaType}
+		if created, ok := layer.Annotations[imgspecv1.AnnotationCreated]; ok {
+			version.Created, _ = time.Parse(time.RFC3339, created)
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}